@@ -1,25 +1,27 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
-
-	"compress/gzip"
+	"strings"
+	"time"
 
 	"github.com/project-machine/bootkit/go/pkg/initrd"
 	cli "github.com/urfave/cli/v2"
 )
 
-var _ = initrd.Identity
-
 var initrdCmd = cli.Command{
 	Name: "initrd",
 	Subcommands: []*cli.Command{
 		&cli.Command{
 			Name:      "join",
+			Usage:     "Join cpio archives and dirs into an initramfs",
 			ArgsUsage: "output-initrd cpio-ish [cpio-ish ...]",
-			Action:    doInitrdJoin,
+			Description: `Each cpio-ish is either a path to a cpio archive (compressed or not)
+   or 'dir:<path>' to include the content of the directory <path>.`,
+			Action: doInitrdJoin,
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:      "microcode",
@@ -28,103 +30,340 @@ var initrdCmd = cli.Command{
 					TakesFile: true,
 					Value:     "",
 				},
+				&cli.StringFlag{
+					Name:  "microcode-dir",
+					Usage: "Generate microcode from intel-ucode/ and amd-ucode/ in dir",
+					Value: "",
+				},
 				&cli.BoolFlag{
 					Name:    "gzip",
 					Aliases: []string{"z"},
-					Usage:   "Compress with gzip",
+					Usage:   "Compress with gzip (same as --compress=gzip)",
+				},
+				&cli.StringFlag{
+					Name:  "compress",
+					Usage: "Compress with none, gzip, zstd, xz, lzma or lz4",
+					Value: "",
+				},
+				&cli.StringFlag{
+					Name:  "dedupe",
+					Usage: "Include each path only once. 'last' or 'first' is kept",
+					Value: "",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "create",
+			Usage:     "Create a cpio archive from a directory",
+			ArgsUsage: "dir output-cpio",
+			Description: `The content of dir is archived in sorted order. If SOURCE_DATE_EPOCH
+   is set, it is used as the mtime of every entry.`,
+			Action: doInitrdCreate,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "compress",
+					Usage: "Compress with none, gzip, zstd, xz, lzma or lz4",
+					Value: "",
+				},
+				&cli.BoolFlag{
+					Name:    "gzip",
+					Aliases: []string{"z"},
+					Usage:   "Compress with gzip (same as --compress=gzip)",
+				},
+				&cli.UintFlag{
+					Name:  "uid",
+					Usage: "Owner uid of every entry",
+					Value: 0,
+				},
+				&cli.UintFlag{
+					Name:  "gid",
+					Usage: "Owner gid of every entry",
+					Value: 0,
+				},
+				&cli.BoolFlag{
+					Name:  "keep-owner",
+					Usage: "Keep the owner of each file instead of using --uid and --gid",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "microcode",
+			Usage:     "Create an early microcode cpio archive",
+			ArgsUsage: "firmware-dir output-cpio",
+			Description: `Create the uncompressed early microcode archive from the vendor
+   microcode in firmware-dir/intel-ucode/* and firmware-dir/amd-ucode/*.bin.`,
+			Action: doInitrdMicrocode,
+		},
+		&cli.Command{
+			Name:      "list",
+			Usage:     "List the segments and files in an initramfs",
+			ArgsUsage: "initrd",
+			Action:    doInitrdList,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Write output as json",
+				},
+				&cli.IntFlag{
+					Name:  "segment",
+					Usage: "Only list segment number <segment>",
+					Value: -1,
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "extract",
+			Usage:     "Extract files from an initramfs",
+			ArgsUsage: "initrd output-dir [path ...]",
+			Description: `Extract the content of every segment of initrd into output-dir.
+   If paths are given, only those paths and their content are extracted.`,
+			Action: doInitrdExtract,
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "segment",
+					Usage: "Only extract segment number <segment>",
+					Value: -1,
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "overlay",
+			Usage:     "Add or replace files in an initramfs",
+			ArgsUsage: "input-initrd output-initrd src:dest|dir:DIR [...]",
+			Description: `Write input-initrd to output-initrd with files added.  Each src:dest
+   adds the file or directory src at dest, and dir:DIR adds the content
+   of DIR at the root.  Entries of input-initrd at those paths are
+   replaced.  Segments without replaced entries, such as early
+   microcode, are copied unchanged and compression is kept.`,
+			Action: doInitrdOverlay,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "compress",
+					Usage: "Compression of the added segment: none, gzip, zstd, xz, lzma or lz4 (default: that of input-initrd)",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "diff",
+			Usage:     "Show the differences between two initramfs",
+			ArgsUsage: "old-initrd new-initrd",
+			Description: `Compare the content of every segment of old-initrd and new-initrd,
+   reporting paths that were added, removed or modified.  Mode, owner,
+   size, content, symlink target and device numbers are compared;
+   modification times are not.  Exit status is 1 if there are
+   differences.`,
+			Action: doInitrdDiff,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Write output as json",
 				},
 			},
 		},
 	},
 }
 
-func isGzipped(buf []byte) bool {
-	if len(buf) < 2 {
-		return false
-	}
-	return buf[0] == 0x1f && buf[1] == 0x8b
-}
-
-/*
-// i started working with this, trying to think about how to support
-// zstd and gzip decompression.
-// the thought to use a multiReader is possibly useful to "replay" the buff.
-// also thought to try a type assertion to a seeker and seek backwards the
-// amount that was read if it can.
-//
-// last, https://github.com/golang/go/issues/51092
-func uncompressedReader(r io.Reader) (io.Reader, error) {
-	var bbuf bytes.Buffer
-	// read into a buf from r. buf is smallest size to be
-	// able to determine if it is compressed.
-	buf := make([]byte, 2, 2)
-	n, err := r.Read(buf)
-	if err != nil && err != io.EOF {
-		return nil, err
-	} else if n < len(buf) {
-		bbuf.Write(buf)
-		return &bbuf, nil
-	}
+type cpioReadCloser interface {
+	initrd.CpioReader
+	io.Closer
+}
 
-	// if we have a seeker, we can avoid the multireader
-	rSeeker, ok := r.(io.ReadSeeker)
-	if ok {
-		if _, err := rSeeker.Seek((int64)(-n), io.SeekCurrent); err != nil {
+// newCpioReader - return a reader for 'arg' which is either a path
+// to a cpio archive or 'dir:<path>'.
+func newCpioReader(arg string) (cpioReadCloser, error) {
+	if strings.HasPrefix(arg, "dir:") {
+		opts, err := initrd.DirOptionsFromEnv()
+		if err != nil {
 			return nil, err
 		}
-	} else {
-		var bbuf bytes.Buffer
-		bbuf.Write(buf)
-		r = io.MultiReader(&bbuf, r)
+		return initrd.NewCpioDirReader(strings.TrimPrefix(arg, "dir:"), opts)
 	}
+	return initrd.NewCpioFileReader(arg)
+}
 
-	type nr func(io.Reader) (*gzip.Reader, error)
-	f := []nr{gzip.NewReader}
-	for _, f := range []nr{gzip.NewReader} {
+// joinArgs - return a comma separated list of args at indexes.
+func joinArgs(args []string, indexes []int) string {
+	names := make([]string, len(indexes))
+	for i, idx := range indexes {
+		names[i] = args[idx]
 	}
-	gzip.NewReader
-	// if you can gzip.NewReader(bytes.Buffer(buf))
-	return nil, nil
+	return strings.Join(names, ", ")
 }
-*/
 
-func uncompressedPathReader(path string) (io.ReadCloser, error) {
-	r, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// compressionFlag - return the compression selected by --gzip or --compress.
+func compressionFlag(ctx *cli.Context) (initrd.Compression, error) {
+	name := ctx.String("compress")
+	if ctx.Bool("gzip") {
+		if name != "" && name != "gzip" {
+			return initrd.Undetermined, fmt.Errorf("--gzip conflicts with --compress=%s", name)
+		}
+		name = "gzip"
+	}
+	if name == "" {
+		return initrd.Identity, nil
+	}
+	return initrd.ParseCompression(name)
+}
+
+func doInitrdJoin(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+
+	if len(args) < 2 {
+		return fmt.Errorf("Got %d args, expect 2 or more", len(args))
+	}
+	output := args[0]
+
+	var microcode initrd.CpioReader
+	mcpath, mcdir := ctx.String("microcode"), ctx.String("microcode-dir")
+	if mcpath != "" && mcdir != "" {
+		return fmt.Errorf("--microcode and --microcode-dir are mutually exclusive")
+	}
+	if mcpath != "" {
+		r, err := newCpioReader(mcpath)
+		if err != nil {
+			return fmt.Errorf("Failed to read microcode %s: %v", mcpath, err)
+		}
+		defer r.Close()
+		microcode = r
+	} else if mcdir != "" {
+		opts, err := initrd.DirOptionsFromEnv()
+		if err != nil {
+			return err
+		}
+		r, err := initrd.NewMicrocodeReader(mcdir, opts)
+		if err != nil {
+			return fmt.Errorf("Failed to read microcode from %s: %v", mcdir, err)
+		}
+		defer r.Close()
+		microcode = r
+	}
+
+	readers := []initrd.CpioReader{}
+	for _, arg := range args[1:] {
+		r, err := newCpioReader(arg)
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %v", arg, err)
+		}
+		defer r.Close()
+		readers = append(readers, r)
 	}
 
-	buf := make([]byte, 2, 2)
-	n, err := r.Read(buf)
+	comp, err := compressionFlag(ctx)
 	if err != nil {
-		r.Close()
-		return nil, err
+		return err
 	}
 
-	if _, err := r.Seek(0, io.SeekStart); err != nil {
-		r.Close()
-		return nil, err
+	var deduped *initrd.DedupedReader
+	if policy := ctx.String("dedupe"); policy != "" {
+		switch policy {
+		case "last":
+			deduped, err = initrd.NewDedupedReader(readers, initrd.LastWins)
+		case "first":
+			deduped, err = initrd.NewDedupedReader(readers, initrd.FirstWins)
+		default:
+			return fmt.Errorf("Unknown dedupe policy '%s': expected 'last' or 'first'", policy)
+		}
+		if err != nil {
+			return err
+		}
+		defer deduped.Close()
+		readers = []initrd.CpioReader{deduped}
 	}
 
-	if n < 2 || !isGzipped(buf) {
-		return r, nil
+	var outWriter io.Writer = os.Stdout
+	if output != "-" {
+		w, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		outWriter = w
 	}
 
-	zRead, err := gzip.NewReader(r)
+	if err := initrd.Join(outWriter, microcode, comp, readers...); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", output, err)
+	}
+
+	if deduped != nil {
+		for _, c := range deduped.Collisions() {
+			fmt.Fprintf(os.Stderr, "%s: present in %s, kept %s\n",
+				c.Name, joinArgs(args[1:], c.Sources), args[1+c.Winner])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote to %s\n", output)
+
+	return nil
+}
+
+func doInitrdCreate(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) != 2 {
+		return fmt.Errorf("Got %d args, expected 2", len(args))
+	}
+	dir := args[0]
+	output := args[1]
+
+	comp, err := compressionFlag(ctx)
 	if err != nil {
-		r.Close()
-		return nil, err
+		return err
+	}
+
+	opts, err := initrd.DirOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+	opts.UID = uint32(ctx.Uint("uid"))
+	opts.GID = uint32(ctx.Uint("gid"))
+	opts.KeepOwner = ctx.Bool("keep-owner")
+
+	r, err := initrd.NewCpioDirReader(dir, opts)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := r.SetCompression(comp); err != nil {
+		return err
+	}
+
+	var outWriter io.Writer = os.Stdout
+	if output != "-" {
+		w, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		outWriter = w
+	}
+
+	if _, err := io.Copy(outWriter, r); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", output, err)
 	}
-	return zRead, nil
+
+	fmt.Fprintf(os.Stderr, "Wrote to %s\n", output)
+
+	return nil
 }
 
-func doInitrdJoin(ctx *cli.Context) error {
+func doInitrdMicrocode(ctx *cli.Context) error {
 	args := ctx.Args().Slice()
+	if len(args) != 2 {
+		return fmt.Errorf("Got %d args, expected 2", len(args))
+	}
+	dir := args[0]
+	output := args[1]
 
-	if len(args) < 2 {
-		return fmt.Errorf("Got %d args, expect 2 or more", len(args))
+	opts, err := initrd.DirOptionsFromEnv()
+	if err != nil {
+		return err
 	}
-	output := args[0]
+
+	r, err := initrd.NewMicrocodeReader(dir, opts)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 
 	var outWriter io.Writer = os.Stdout
 	if output != "-" {
@@ -136,20 +375,341 @@ func doInitrdJoin(ctx *cli.Context) error {
 		outWriter = w
 	}
 
-	if mcpath := ctx.String("microcode"); mcpath != "" {
-		mcReader, err := uncompressedPathReader(ctx.String("microcode"))
+	if _, err := io.Copy(outWriter, r); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", output, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote to %s\n", output)
+
+	return nil
+}
+
+type listEntry struct {
+	Name  string `json:"name"`
+	Mode  string `json:"mode"`
+	UID   uint32 `json:"uid"`
+	GID   uint32 `json:"gid"`
+	Size  uint32 `json:"size"`
+	Mtime uint32 `json:"mtime"`
+	Ino   uint32 `json:"ino"`
+	Nlink uint32 `json:"nlink"`
+	Rdev  string `json:"rdev,omitempty"`
+	Link  string `json:"link,omitempty"`
+}
+
+type listSegment struct {
+	Index       int                `json:"index"`
+	Offset      int64              `json:"offset"`
+	Size        int64              `json:"size"`
+	Compression initrd.Compression `json:"compression"`
+	Entries     []listEntry        `json:"entries"`
+}
+
+func newListEntry(hdr *initrd.Header, r io.Reader) (listEntry, error) {
+	e := listEntry{
+		Name:  hdr.Name,
+		Mode:  hdr.FileMode().String(),
+		UID:   hdr.UID,
+		GID:   hdr.GID,
+		Size:  hdr.FileSize,
+		Mtime: hdr.Mtime,
+		Ino:   hdr.Ino,
+		Nlink: hdr.Nlink,
+	}
+	switch hdr.Mode & initrd.ModeTypeMask {
+	case initrd.ModeBlock, initrd.ModeChar:
+		e.Rdev = fmt.Sprintf("%d:%d", hdr.RDevMajor, hdr.RDevMinor)
+	case initrd.ModeSymlink:
+		target, err := io.ReadAll(r)
+		if err != nil {
+			return e, err
+		}
+		e.Link = string(target)
+	}
+	return e, nil
+}
+
+func (e listEntry) String() string {
+	name := e.Name
+	if e.Link != "" {
+		name += " -> " + e.Link
+	}
+	size := fmt.Sprintf("%d", e.Size)
+	if e.Rdev != "" {
+		size = e.Rdev
+	}
+	return fmt.Sprintf("%s %5d/%-5d %10s %s %s", e.Mode, e.UID, e.GID, size,
+		time.Unix(int64(e.Mtime), 0).UTC().Format("2006-01-02 15:04"), name)
+}
+
+func (s listSegment) String() string {
+	return fmt.Sprintf("segment %d: offset=%d size=%d compression=%s entries=%d",
+		s.Index, s.Offset, s.Size, s.Compression, len(s.Entries))
+}
+
+func doInitrdList(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) != 1 {
+		return fmt.Errorf("Got %d args, expected 1", len(args))
+	}
+
+	r, err := initrd.NewCpioFileReader(args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	sr, err := r.Segments()
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+
+	want := ctx.Int("segment")
+	segments := []listSegment{}
+	for {
+		hdr, err := sr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed reading %s: %v", args[0], err)
+		}
+		seg := sr.Segment()
+		if want >= 0 && seg.Index != want {
+			continue
+		}
+		if len(segments) == 0 || segments[len(segments)-1].Index != seg.Index {
+			segments = append(segments, listSegment{
+				Index: seg.Index, Offset: seg.Offset, Compression: seg.Compression})
+		}
+		entry, err := newListEntry(hdr, sr)
+		if err != nil {
+			return fmt.Errorf("Failed reading %s: %v", hdr.Name, err)
+		}
+		cur := &segments[len(segments)-1]
+		cur.Entries = append(cur.Entries, entry)
+	}
+
+	// sizes are only known once a segment has been read.
+	for i := range segments {
+		segments[i].Size = sr.Segments()[segments[i].Index].Size
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(segments)
+	}
+
+	for _, seg := range segments {
+		fmt.Println(seg)
+		for _, e := range seg.Entries {
+			fmt.Println("  " + e.String())
+		}
+	}
+	return nil
+}
+
+func doInitrdExtract(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) < 2 {
+		return fmt.Errorf("Got %d args, expected 2 or more", len(args))
+	}
+	input := args[0]
+	outDir := args[1]
+	paths := args[2:]
+
+	r, err := initrd.NewCpioFileReader(input)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	sr, err := r.Segments()
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	want := ctx.Int("segment")
+	var pathMatch func(initrd.Segment, *initrd.Header) bool
+	if len(paths) != 0 {
+		pathMatch = initrd.PathMatcher(paths...)
+	}
+	match := func(seg initrd.Segment, hdr *initrd.Header) bool {
+		if want >= 0 && seg.Index != want {
+			return false
+		}
+		return pathMatch == nil || pathMatch(seg, hdr)
+	}
+
+	e, err := initrd.ExtractAll(sr, outDir, match)
+	if err != nil {
+		return fmt.Errorf("Failed extracting %s: %v", input, err)
+	}
+
+	for _, name := range e.Skipped {
+		fmt.Fprintf(os.Stderr, "Skipped device %s: permission denied\n", name)
+	}
+	fmt.Fprintf(os.Stderr, "Extracted to %s\n", outDir)
+
+	return nil
+}
+
+// parseOverlayArg - parse 'src:dest' or 'dir:<path>'.
+func parseOverlayArg(arg string) (initrd.OverlayFile, error) {
+	if strings.HasPrefix(arg, "dir:") {
+		return initrd.OverlayFile{Src: strings.TrimPrefix(arg, "dir:"), Dest: "/"}, nil
+	}
+	idx := strings.LastIndex(arg, ":")
+	if idx <= 0 || idx == len(arg)-1 {
+		return initrd.OverlayFile{}, fmt.Errorf("Bad overlay '%s': expected src:dest or dir:DIR", arg)
+	}
+	return initrd.OverlayFile{Src: arg[:idx], Dest: arg[idx+1:]}, nil
+}
+
+func doInitrdOverlay(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) < 3 {
+		return fmt.Errorf("Got %d args, expected 3 or more", len(args))
+	}
+	input := args[0]
+	output := args[1]
+
+	if input == output {
+		return fmt.Errorf("Output %s must differ from input", output)
+	}
+
+	comp := initrd.Undetermined
+	if name := ctx.String("compress"); name != "" {
+		var err error
+		if comp, err = initrd.ParseCompression(name); err != nil {
+			return err
+		}
+	}
+
+	files := []initrd.OverlayFile{}
+	for _, arg := range args[2:] {
+		f, err := parseOverlayArg(arg)
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(outWriter, mcReader)
+		if !PathExists(f.Src) {
+			return fmt.Errorf("%s does not exist", f.Src)
+		}
+		files = append(files, f)
+	}
+
+	opts, err := initrd.DirOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	var outWriter io.Writer = os.Stdout
+	if output != "-" {
+		w, err := os.Create(output)
 		if err != nil {
 			return err
 		}
+		defer w.Close()
+		outWriter = w
+	}
 
-		mcReader.Close()
+	if err := initrd.Overlay(outWriter, input, files, comp, opts); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", output, err)
 	}
 
 	fmt.Fprintf(os.Stderr, "Wrote to %s\n", output)
 
 	return nil
 }
+
+// readFileStates - return the state of each path in the initramfs at path.
+func readFileStates(path string) (map[string]*initrd.FileState, error) {
+	r, err := initrd.NewCpioFileReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	sr, err := r.Segments()
+	if err != nil {
+		return nil, err
+	}
+	defer sr.Close()
+
+	states, err := initrd.ReadFileStates(sr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading %s: %v", path, err)
+	}
+	return states, nil
+}
+
+func changeString(c initrd.Change) string {
+	switch c.Type {
+	case initrd.Added:
+		return fmt.Sprintf("A %s %s %d/%d %d", c.Path, c.New.Perms, c.New.UID, c.New.GID, c.New.Size)
+	case initrd.Removed:
+		return fmt.Sprintf("D %s", c.Path)
+	}
+
+	diffs := []string{}
+	for _, field := range c.Fields {
+		var from, to string
+		switch field {
+		case "type", "mode":
+			from, to = c.Old.Perms, c.New.Perms
+		case "owner":
+			from, to = fmt.Sprintf("%d/%d", c.Old.UID, c.Old.GID), fmt.Sprintf("%d/%d", c.New.UID, c.New.GID)
+		case "size":
+			from, to = fmt.Sprintf("%d", c.Old.Size), fmt.Sprintf("%d", c.New.Size)
+		case "content":
+			diffs = append(diffs, "content")
+			continue
+		case "link":
+			from, to = c.Old.Link, c.New.Link
+		case "rdev":
+			from, to = c.Old.Rdev, c.New.Rdev
+		}
+		diffs = append(diffs, fmt.Sprintf("%s %s -> %s", field, from, to))
+	}
+	return fmt.Sprintf("M %s: %s", c.Path, strings.Join(diffs, ", "))
+}
+
+func doInitrdDiff(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) != 2 {
+		return fmt.Errorf("Got %d args, expected 2", len(args))
+	}
+
+	from, err := readFileStates(args[0])
+	if err != nil {
+		return err
+	}
+	to, err := readFileStates(args[1])
+	if err != nil {
+		return err
+	}
+
+	changes := initrd.DiffStates(from, to)
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(changes); err != nil {
+			return err
+		}
+	} else {
+		for _, c := range changes {
+			fmt.Println(changeString(c))
+		}
+	}
+
+	if len(changes) != 0 {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
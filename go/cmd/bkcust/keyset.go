@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/project-machine/bootkit/go/pkg/cert"
+	"github.com/project-machine/bootkit/go/pkg/signer"
+	cli "github.com/urfave/cli/v2"
+)
+
+var keysetCmd = cli.Command{
+	Name:  "keyset",
+	Usage: "Work with keysets",
+	Subcommands: []*cli.Command{
+		&cli.Command{
+			Name:      "create",
+			Usage:     "Create a new keyset",
+			ArgsUsage: "keyset-dir",
+			Description: `Create keyset-dir, which must not exist, holding a directory for each key
+   with privkey.pem and cert.pem:
+
+     uefi-pk, uefi-kek, uefi-db
+         the firmware keys, with owner guid files.  The PK is a self signed
+         CA that issues the KEK, which issues db for code signing.
+     uki-limited, uki-production, uki-tpm
+         the shim vendor db keys, with owner guid files, issued by the KEK
+         for code signing.
+
+   The uefi and uki keys sign EFI binaries, so --uefi-algorithm, which they
+   are made with, must be an rsa algorithm.  The other keys are made with
+   --algorithm.
+     manifest-ca, sudi-ca
+         self signed CAs.
+     tpmpol-admin, tpmpol-luks
+         keys with pubkey.pem in place of cert.pem.
+
+   It can be used as KEYSET_D for the custom layer, except that the
+   pcr7data that the layer copies is not created.`,
+			Action: doKeysetCreate,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "org",
+					Usage: "The organization of the certificate subjects",
+					Value: "bootkit",
+				},
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "The organizational unit of the certificate subjects (default: the base name of keyset-dir)",
+				},
+				&cli.IntFlag{
+					Name:  "years",
+					Usage: "Make certificates valid for <years>",
+					Value: 25,
+				},
+				&cli.StringFlag{
+					Name:  "uefi-algorithm",
+					Usage: "The key algorithm of the uefi and uki keys: rsa2048, rsa3072 or rsa4096",
+					Value: "rsa2048",
+				},
+				&cli.StringFlag{
+					Name:  "algorithm",
+					Usage: "The key algorithm of the other keys: rsa2048, rsa3072, rsa4096, ecdsa-p256 or ecdsa-p384",
+					Value: "rsa2048",
+				},
+				&cli.StringFlag{
+					Name:  "owner",
+					Usage: "Use owner guid <owner> for every key (default: a random guid for each)",
+				},
+			},
+		},
+	},
+}
+
+func doKeysetCreate(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) != 1 {
+		return fmt.Errorf("Got %d args, expected 1", len(args))
+	}
+	dir := args[0]
+
+	if ctx.Int("years") <= 0 {
+		return fmt.Errorf("Invalid --years %d", ctx.Int("years"))
+	}
+	opts := cert.KeysetOptions{
+		Organization:  ctx.String("org"),
+		Name:          ctx.String("name"),
+		Validity:      time.Duration(ctx.Int("years")) * 365 * 24 * time.Hour,
+		UEFIAlgorithm: ctx.String("uefi-algorithm"),
+		Algorithm:     ctx.String("algorithm"),
+	}
+	if opts.Name == "" {
+		opts.Name = filepath.Base(filepath.Clean(dir))
+	}
+	if owner := ctx.String("owner"); owner != "" {
+		guid, err := efi.DecodeGUIDString(owner)
+		if err != nil {
+			return fmt.Errorf("Invalid --owner %s: %v", owner, err)
+		}
+		opts.Owner = guid
+	}
+
+	if err := cert.CreateKeyset(dir, opts); err != nil {
+		return fmt.Errorf("Failed creating keyset %s: %v", dir, err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote to %s\n", dir)
+	return nil
+}
+
+var keysetFlag = &cli.StringFlag{
+	Name:  "keyset",
+	Usage: "Use the keys of the keyset in <keyset>, as created by keyset create",
+}
+
+var keysetKeyFlag = &cli.StringFlag{
+	Name:  "keyset-key",
+	Usage: "Sign with key <keyset-key> of --keyset, such as uki-production or uefi-db",
+}
+
+// loadKeyset - return the keyset named by --keyset, or nil if it is not
+// set.  Encrypted keys are decrypted with --key-passphrase.
+func loadKeyset(ctx *cli.Context) (*cert.Keyset, error) {
+	dir := ctx.String("keyset")
+	if dir == "" {
+		return nil, nil
+	}
+	passphrase, err := keyPassphrase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ks, err := cert.LoadKeyset(dir, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("Failed loading keyset: %v", err)
+	}
+	return ks, nil
+}
+
+// keysetSigner - return the certificate and key named by --keyset-key
+// in ks.
+func keysetSigner(ctx *cli.Context, ks *cert.Keyset) (*x509.Certificate, crypto.Signer, error) {
+	name := ctx.String("keyset-key")
+	if name == "" {
+		return nil, nil, fmt.Errorf("--keyset-key is required to sign with --keyset")
+	}
+	k := ks.Key(name)
+	if k == nil {
+		return nil, nil, fmt.Errorf("Keyset %s has no key %s", ks.Dir, name)
+	}
+	if err := signer.CheckEFIKey(k.Cert.PublicKey); err != nil {
+		return nil, nil, fmt.Errorf("Cannot sign with key %s of keyset %s: %v", name, ks.Dir, err)
+	}
+	s, err := k.Signer()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed reading key %s of keyset %s: %v", name, ks.Dir, err)
+	}
+	return k.Cert, s, nil
+}
@@ -15,9 +15,13 @@ func main() {
 	app.Version = "0.0.1"
 	app.Commands = []*cli.Command{
 		&initrdCmd,
+		&keysetCmd,
+		&pcrCmd,
+		&peCmd,
 		&shimCmd,
 		&signEfiCmd,
 		&stubbyCmd,
+		&verifyEfiCmd,
 		&virtFwCmd,
 	}
 	app.Flags = []cli.Flag{
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/project-machine/bootkit/go/pkg/pcr"
+	cli "github.com/urfave/cli/v2"
+)
+
+var pcrCmd = cli.Command{
+	Name:  "pcr",
+	Usage: "Work with TPM PCR measurements",
+	Subcommands: []*cli.Command{
+		&cli.Command{
+			Name:      "predict",
+			Usage:     "Predict the SHA-256 values of PCRs 4, 7 and 11 when booting a kernel",
+			ArgsUsage: "kernel.efi",
+			Description: `Compute the measurements made when OVMF with the variables in --vars
+   boots kernel.efi, a unified kernel image, either directly (oci-boot
+   efi-kernel mode) or through --shim (efi-shim mode).
+
+   PCR 4 holds the Authenticode digests of shim and the kernel, PCR 7
+   the secure boot variables and the db or shim vendor_db entries that
+   allowed them, and PCR 11 the sections of the kernel as systemd-stub
+   measures them.`,
+			Action: doPCRPredict,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "vars",
+					Usage:    "The OVMF vars file",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "shim",
+					Usage: "Boot kernel.efi through shim <shim>",
+				},
+				&cli.StringFlag{
+					Name:  "sbat-level",
+					Usage: "The SbatLevel that shim measures, from the file <sbat-level>",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Write output as json",
+				},
+			},
+		},
+	},
+}
+
+func doPCRPredict(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) != 1 {
+		return fmt.Errorf("Got %d args, expected 1", len(args))
+	}
+
+	opts := pcr.Options{
+		Kernel: args[0],
+		Shim:   ctx.String("shim"),
+		Vars:   ctx.String("vars"),
+	}
+	if path := ctx.String("sbat-level"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		opts.SbatLevel = content
+	}
+
+	p, err := pcr.Predict(opts)
+	if err != nil {
+		return fmt.Errorf("Failed predicting PCRs: %v", err)
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	}
+
+	for _, e := range p.Log {
+		fmt.Printf("%2d %s %-33s %s\n", e.PCR, e.Digest, e.Type, e.Description)
+	}
+	pcrs := []int{}
+	for n := range p.PCRs {
+		pcrs = append(pcrs, n)
+	}
+	sort.Ints(pcrs)
+	for _, n := range pcrs {
+		fmt.Printf("pcr%d: %s\n", n, p.PCRs[n])
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"debug/pe"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/project-machine/bootkit/go/pkg/obj"
+	"github.com/project-machine/bootkit/go/pkg/shim"
+	cli "github.com/urfave/cli/v2"
+)
+
+var peCmd = cli.Command{
+	Name:  "pe",
+	Usage: "Operate on PE/COFF (EFI) binaries",
+	Subcommands: []*cli.Command{
+		&cli.Command{
+			Name:      "inspect",
+			Usage:     "Show the sections, signatures and embedded metadata of an EFI binary",
+			ArgsUsage: "file.efi",
+			Description: `Show the sections of file.efi with their sizes and sha256, the
+   content of .sbat, .cmdline, .uname and .osrel, the db and dbx in a shim .vendor_cert
+   and the subject of the signer of each Authenticode signature.`,
+			Action: doPEInspect,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Write output as json",
+				},
+			},
+		},
+	},
+}
+
+var peMachines = map[uint16]string{
+	pe.IMAGE_FILE_MACHINE_I386:    "x86",
+	pe.IMAGE_FILE_MACHINE_AMD64:   "x86_64",
+	pe.IMAGE_FILE_MACHINE_ARM:     "arm",
+	pe.IMAGE_FILE_MACHINE_ARMNT:   "arm",
+	pe.IMAGE_FILE_MACHINE_ARM64:   "aarch64",
+	pe.IMAGE_FILE_MACHINE_RISCV64: "riscv64",
+}
+
+var peSubsystems = map[uint16]string{
+	pe.IMAGE_SUBSYSTEM_EFI_APPLICATION:         "efi-application",
+	pe.IMAGE_SUBSYSTEM_EFI_BOOT_SERVICE_DRIVER: "efi-boot-service-driver",
+	pe.IMAGE_SUBSYSTEM_EFI_RUNTIME_DRIVER:      "efi-runtime-driver",
+	pe.IMAGE_SUBSYSTEM_EFI_ROM:                 "efi-rom",
+}
+
+type peSectionInfo struct {
+	Name            string `json:"name"`
+	VMA             uint64 `json:"vma"`
+	VirtualSize     uint32 `json:"virtual_size"`
+	RawSize         int    `json:"raw_size"`
+	Characteristics uint32 `json:"characteristics"`
+	SHA256          string `json:"sha256"`
+}
+
+type peCertInfo struct {
+	Type    string `json:"type"`
+	Owner   string `json:"owner"`
+	Subject string `json:"subject,omitempty"`
+	Issuer  string `json:"issuer,omitempty"`
+	// SHA256 - the hash for sha256 entries, or the fingerprint of a certificate.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type peVendorCert struct {
+	DB    []peCertInfo `json:"db"`
+	DBX   []peCertInfo `json:"dbx"`
+	Error string       `json:"error,omitempty"`
+}
+
+type peSignerInfo struct {
+	Subject  string `json:"subject"`
+	Issuer   string `json:"issuer"`
+	Serial   string `json:"serial"`
+	NotAfter string `json:"not_after"`
+}
+
+type peInfo struct {
+	Path       string          `json:"path"`
+	SHA256     string          `json:"sha256"`
+	Machine    string          `json:"machine"`
+	Subsystem  string          `json:"subsystem"`
+	ImageBase  uint64          `json:"image_base"`
+	Sections   []peSectionInfo `json:"sections"`
+	Sbat       string          `json:"sbat,omitempty"`
+	Cmdline    string          `json:"cmdline,omitempty"`
+	Uname      string          `json:"uname,omitempty"`
+	OSRel      string          `json:"osrel,omitempty"`
+	VendorCert *peVendorCert   `json:"vendor_cert,omitempty"`
+	Signers    []peSignerInfo  `json:"signers"`
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func lookupName(names map[uint16]string, v uint16) string {
+	if name, ok := names[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", v)
+}
+
+func newCertInfos(db efi.SignatureDatabase) []peCertInfo {
+	infos := []peCertInfo{}
+	for _, l := range db {
+		for _, sig := range l.Signatures {
+			info := peCertInfo{Owner: sig.Owner.String(), Type: l.Type.String()}
+			switch l.Type {
+			case efi.CertX509Guid:
+				info.Type = "x509"
+				info.SHA256 = sha256Hex(sig.Data)
+				if c, err := x509.ParseCertificate(sig.Data); err == nil {
+					info.Subject = c.Subject.String()
+					info.Issuer = c.Issuer.String()
+				} else {
+					info.Subject = fmt.Sprintf("unparseable certificate: %v", err)
+				}
+			case efi.CertSHA256Guid:
+				info.Type = "sha256"
+				info.SHA256 = hex.EncodeToString(sig.Data)
+			}
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// newPEInfo - return the information shown by 'pe inspect' for the
+// image in data.
+func newPEInfo(path string, data []byte) (*peInfo, error) {
+	p, err := obj.ParsePE(data)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &peInfo{
+		Path:      path,
+		SHA256:    sha256Hex(data),
+		Machine:   lookupName(peMachines, p.Machine()),
+		Subsystem: lookupName(peSubsystems, p.Subsystem()),
+		ImageBase: p.ImageBase(),
+		Sections:  []peSectionInfo{},
+		Signers:   []peSignerInfo{},
+	}
+
+	for _, s := range p.Sections {
+		content := s.Content()
+		info.Sections = append(info.Sections, peSectionInfo{
+			Name:            s.Name,
+			VMA:             p.ImageBase() + uint64(s.VirtualAddress),
+			VirtualSize:     s.VirtualSize,
+			RawSize:         len(s.Data),
+			Characteristics: s.Characteristics,
+			SHA256:          sha256Hex(content),
+		})
+
+		switch s.Name {
+		case ".sbat":
+			info.Sbat = strings.TrimRight(string(content), "\x00")
+		case ".cmdline":
+			info.Cmdline = strings.TrimRight(string(content), "\x00")
+		case ".uname":
+			info.Uname = strings.TrimRight(string(content), "\x00")
+		case ".osrel":
+			info.OSRel = strings.TrimRight(string(content), "\x00")
+		}
+	}
+
+	if s := p.Section(".vendor_cert"); s != nil {
+		db, dbx, err := shim.ParseVendorDB(s.Content())
+		if err != nil {
+			info.VendorCert = &peVendorCert{Error: err.Error()}
+		} else {
+			info.VendorCert = &peVendorCert{DB: newCertInfos(db), DBX: newCertInfos(dbx)}
+		}
+	}
+
+	sigs, err := p.Signatures()
+	if err != nil {
+		return nil, err
+	}
+	for i, sig := range sigs {
+		signers, err := sig.Signers()
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading signature %d: %v", i, err)
+		}
+		for _, c := range signers {
+			info.Signers = append(info.Signers, peSignerInfo{
+				Subject:  c.Subject.String(),
+				Issuer:   c.Issuer.String(),
+				Serial:   c.SerialNumber.Text(16),
+				NotAfter: c.NotAfter.UTC().Format("2006-01-02"),
+			})
+		}
+	}
+
+	return info, nil
+}
+
+func (c peCertInfo) String() string {
+	if c.Subject == "" {
+		return fmt.Sprintf("%s %s owner=%s", c.Type, c.SHA256, c.Owner)
+	}
+	return fmt.Sprintf("%s subject=%q issuer=%q owner=%s", c.Type, c.Subject, c.Issuer, c.Owner)
+}
+
+func (info *peInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: sha256=%s\n", info.Path, info.SHA256)
+	fmt.Fprintf(&b, "machine=%s subsystem=%s image-base=0x%x\n", info.Machine, info.Subsystem, info.ImageBase)
+
+	fmt.Fprintf(&b, "sections:\n")
+	fmt.Fprintf(&b, "  %-12s %18s %10s %10s %s\n", "name", "vma", "vsize", "rawsize", "sha256")
+	for _, s := range info.Sections {
+		fmt.Fprintf(&b, "  %-12s %#18x %#10x %#10x %s\n", s.Name, s.VMA, s.VirtualSize, s.RawSize, s.SHA256)
+	}
+
+	if info.Sbat != "" {
+		fmt.Fprintf(&b, "sbat:\n")
+		for _, line := range strings.Split(strings.TrimRight(info.Sbat, "\n"), "\n") {
+			fmt.Fprintf(&b, "  %s\n", line)
+		}
+	}
+	if info.Cmdline != "" {
+		fmt.Fprintf(&b, "cmdline: %s\n", strings.TrimSpace(info.Cmdline))
+	}
+
+	if info.Uname != "" {
+		fmt.Fprintf(&b, "uname: %s\n", strings.TrimSpace(info.Uname))
+	}
+	if info.OSRel != "" {
+		fmt.Fprintf(&b, "osrel:\n")
+		for _, line := range strings.Split(strings.TrimRight(info.OSRel, "\n"), "\n") {
+			fmt.Fprintf(&b, "  %s\n", line)
+		}
+	}
+
+	if info.VendorCert != nil {
+		fmt.Fprintf(&b, "vendor_cert:\n")
+		if info.VendorCert.Error != "" {
+			fmt.Fprintf(&b, "  error: %s\n", info.VendorCert.Error)
+		}
+		for _, c := range info.VendorCert.DB {
+			fmt.Fprintf(&b, "  db: %s\n", c)
+		}
+		for _, c := range info.VendorCert.DBX {
+			fmt.Fprintf(&b, "  dbx: %s\n", c)
+		}
+	}
+
+	if len(info.Signers) == 0 {
+		fmt.Fprintf(&b, "signers: none\n")
+	} else {
+		fmt.Fprintf(&b, "signers:\n")
+		for _, s := range info.Signers {
+			fmt.Fprintf(&b, "  subject=%q issuer=%q serial=%s not-after=%s\n", s.Subject, s.Issuer, s.Serial, s.NotAfter)
+		}
+	}
+	return b.String()
+}
+
+func doPEInspect(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) != 1 {
+		return fmt.Errorf("Got %d args, expected 1", len(args))
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	info, err := newPEInfo(args[0], data)
+	if err != nil {
+		return fmt.Errorf("Failed inspecting %s: %v", args[0], err)
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	fmt.Print(info)
+	return nil
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"strings"
 
 	efi "github.com/canonical/go-efilib"
 	"github.com/project-machine/bootkit/go/pkg/cert"
@@ -16,8 +15,14 @@ var shimCmd = cli.Command{
 	Subcommands: []*cli.Command{
 		&cli.Command{
 			Name:      "set-db",
-			ArgsUsage: "shim.efi guid:cert [keydir:path/to/dir/ ...]",
-			Action:    doSetDB,
+			ArgsUsage: "shim.efi [guid:cert | keydir:path/to/dir/ | cert | file.esl ...]",
+			Description: `Replace the vendor db of shim.efi with the given certificates: a key
+   directory with cert.pem and guid, owned by the zero guid if it has no
+   guid file, a PEM or DER certificate owned by guid or by the zero guid,
+   or the entries of an EFI signature list.  With
+   --keyset, the uki-limited, uki-production and uki-tpm keys of the keyset
+   come first.`,
+			Action: doSetDB,
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:    "output",
@@ -25,6 +30,7 @@ var shimCmd = cli.Command{
 					Usage:   "Put modified shim in <output>",
 					Value:   "",
 				},
+				keysetFlag,
 			},
 		},
 	},
@@ -38,6 +44,24 @@ func doSetDB(ctx *cli.Context) error {
 	shimEfi := args[0]
 	guidCerts := args[1:]
 
+	ks, err := loadKeyset(ctx)
+	if err != nil {
+		return err
+	}
+	if ks == nil && len(guidCerts) == 0 {
+		return fmt.Errorf("Need certificates or --keyset")
+	}
+
+	db := efi.SignatureDatabase{}
+	if ks != nil {
+		db = cert.NewEFISignatureDatabase(ks.VendorDBSignatureData())
+	}
+	argsDB, err := cert.ReadSignatureArgs(guidCerts)
+	if err != nil {
+		return fmt.Errorf("Failed reading certificates: %v", err)
+	}
+	db = append(db, argsDB...)
+
 	if !PathExists(shimEfi) {
 		return fmt.Errorf("shim '%s' does not exist", shimEfi)
 	}
@@ -49,34 +73,5 @@ func doSetDB(ctx *cli.Context) error {
 		shimEfi = output
 	}
 
-	// guidCerts are either <uuid>:*.pem or a "keydir" expected to
-	// have a 'guid' and 'cert.pem' file
-	certPath := ""
-	sigDatas := []*efi.SignatureData{}
-	for _, p := range guidCerts {
-		if IsDir(p) {
-			sd, err := cert.LoadSignatureDataDir(p)
-			if err != nil {
-				return fmt.Errorf("guidCert arg %s is a dir: %s", p, err)
-			}
-			sigDatas = append(sigDatas, sd)
-		} else {
-			toks := strings.Split(p, ":")
-			if len(toks) < 2 {
-				return fmt.Errorf("guidCert arg %s was not uuid:path", p)
-			}
-			guid, err := efi.DecodeGUIDString(toks[0])
-			if err != nil {
-				return fmt.Errorf("first token in guidCert '%s' not a valild uuid: %v", toks[0], err)
-			}
-			cert, err := cert.CertFromPemFile(certPath)
-			if err != nil {
-				return fmt.Errorf("Failed reading cert from %s: %s", p, err)
-			}
-			sigDatas = append(sigDatas, &efi.SignatureData{Owner: guid, Data: cert.Raw})
-		}
-	}
-
-	return shim.SetVendorDB(shimEfi, cert.NewEFISignatureDatabase(sigDatas),
-		cert.NewEFISignatureDatabase([]*efi.SignatureData{}))
+	return shim.SetVendorDB(shimEfi, db, efi.SignatureDatabase{})
 }
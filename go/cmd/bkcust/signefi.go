@@ -1,67 +1,138 @@
 package main
 
 import (
+	"crypto"
+	"crypto/x509"
 	"fmt"
 	"os"
 
-	"github.com/foxboron/go-uefi/efi/pecoff"
 	"github.com/project-machine/bootkit/go/pkg/cert"
+	"github.com/project-machine/bootkit/go/pkg/signer"
 	cli "github.com/urfave/cli/v2"
 )
 
 var signEfiCmd = cli.Command{
 	Name:      "sign-efi",
 	Action:    doSignEfi,
-	ArgsUsage: "app.efi cert.pem key.pem",
+	ArgsUsage: "app.efi [cert.pem key]",
+	Description: `Sign app.efi with the key named by --keyset-key in --keyset, or with
+   cert.pem and key.  Only RSA keys can sign EFI binaries.  key is one of:
+
+     key.pem or file:key.pem
+         a PEM private key file: PKCS#1 or PKCS#8, optionally encrypted
+         with the passphrase from --key-passphrase.
+     pkcs11:token=T;object=O?module-path=M&pin-source=file:P
+         a key in a PKCS#11 token (RFC 7512 URI); it never leaves the token.
+     exec:command [args...]
+         an external signing command, run with the hash name (sha256)
+         appended; it reads the digest on stdin and writes the signature
+         to stdout.`,
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:  "output, o",
 			Usage: "Put modified shim in <output>",
 			Value: "",
 		},
+		keyPassphraseFlag,
+		keysetFlag,
+		keysetKeyFlag,
 	},
 }
 
+var keyPassphraseFlag = &cli.StringFlag{
+	Name:  "key-passphrase",
+	Usage: "Decrypt an encrypted key with the passphrase from env:NAME or file:PATH",
+}
+
+// keyPassphrase - return the passphrase named by --key-passphrase, or
+// nil if it is not set.
+func keyPassphrase(ctx *cli.Context) ([]byte, error) {
+	source := ctx.String("key-passphrase")
+	if source == "" {
+		return nil, nil
+	}
+	passphrase, err := cert.ReadPassphrase(source)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading key passphrase: %v", err)
+	}
+	return passphrase, nil
+}
+
 func doSignEfi(ctx *cli.Context) error {
 	args := ctx.Args().Slice()
-	if len(args) != 3 {
-		return fmt.Errorf("Got %d args, expected 3", len(args))
+	expected := 3
+	if ctx.IsSet("keyset") {
+		expected = 1
+	}
+	if len(args) != expected {
+		return fmt.Errorf("Got %d args, expected %d", len(args), expected)
 	}
 
 	efiFile := args[0]
-	certFile := args[1]
-	keyFile := args[2]
+	certFile, key := "", ""
+	if expected == 3 {
+		certFile, key = args[1], args[2]
+	}
 
 	output := ctx.String("output")
 	if output == "" {
 		output = efiFile
 	}
 
-	signPKey, err := cert.KeyFromPemFile(keyFile)
+	signCert, signPKey, err := openSigner(ctx, certFile, key)
 	if err != nil {
-		return fmt.Errorf("failed reading private key from %s: %v", keyFile, err)
+		return err
 	}
+	defer signer.Close(signPKey)
 
-	signCert, err := cert.CertFromPemFile(certFile)
+	return signEfi(efiFile, signCert, signPKey, output)
+}
+
+// openSigner - return the certificate and key to sign with: the key
+// named by --keyset-key in the keyset of --keyset, or else the cert in
+// certFile and the key named by key, a path or a signer uri.  It fails
+// before opening the key if the certificate is not for an RSA key, as
+// only those can sign EFI binaries.  Release the key with signer.Close.
+func openSigner(ctx *cli.Context, certFile, key string) (*x509.Certificate, crypto.Signer, error) {
+	ks, err := loadKeyset(ctx)
 	if err != nil {
-		return fmt.Errorf("failed reading cert from %s: %v", certFile, err)
+		return nil, nil, err
+	}
+	if ks != nil {
+		return keysetSigner(ctx, ks)
 	}
 
-	peFile, err := os.ReadFile(efiFile)
+	passphrase, err := keyPassphrase(ctx)
 	if err != nil {
-		return fmt.Errorf("Failed reading efi '%s': %v", efiFile, err)
+		return nil, nil, err
 	}
 
-	pctx := pecoff.PECOFFChecksum(peFile)
+	signCert, err := cert.CertFromPemFile(certFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed reading cert from %s: %v", certFile, err)
+	}
+	if err := signer.CheckEFIKey(signCert.PublicKey); err != nil {
+		return nil, nil, fmt.Errorf("Cannot sign with %s: %v", certFile, err)
+	}
 
-	sig, err := pecoff.CreateSignature(pctx, signCert, signPKey)
+	signPKey, err := signer.Open(key, signCert.PublicKey, passphrase)
 	if err != nil {
-		return fmt.Errorf("Failed createsig:%v", err)
+		return nil, nil, fmt.Errorf("failed opening private key %s: %v", key, err)
+	}
+	return signCert, signPKey, nil
+}
+
+// signEfi - sign efiFile with signCert and signPKey, writing the signed
+// binary to output.
+func signEfi(efiFile string, signCert *x509.Certificate, signPKey crypto.Signer, output string) error {
+	peFile, err := os.ReadFile(efiFile)
+	if err != nil {
+		return fmt.Errorf("Failed reading efi '%s': %v", efiFile, err)
 	}
 
-	signedBin, err := pecoff.AppendToBinary(pctx, sig)
+	signedBin, err := signer.SignEFI(peFile, signCert, signPKey)
 	if err != nil {
-		return fmt.Errorf("Failed append :%v", err)
+		return fmt.Errorf("Failed signing %s: %v", efiFile, err)
 	}
 
 	return os.WriteFile(output, signedBin, 0x755)
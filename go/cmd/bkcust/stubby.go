@@ -1,29 +1,50 @@
 package main
 
 import (
+	"crypto"
+	"crypto/x509"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/project-machine/bootkit/go/pkg/cmdline"
+	"github.com/project-machine/bootkit/go/pkg/obj"
+	"github.com/project-machine/bootkit/go/pkg/sbat"
+	"github.com/project-machine/bootkit/go/pkg/signer"
 	"github.com/project-machine/bootkit/go/pkg/stubby"
 	cli "github.com/urfave/cli/v2"
 )
 
-var sbatBuiltIn = `sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md
-stubby.puzzleos,2,PuzzleOS,stubby,1,https://github.com/puzzleos/stubby
-linux.puzzleos,1,PuzzleOS,linux,1,NOURL`
-
 var stubbyCmd = cli.Command{
 	Name: "stubby",
 	Subcommands: []*cli.Command{
 		&cli.Command{
 			Name:      "smoosh",
-			ArgsUsage: "output-uki.efi stubby.efi vmlinuz initrd",
-			Action:    doStubbySmoosh,
+			Usage:     "Create a unified kernel image from stubby, a kernel and an initrd",
+			ArgsUsage: "[output-uki.efi] stubby.efi vmlinuz initrd",
+			Description: `Write a unified kernel image to output-uki.efi, which is given
+   either with --output or as the first argument.
+
+   The embedded SBAT is that of --sbat, or the built-in SBAT, with each
+   --sbat-entry merged into it.  An entry either replaces the entry for
+   the same component, or is added.  'component,generation' changes only
+   the generation of an existing entry.  The SBAT is validated, and
+   written to stdout once the image has been written.
+
+   The kernel command line is --cmdline with each --cmdline-append
+   merged into it.  A parameter replaces an earlier one with the same
+   key, so '--cmdline-append console=ttyS1' replaces any console=.
+   With --production, parameters that give a shell or change how the
+   system boots, such as rd.shell, rd.break and init=, are refused, as
+   are init arguments after '--' such as single or emergency.`,
+			Action: doStubbySmoosh,
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:    "output",
 					Aliases: []string{"o"},
-					Usage:   "Put modified vars in <output>",
+					Usage:   "Write the unified kernel image to <output>",
 					Value:   "",
 				},
 				&cli.StringFlag{
@@ -31,34 +52,361 @@ var stubbyCmd = cli.Command{
 					Usage: "Embed the provided kernel command line",
 					Value: "",
 				},
+				&cli.GenericFlag{
+					Name:  "cmdline-append",
+					Usage: "Merge <cmdline-append> into the kernel command line (repeatable)",
+					Value: &repeatedFlag{},
+				},
+				&cli.BoolFlag{
+					Name:  "production",
+					Usage: "Refuse a kernel command line with debug parameters such as rd.shell or init=",
+				},
+				&cli.StringFlag{
+					Name:  "sbat",
+					Usage: "Embed the sbat csv in <sbat> rather than the built-in sbat",
+				},
+				&cli.GenericFlag{
+					Name:  "sbat-entry",
+					Usage: "Merge 'component,generation,vendor,package,version,url' or 'component,generation' into the sbat (repeatable)",
+					Value: &repeatedFlag{},
+				},
+				&cli.StringFlag{
+					Name:  "osrel",
+					Usage: "Embed <osrel> (an os-release file) as .osrel",
+				},
+				&cli.StringFlag{
+					Name:  "uname",
+					Usage: "Embed the kernel version <uname> as .uname",
+				},
+				&cli.StringFlag{
+					Name:  "splash",
+					Usage: "Embed the bmp image <splash> as .splash",
+				},
+				&cli.StringFlag{
+					Name:  "dtb",
+					Usage: "Embed the device tree blob <dtb> as .dtb",
+				},
+				&cli.StringFlag{
+					Name:  "pcrsig",
+					Usage: "Embed the PCR signature json <pcrsig> as .pcrsig",
+				},
+				&cli.StringFlag{
+					Name:  "pcrpkey",
+					Usage: "Embed the PCR public key <pcrpkey> as .pcrpkey",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "extract",
+			Usage:     "Extract the sections of a unified kernel image into files",
+			ArgsUsage: "uki.efi output-dir [section ...]",
+			Description: `Write the .linux, .initrd, .cmdline and .sbat sections of uki.efi
+   to output-dir/linux, output-dir/initrd, output-dir/cmdline and
+   output-dir/sbat, along with any of .osrel, .uname, .splash, .dtb,
+   .pcrsig and .pcrpkey.  If sections are named, only those are written.`,
+			Action: doStubbyExtract,
+		},
+		&cli.Command{
+			Name:      "set",
+			Usage:     "Replace sections of a unified kernel image",
+			ArgsUsage: "uki.efi",
+			Description: `Replace the .cmdline, .initrd or .sbat section of uki.efi, keeping
+   the other sections.  Any signature is removed as it is no longer
+   valid; use --cert and --key, or --keyset and --keyset-key, to sign the
+   result.`,
+			Action: doStubbySet,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "Put modified uki in <output>",
+					Value:   "",
+				},
+				&cli.StringFlag{
+					Name:  "cmdline",
+					Usage: "Replace the kernel command line with <cmdline>",
+				},
+				&cli.StringFlag{
+					Name:  "cmdline-file",
+					Usage: "Replace the kernel command line with the content of <cmdline-file>",
+				},
+				&cli.BoolFlag{
+					Name:  "production",
+					Usage: "Refuse a kernel command line with debug parameters such as rd.shell or init=",
+				},
+				&cli.StringFlag{
+					Name:  "initrd",
+					Usage: "Replace the initrd with <initrd>",
+				},
+				&cli.StringFlag{
+					Name:  "sbat",
+					Usage: "Replace the sbat with the content of <sbat>",
+				},
+				&cli.StringFlag{
+					Name:  "cert",
+					Usage: "Sign the result with <cert>",
+				},
+				&cli.StringFlag{
+					Name:  "key",
+					Usage: "Sign the result with <key>, a PEM file or a pkcs11: or exec: signer as for sign-efi",
+				},
+				keyPassphraseFlag,
+				keysetFlag,
+				keysetKeyFlag,
 			},
 		},
 	},
 }
 
+// extraSections - return the optional sections given as flags.  Each
+// flag is a path, except --uname which is the content and is written
+// to a file in tmpd.
+func extraSections(ctx *cli.Context, tmpd string) ([]obj.SectionInput, error) {
+	sections := []obj.SectionInput{}
+	for _, name := range stubby.ExtraSections {
+		flag := strings.TrimPrefix(name, ".")
+		value := ctx.String(flag)
+		if value == "" {
+			continue
+		}
+		if flag == "uname" {
+			path := filepath.Join(tmpd, "uname")
+			if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+				return nil, err
+			}
+			value = path
+		} else if !PathExists(value) {
+			return nil, fmt.Errorf("--%s file '%s' does not exist", flag, value)
+		}
+		sections = append(sections, obj.SectionInput{Name: name, Path: value})
+	}
+	return sections, nil
+}
+
+// smooshSbat - return the sbat given by the --sbat and --sbat-entry
+// flags.
+func smooshSbat(ctx *cli.Context) (sbat.SBAT, error) {
+	s := sbat.Default
+	if path := ctx.String("sbat"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if s, err = sbat.Parse(content); err != nil {
+			return nil, fmt.Errorf("Invalid sbat in %s: %v", path, err)
+		}
+	}
+
+	for _, value := range *ctx.Generic("sbat-entry").(*repeatedFlag) {
+		var entry sbat.Entry
+		if fields := strings.Split(value, ","); len(fields) == 2 {
+			cur := s.Entry(fields[0])
+			if cur == nil {
+				return nil, fmt.Errorf("Invalid --sbat-entry %q: no sbat entry for component %s", value, fields[0])
+			}
+			gen, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid --sbat-entry %q: bad generation %q", value, fields[1])
+			}
+			entry = *cur
+			entry.Generation = gen
+		} else {
+			var err error
+			if entry, err = sbat.ParseEntry(value); err != nil {
+				return nil, fmt.Errorf("Invalid --sbat-entry %q: %v", value, err)
+			}
+		}
+		s = s.Merge(entry)
+	}
+
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid sbat: %v", err)
+	}
+	return s, nil
+}
+
+// cmdlineBuilder - return the builder for kernel command lines, which
+// refuses debug parameters with --production.
+func cmdlineBuilder(ctx *cli.Context) *cmdline.Builder {
+	b := &cmdline.Builder{}
+	if ctx.Bool("production") {
+		b.Deny = cmdline.ProductionDeny
+	}
+	return b
+}
+
 func doStubbySmoosh(ctx *cli.Context) error {
 	var err error
 	args := ctx.Args().Slice()
-	if len(args) != 4 {
-		return fmt.Errorf("Got %d args, require 4", len(args))
+	output := ctx.String("output")
+	if output == "" {
+		if len(args) != 4 {
+			return fmt.Errorf("Got %d args, require 4", len(args))
+		}
+		output, args = args[0], args[1:]
+	} else if len(args) != 3 {
+		return fmt.Errorf("Got %d args, require 3 with --output", len(args))
+	}
+	stubEfi := args[0]
+	kernel := args[1]
+	initrd := args[2]
+
+	s, err := smooshSbat(ctx)
+	if err != nil {
+		return err
+	}
+
+	cmdline, err := cmdlineBuilder(ctx).Build(ctx.String("cmdline"), *ctx.Generic("cmdline-append").(*repeatedFlag)...)
+	if err != nil {
+		return fmt.Errorf("Invalid kernel command line: %v", err)
+	}
+
+	tmpd, err := os.MkdirTemp("", "smoosh-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpd)
+
+	extra, err := extraSections(ctx, tmpd)
+	if err != nil {
+		return err
+	}
+
+	err = stubby.Smoosh(stubEfi, output, cmdline, s.String(), kernel, initrd, extra...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote to %s\n", output)
+	fmt.Print(s)
+
+	return nil
+}
+
+func doStubbyExtract(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) < 2 {
+		return fmt.Errorf("Got %d args, require 2 or more", len(args))
 	}
-	output := args[0]
-	stubEfi := args[1]
-	kernel := args[2]
-	initrd := args[3]
+	uki := args[0]
+	outDir := args[1]
 
-	sbat := sbatBuiltIn
-	if ctx.String("sbat") != "" {
-		content, err := os.ReadFile(ctx.String("sbat"))
+	sections := args[2:]
+	for i, name := range sections {
+		if !strings.HasPrefix(name, ".") {
+			sections[i] = "." + name
+		}
+	}
+
+	written, err := stubby.Unsmoosh(uki, outDir, sections...)
+	if err != nil {
+		return fmt.Errorf("Failed extracting %s: %v", uki, err)
+	}
+	for _, path := range written {
+		fmt.Fprintf(os.Stderr, "Wrote to %s\n", path)
+	}
+
+	return nil
+}
+
+// checkUKICmdline - check the kernel command line that uki will have
+// once updated, which is content or, if that is nil, its current one.
+func checkUKICmdline(ctx *cli.Context, uki string, content []byte) error {
+	if content == nil {
+		p, err := obj.ReadPEFile(uki)
 		if err != nil {
 			return err
 		}
-		sbat = string(content)
+		if sect := p.Section(".cmdline"); sect != nil {
+			content = sect.Content()
+		}
+	}
+	c, err := cmdline.Parse(strings.TrimRight(string(content), "\x00"))
+	if err != nil {
+		return fmt.Errorf("Invalid kernel command line: %v", err)
+	}
+	if err := cmdlineBuilder(ctx).Check(c); err != nil {
+		return fmt.Errorf("Invalid kernel command line: %v", err)
+	}
+	return nil
+}
+
+func doStubbySet(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) != 1 {
+		return fmt.Errorf("Got %d args, require 1", len(args))
+	}
+	uki := args[0]
+
+	output := ctx.String("output")
+	if output == "" {
+		output = uki
+	}
+
+	certFile, keyFile := ctx.String("cert"), ctx.String("key")
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("--cert and --key must be used together")
+	}
+	if certFile != "" && ctx.IsSet("keyset") {
+		return fmt.Errorf("--cert and --key conflict with --keyset")
+	}
+	var signCert *x509.Certificate
+	var signPKey crypto.Signer
+	if certFile != "" || ctx.IsSet("keyset") {
+		var err error
+		if signCert, signPKey, err = openSigner(ctx, certFile, keyFile); err != nil {
+			return err
+		}
+		defer signer.Close(signPKey)
+	}
+
+	sections := map[string][]byte{}
+	if ctx.IsSet("cmdline") && ctx.IsSet("cmdline-file") {
+		return fmt.Errorf("--cmdline conflicts with --cmdline-file")
+	}
+	if ctx.IsSet("cmdline") {
+		sections[".cmdline"] = []byte(ctx.String("cmdline"))
+	}
+	for flag, name := range map[string]string{
+		"cmdline-file": ".cmdline",
+		"initrd":       ".initrd",
+		"sbat":         ".sbat",
+	} {
+		path := ctx.String(flag)
+		if path == "" {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sections[name] = content
+	}
+	if len(sections) == 0 {
+		return fmt.Errorf("Nothing to set: use --cmdline, --cmdline-file, --initrd or --sbat")
+	}
+	if content, ok := sections[".sbat"]; ok {
+		if _, err := sbat.Parse(content); err != nil {
+			return fmt.Errorf("Invalid sbat in %s: %v", ctx.String("sbat"), err)
+		}
+	}
+	if ctx.Bool("production") {
+		if err := checkUKICmdline(ctx, uki, sections[".cmdline"]); err != nil {
+			return err
+		}
 	}
 
-	err = stubby.Smoosh(stubEfi, output, ctx.String("cmdline"), sbat, kernel, initrd)
+	signed, err := stubby.Update(uki, output, sections)
 	if err != nil {
-		return err
+		return fmt.Errorf("Failed updating %s: %v", uki, err)
+	}
+	if signed {
+		fmt.Fprintf(os.Stderr, "Removed signature from %s\n", output)
+	}
+
+	if signPKey != nil {
+		if err := signEfi(output, signCert, signPKey, output); err != nil {
+			return err
+		}
 	}
 	fmt.Fprintf(os.Stderr, "Wrote to %s\n", output)
 
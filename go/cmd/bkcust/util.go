@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"regexp"
+	"strings"
 )
 
 var uuidMatch = regexp.MustCompile("[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}")
@@ -22,3 +23,17 @@ func PathExists(d string) bool {
 	}
 	return true
 }
+
+// repeatedFlag - the values of a flag that may be given more than once.
+// Use it with a cli.GenericFlag rather than a StringSliceFlag when
+// values may contain commas, as StringSliceFlag splits them.
+type repeatedFlag []string
+
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func (f *repeatedFlag) String() string {
+	return strings.Join(*f, " ")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/project-machine/bootkit/go/pkg/cert"
+	"github.com/project-machine/bootkit/go/pkg/firmware"
+	"github.com/project-machine/bootkit/go/pkg/obj"
+	"github.com/project-machine/bootkit/go/pkg/shim"
+	cli "github.com/urfave/cli/v2"
+)
+
+var verifyEfiCmd = cli.Command{
+	Name:      "verify-efi",
+	Usage:     "Verify the Authenticode signatures of an EFI binary against a trust set",
+	ArgsUsage: "app.efi",
+	Description: `Recompute the Authenticode digest of app.efi, check each attached
+   signature against it and report which entry of the trust set, if any,
+   allows it.  The trust set is the union of every --cert, --keydir, --esl,
+   the db of --vars and the .vendor_cert db of --shim; the dbx of --vars and
+   --shim revoke.
+
+   Exits non-zero unless app.efi would be started by firmware or shim with
+   that trust set.`,
+	Action: doVerifyEfi,
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "cert",
+			Usage: "Trust <cert>: a PEM or DER certificate, guid:cert, keydir:DIR or an EFI signature list",
+		},
+		&cli.StringSliceFlag{
+			Name:  "keydir",
+			Usage: "Trust the cert.pem of the key directory <keydir>",
+		},
+		&cli.StringSliceFlag{
+			Name:  "esl",
+			Usage: "Trust the EFI signature list file <esl>",
+		},
+		&cli.StringFlag{
+			Name:  "vars",
+			Usage: "Trust the db, and revoke by the dbx, of the OVMF vars file <vars>",
+		},
+		&cli.StringFlag{
+			Name:  "shim",
+			Usage: "Trust the .vendor_cert db, and revoke by the dbx, of shim <shim>",
+		},
+		keysetFlag,
+	},
+}
+
+// trustSet - the databases that allow and revoke images, and where each
+// of their entries came from.
+type trustSet struct {
+	db, dbx efi.SignatureDatabase
+	sources map[*efi.SignatureData]string
+}
+
+func (t *trustSet) add(source string, db, dbx efi.SignatureDatabase) {
+	for _, l := range db {
+		for _, sd := range l.Signatures {
+			t.sources[sd] = source
+		}
+	}
+	for _, l := range dbx {
+		for _, sd := range l.Signatures {
+			t.sources[sd] = source
+		}
+	}
+	t.db = append(t.db, db...)
+	t.dbx = append(t.dbx, dbx...)
+}
+
+// describe - return a description of the entry sd of the trust set.
+func (t *trustSet) describe(sd *efi.SignatureData) string {
+	if c, err := x509.ParseCertificate(sd.Data); err == nil {
+		return fmt.Sprintf("%s (%s, owner %s)", c.Subject, t.sources[sd], sd.Owner)
+	}
+	return fmt.Sprintf("sha256 %x (%s, owner %s)", sd.Data, t.sources[sd], sd.Owner)
+}
+
+func loadTrustSet(ctx *cli.Context) (*trustSet, error) {
+	t := &trustSet{sources: map[*efi.SignatureData]string{}}
+
+	args := ctx.StringSlice("cert")
+	for _, p := range ctx.StringSlice("keydir") {
+		args = append(args, "keydir:"+p)
+	}
+	args = append(args, ctx.StringSlice("esl")...)
+	for _, p := range args {
+		db, err := cert.ReadSignatureArg(p)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading %s: %v", p, err)
+		}
+		t.add(p, db, nil)
+	}
+
+	ks, err := loadKeyset(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ks != nil {
+		t.add(ks.Dir+" db", cert.NewEFISignatureDatabase(ks.DBSignatureData()), nil)
+		t.add(ks.Dir+" vendor_db", cert.NewEFISignatureDatabase(ks.VendorDBSignatureData()), nil)
+	}
+
+	if p := ctx.String("vars"); p != "" {
+		vars, err := firmware.ReadOVMFVars(p)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading vars %s: %v", p, err)
+		}
+		db, err := vars.SignatureDatabase("db")
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading db of %s: %v", p, err)
+		}
+		dbx, err := vars.SignatureDatabase("dbx")
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading dbx of %s: %v", p, err)
+		}
+		t.add(p+" db", db, dbx)
+	}
+
+	if p := ctx.String("shim"); p != "" {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		pf, err := obj.ParsePE(data)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading shim %s: %v", p, err)
+		}
+		s := pf.Section(".vendor_cert")
+		if s == nil {
+			return nil, fmt.Errorf("Shim %s has no .vendor_cert section", p)
+		}
+		db, dbx, err := shim.ParseVendorDB(s.Content())
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading .vendor_cert of %s: %v", p, err)
+		}
+		t.add(p+" vendor_db", db, dbx)
+	}
+
+	return t, nil
+}
+
+func doVerifyEfi(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) != 1 {
+		return fmt.Errorf("Got %d args, expected 1", len(args))
+	}
+	if !ctx.IsSet("cert") && !ctx.IsSet("keydir") && !ctx.IsSet("esl") && !ctx.IsSet("vars") && !ctx.IsSet("shim") && !ctx.IsSet("keyset") {
+		return fmt.Errorf("Need at least one of --cert, --keydir, --esl, --vars, --shim or --keyset")
+	}
+
+	trust, err := loadTrustSet(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	v, err := obj.Verify(data, trust.db, trust.dbx)
+	if err != nil {
+		return fmt.Errorf("Failed verifying %s: %v", args[0], err)
+	}
+
+	fmt.Printf("%s: sha256 %x\n", args[0], v.Digest)
+	if v.TrustedBy != nil {
+		fmt.Printf("  digest allowed by %s\n", trust.describe(v.TrustedBy))
+	}
+	if v.RevokedBy != nil {
+		fmt.Printf("  digest revoked by %s\n", trust.describe(v.RevokedBy))
+	}
+	if len(v.Signatures) == 0 {
+		fmt.Printf("  no signatures\n")
+	}
+	for i, s := range v.Signatures {
+		fmt.Printf("  signature %d:\n", i)
+		for _, c := range s.Signers {
+			fmt.Printf("    signer: %s\n", c.Subject)
+		}
+		switch {
+		case s.Err != nil:
+			fmt.Printf("    invalid: %v\n", s.Err)
+		case s.RevokedBy != nil:
+			fmt.Printf("    revoked by %s\n", trust.describe(s.RevokedBy))
+		case s.TrustedBy != nil:
+			fmt.Printf("    allowed by %s\n", trust.describe(s.TrustedBy))
+		default:
+			fmt.Printf("    valid, but not allowed by the trust set\n")
+		}
+	}
+
+	if !v.Trusted() {
+		return cli.Exit(fmt.Sprintf("%s is not trusted", args[0]), 1)
+	}
+	fmt.Printf("%s is trusted\n", args[0])
+	return nil
+}
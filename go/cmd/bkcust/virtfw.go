@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"strings"
 
 	efi "github.com/canonical/go-efilib"
 	"github.com/project-machine/bootkit/go/pkg/cert"
@@ -18,7 +17,11 @@ var virtFwCmd = cli.Command{
 		&cli.Command{
 			Name:      "secure-boot",
 			ArgsUsage: "ovmf-vars.fd",
-			Action:    doVirtFW,
+			Description: `Enroll keys in ovmf-vars.fd and enable secure boot.  Each key is a
+   key directory (keydir:DIR or DIR) with cert.pem and guid, owned by the
+   zero guid if it has no guid file, guid:cert, a PEM or DER certificate
+   owned by the zero guid, or an EFI signature list of certificates.  --keyset adds its uefi-pk, uefi-kek and uefi-db keys.`,
+			Action: doVirtFW,
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:  "output, o",
@@ -46,41 +49,21 @@ var virtFwCmd = cli.Command{
 					Usage: "mok key",
 					Value: &cli.StringSlice{},
 				},
+				keysetFlag,
 			},
 		},
 	},
 }
 
-// guidCerts are either <uuid>:*.pem or a "keydir" expected to
-// have a 'guid' and 'cert.pem' file
-func readGuidCertString(guidCerts []string) ([]*efi.SignatureData, error) {
-	certPath := ""
-	sigDatas := []*efi.SignatureData{}
-	for _, p := range guidCerts {
-		if IsDir(p) {
-			sd, err := cert.LoadSignatureDataDir(p)
-			if err != nil {
-				return sigDatas, fmt.Errorf("guidCert arg %s is a dir: %s", p, err)
-			}
-			sigDatas = append(sigDatas, sd)
-		} else {
-			toks := strings.Split(p, ":")
-			if len(toks) < 2 {
-				return sigDatas, fmt.Errorf("guidCert arg %s was not uuid:path", p)
-			}
-			guid, err := efi.DecodeGUIDString(toks[0])
-			if err != nil {
-				return sigDatas, fmt.Errorf("first token in guidCert '%s' not a valild uuid: %v", toks[0], err)
-			}
-			cert, err := cert.CertFromPemFile(certPath)
-			if err != nil {
-				return sigDatas, fmt.Errorf("Failed reading cert from %s: %s", p, err)
-			}
-			sigDatas = append(sigDatas, &efi.SignatureData{Owner: guid, Data: cert.Raw})
-		}
+// readCertArgs - return the certificates named by args, as for
+// cert.ReadSignatureArg.  virt-fw-vars only accepts certificates, so
+// signature lists of hashes are an error.
+func readCertArgs(args []string) ([]*efi.SignatureData, error) {
+	db, err := cert.ReadSignatureArgs(args)
+	if err != nil {
+		return nil, err
 	}
-
-	return sigDatas, nil
+	return cert.CertSignatureData(db)
 }
 
 func doVirtFW(ctx *cli.Context) error {
@@ -104,35 +87,54 @@ func doVirtFW(ctx *cli.Context) error {
 	platformKey := efi.SignatureData{}
 	var kekData, dbData, mokData []*efi.SignatureData
 
+	ks, err := loadKeyset(ctx)
+	if err != nil {
+		return err
+	}
+	if ks != nil {
+		if ctx.IsSet("platform") {
+			return fmt.Errorf("--platform conflicts with --keyset")
+		}
+		platformKey = *ks.PK.SignatureData()
+	}
+
 	if pkstr := ctx.String("platform"); pkstr != "" {
-		sigdlist, err := readGuidCertString([]string{pkstr})
+		sigdlist, err := readCertArgs([]string{pkstr})
 		if err != nil {
 			return fmt.Errorf("Failed to read platform key: %v", err)
 		}
+		if len(sigdlist) != 1 {
+			return fmt.Errorf("Platform key %s has %d certificates, expected 1", pkstr, len(sigdlist))
+		}
 		platformKey = *sigdlist[0]
 	}
 
 	if kekStrs := ctx.StringSlice("kek"); len(kekStrs) != 0 {
-		kekData, err = readGuidCertString(kekStrs)
+		kekData, err = readCertArgs(kekStrs)
 		if err != nil {
 			return fmt.Errorf("Failed to read kek key: %v", err)
 		}
 	}
 
 	if dbStrs := ctx.StringSlice("db"); len(dbStrs) != 0 {
-		dbData, err = readGuidCertString(dbStrs)
+		dbData, err = readCertArgs(dbStrs)
 		if err != nil {
 			return fmt.Errorf("Failed to read db key: %v", err)
 		}
 	}
 
 	if mokStrs := ctx.StringSlice("mok"); len(mokStrs) != 0 {
-		mokData, err = readGuidCertString(mokStrs)
+		mokData, err = readCertArgs(mokStrs)
 		if err != nil {
 			return fmt.Errorf("Failed to read mok key: %v", err)
 		}
 	}
 
+	if ks != nil {
+		kekData = append(ks.KEKSignatureData(), kekData...)
+		dbData = append(ks.DBSignatureData(), dbData...)
+	}
+
 	err = firmware.OVMFPopulateSecureBoot(
 		ovmfVarsIn, ovmfVarsOut, &platformKey, kekData, dbData, mokData)
 	if err != nil {
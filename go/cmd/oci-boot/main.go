@@ -23,6 +23,8 @@ import (
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/project-machine/bootkit/go/pkg/cmdline"
+	"github.com/project-machine/bootkit/go/pkg/sbat"
 	cli "github.com/urfave/cli/v2"
 	"stackerbuild.io/stacker/pkg/lib"
 	stackeroci "stackerbuild.io/stacker/pkg/oci"
@@ -44,10 +46,8 @@ const (
 	EFIKernel
 )
 
-const SBATContent = `sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md
-stubby.puzzleos,2,PuzzleOS,stubby,1,https://github.com/puzzleos/stubby
-linux.puzzleos,1,PuzzleOS,linux,1,NOURL
-`
+var SBATContent = sbat.Default.String()
+
 const fat32BlockSize = 512
 
 var EFIBootModeStrings = map[string]BootMode{
@@ -349,6 +349,8 @@ type OciBoot struct {
 	cleanups   []func() error
 	bootKitDir string
 	RepoDir    string `json:"repodir"`
+	// Production - refuse kernel command lines with debug parameters.
+	Production bool `json:"production"`
 }
 
 func genGptDisk(fpath string, fsize int64) (disko.Disk, error) {
@@ -644,7 +646,11 @@ func ensureDir(dir string) error {
 
 // PopulateEFI - populate destd with files for an efi tree.
 //   destd will have efi/ under it.
-func (o *OciBoot) PopulateEFI(mode BootMode, cmdline string, destd string) error {
+//
+// The kernel command line is extraCmdline merged into the root= for the boot
+// layer.  ${ISOLabel} and ${BootLayerName} in extraCmdline are replaced
+// with their values.
+func (o *OciBoot) PopulateEFI(mode BootMode, extraCmdline string, destd string) error {
 	const EFIBootDir = "/efi/boot/"
 	const StartupNSHPath = "startup.nsh"
 	const KernelEFI = "kernel.efi"
@@ -658,13 +664,20 @@ func (o *OciBoot) PopulateEFI(mode BootMode, cmdline string, destd string) error
 		}
 	}
 
-	fullCmdline := ""
+	baseCmdline := ""
 	if o.BootLayer != "" {
 		// FIXME: fullCmdline root= should be based on type of o.BootLayer (root=soci or root=oci)
-		fullCmdline = "root=soci:name=" + BootLayerName + ",dev=LABEL=" + ISOLabel
+		baseCmdline = "root=soci:name=${BootLayerName},dev=LABEL=${ISOLabel}"
+	}
+	builder := &cmdline.Builder{
+		Vars: map[string]string{"BootLayerName": BootLayerName, "ISOLabel": ISOLabel},
+	}
+	if o.Production {
+		builder.Deny = cmdline.ProductionDeny
 	}
-	if cmdline != "" {
-		fullCmdline = fullCmdline + " " + cmdline
+	fullCmdline, err := builder.Build(baseCmdline, extraCmdline)
+	if err != nil {
+		return fmt.Errorf("Invalid kernel command line: %v", err)
 	}
 
 	// should get the total size of all the source files and compute this.
@@ -993,6 +1006,7 @@ func doMain(ctx *cli.Context) error {
 		ociBoot.Layers = args.Slice()[3:]
 	}
 
+	ociBoot.Production = ctx.Bool("production")
 	ociBoot.Files = map[string]string{}
 	for _, p := range ctx.StringSlice("insert") {
 		toks := strings.SplitN(p, ":", 2)
@@ -1066,7 +1080,11 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:  "cmdline",
-			Usage: "cmdline: additional parameters for kernel command line",
+			Usage: "cmdline: additional parameters for kernel command line, may use ${ISOLabel} and ${BootLayerName}",
+		},
+		&cli.BoolFlag{
+			Name:  "production",
+			Usage: "refuse a kernel command line with debug parameters such as rd.shell or init=",
 		},
 		&cli.StringSliceFlag{
 			Name:  "sync-repodir",
@@ -5,8 +5,10 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -38,15 +40,12 @@ func PemFromCert(cert *x509.Certificate) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// KeyFromPem - return the unencrypted RSA private key in data.  Use
+// SignerFromPem for other keys.
 func KeyFromPem(data []byte) (*rsa.PrivateKey, error) {
-	block, _ := pem.Decode(data)
-	if block == nil {
-		return nil, fmt.Errorf("No PEM block found")
-	}
-
-	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	key, err := SignerFromPem(data, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse key: %w", err)
+		return nil, err
 	}
 
 	if pkey, ok := key.(*rsa.PrivateKey); ok {
@@ -74,13 +73,24 @@ func GUIDFromFile(path string) (efi.GUID, error) {
 	return efi.DecodeGUIDString(strings.TrimRight(string(content), "\n"))
 }
 
+// LoadSignatureDataDir - return the entry for the key directory
+// dirPath: the certificate in cert.pem, owned by the GUID in guid.  A
+// directory without a guid file is owned by the zero GUID, as older key
+// directories have none.
 func LoadSignatureDataDir(dirPath string) (*efi.SignatureData, error) {
 	cert, err := CertFromPemFile(filepath.Join(dirPath, "cert.pem"))
 	if err != nil {
 		return nil, err
 	}
 
-	return &efi.SignatureData{Owner: efi.GUID{}, Data: cert.Raw}, nil
+	guid, err := GUIDFromFile(filepath.Join(dirPath, "guid"))
+	if errors.Is(err, os.ErrNotExist) {
+		guid = efi.GUID{}
+	} else if err != nil {
+		return nil, fmt.Errorf("bad owner guid in %s: %w", dirPath, err)
+	}
+
+	return &efi.SignatureData{Owner: guid, Data: cert.Raw}, nil
 }
 
 func LoadSignatureDataDirs(dirPaths ...string) ([]*efi.SignatureData, error) {
@@ -110,6 +110,25 @@ func TestLoadDataDir(t *testing.T) {
 		t.Errorf("Data bad. Found (len=%d) != Expected (len=%d)", len(sigdata.Data), len(cert.Raw))
 	}
 
+	// a guid file that does not hold a guid is an error.
+	if err := ioutil.WriteFile(filepath.Join(tmpd, "guid"), []byte("not a guid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSignatureDataDir(tmpd); err == nil {
+		t.Errorf("LoadSignatureDataDir succeeded with a bad guid")
+	}
+
+	// without a guid file the owner is the zero guid.
+	if err := os.Remove(filepath.Join(tmpd, "guid")); err != nil {
+		t.Fatal(err)
+	}
+	sigdata, err = LoadSignatureDataDir(tmpd)
+	if err != nil {
+		t.Fatalf("LoadSignatureDataDir without guid: %v", err)
+	}
+	if sigdata.Owner != (efi.GUID{}) {
+		t.Errorf("Owner without guid was %s, expected the zero guid", sigdata.Owner)
+	}
 }
 
 func TestReadWriteCert(t *testing.T) {
@@ -0,0 +1,238 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ErrPassphraseRequired - returned when a key is encrypted and no
+// passphrase was given.
+var ErrPassphraseRequired = errors.New("key is encrypted and no passphrase was given")
+
+// ReadPassphrase - return the passphrase named by source, which is
+// env:NAME for the environment variable NAME or file:PATH for the first
+// line of the file PATH, as for openssl -passin.
+func ReadPassphrase(source string) ([]byte, error) {
+	kind, name, ok := strings.Cut(source, ":")
+	if !ok {
+		return nil, fmt.Errorf("passphrase source %q is not env:NAME or file:PATH", source)
+	}
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("passphrase variable %s is not set", name)
+		}
+		return []byte(v), nil
+	case "file":
+		content, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		line, _, _ := strings.Cut(string(content), "\n")
+		return []byte(strings.TrimSuffix(line, "\r")), nil
+	}
+	return nil, fmt.Errorf("passphrase source %q is not env:NAME or file:PATH", source)
+}
+
+// SignerFromPem - return the private key in the first PEM block of data
+// that holds one.  The key may be PKCS#1 RSA ("RSA PRIVATE KEY"), SEC1 EC
+// ("EC PRIVATE KEY") or PKCS#8 ("PRIVATE KEY"), encrypted with
+// passphrase either as PKCS#8 PBES2 ("ENCRYPTED PRIVATE KEY") or with
+// legacy PEM encryption (Proc-Type: 4,ENCRYPTED).  passphrase is
+// ignored for unencrypted keys.
+func SignerFromPem(data, passphrase []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("No private key PEM block found")
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+			return signerFromBlock(block, passphrase)
+		}
+	}
+}
+
+// SignerFromPemFile - return the private key in the PEM file path, as
+// for SignerFromPem.
+func SignerFromPemFile(path string, passphrase []byte) (crypto.Signer, error) {
+	pemData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return SignerFromPem(pemData, passphrase)
+}
+
+func signerFromBlock(block *pem.Block, passphrase []byte) (crypto.Signer, error) {
+	der := block.Bytes
+	// legacy PEM encryption is deprecated, but openssl still writes it
+	// for "openssl rsa -aes256" and older keysets use it.
+	if x509.IsEncryptedPEMBlock(block) { //nolint:staticcheck
+		if passphrase == nil {
+			return nil, ErrPassphraseRequired
+		}
+		var err error
+		if der, err = x509.DecryptPEMBlock(block, passphrase); err != nil { //nolint:staticcheck
+			return nil, fmt.Errorf("failed to decrypt key: %w", err)
+		}
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(der)
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == nil {
+			return nil, ErrPassphraseRequired
+		}
+		if der, err = decryptPKCS8(der, passphrase); err != nil {
+			return nil, err
+		}
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("parsed key %T can not sign", key)
+	}
+	return signer, nil
+}
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// encryptedPrivateKeyInfo - RFC 5958 EncryptedPrivateKeyInfo.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params - RFC 8018 PBES2-params.
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params - RFC 8018 PBKDF2-params.  The salt must be specified,
+// not otherSource.
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 - return the PKCS#8 PrivateKeyInfo in the PBES2
+// EncryptedPrivateKeyInfo der.
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("bad encrypted private key: %w", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %s, expected PBES2", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("bad PBES2 parameters: %w", err)
+	}
+
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %s, expected PBKDF2", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("bad PBKDF2 parameters: %w", err)
+	}
+	var prf func() hash.Hash
+	switch alg := kdf.PRF.Algorithm; {
+	case len(alg) == 0 || alg.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case alg.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case alg.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case alg.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 prf %s", alg)
+	}
+
+	var keyLen int
+	var newCipher func([]byte) (cipher.Block, error)
+	switch alg := params.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen, newCipher = 16, aes.NewCipher
+	case alg.Equal(oidAES192CBC):
+		keyLen, newCipher = 24, aes.NewCipher
+	case alg.Equal(oidAES256CBC):
+		keyLen, newCipher = 32, aes.NewCipher
+	case alg.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, fmt.Errorf("unsupported key cipher %s", alg)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("bad cipher parameters: %w", err)
+	}
+
+	block, err := newCipher(pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, keyLen, prf))
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("bad encrypted private key length")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// a wrong passphrase almost always gives bad padding.
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, fmt.Errorf("failed to decrypt key: incorrect passphrase")
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, fmt.Errorf("failed to decrypt key: incorrect passphrase")
+		}
+	}
+	return plain[:len(plain)-pad], nil
+}
@@ -0,0 +1,450 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	efi "github.com/canonical/go-efilib"
+)
+
+// The key directories of a keyset.  Each holds cert.pem and privkey.pem
+// and, for those that go in a signature database, a guid file with the
+// owner GUID.  The tpmpol keys have pubkey.pem instead of cert.pem.
+const (
+	KeysetPK            = "uefi-pk"
+	KeysetKEK           = "uefi-kek"
+	KeysetDB            = "uefi-db"
+	KeysetUKILimited    = "uki-limited"
+	KeysetUKIProduction = "uki-production"
+	KeysetUKITPM        = "uki-tpm"
+	KeysetManifestCA    = "manifest-ca"
+	KeysetSUDICA        = "sudi-ca"
+	KeysetTPMPolAdmin   = "tpmpol-admin"
+	KeysetTPMPolLUKS    = "tpmpol-luks"
+)
+
+// KeyAlgorithms - the key algorithms that keysets can be created with.
+var KeyAlgorithms = map[string]func() (crypto.Signer, error){
+	"rsa2048":    func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) },
+	"rsa3072":    func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 3072) },
+	"rsa4096":    func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 4096) },
+	"ecdsa-p256": func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) },
+	"ecdsa-p384": func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P384(), rand.Reader) },
+}
+
+// KeysetOptions - the parameters of CreateKeyset.
+type KeysetOptions struct {
+	// Organization - the O of each subject.
+	Organization string
+	// Name - the OU of each subject, usually the name of the keyset.
+	Name string
+	// Validity - how long the certificates are valid for.
+	Validity time.Duration
+	// UEFIAlgorithm - the algorithm of the keys in the firmware
+	// databases, uefi-pk, uefi-kek and uefi-db, and of the uki keys in
+	// the shim vendor db.  These keys sign EFI binaries or variables
+	// with Authenticode, so it must be an rsa algorithm.  Most firmware
+	// only supports rsa2048.
+	UEFIAlgorithm string
+	// Algorithm - the algorithm of the other keys: manifest-ca, sudi-ca
+	// and the tpmpol keys.
+	Algorithm string
+	// Owner - if not the zero GUID, the owner GUID of every entry;
+	// otherwise a random GUID is made for each.
+	Owner efi.GUID
+}
+
+// keysetKey - how to make one key of a keyset.
+type keysetKey struct {
+	dir        string
+	commonName string
+	// issuer - the dir of the issuing key, or "" if self signed.
+	issuer string
+	ca     bool
+	ekus   []x509.ExtKeyUsage
+	// uefi - the key signs EFI binaries or variables, so is made
+	// with UEFIAlgorithm.
+	uefi bool
+	// guid - whether the key has an owner GUID.
+	guid bool
+	// noCert - the key has only a public key, no certificate.
+	noCert bool
+}
+
+// keysetKeys - the keys of a keyset, issuers before the keys they issue.
+// The PK is the root of the UEFI hierarchy: it issues the KEK, which
+// issues db and the shim vendor db keys.  The manifest and SUDI CAs are
+// roots of their own.
+var keysetKeys = []keysetKey{
+	{dir: KeysetPK, commonName: "UEFI PK", ca: true, uefi: true, guid: true},
+	{dir: KeysetKEK, commonName: "UEFI KEK", issuer: KeysetPK, ca: true, uefi: true, guid: true},
+	{dir: KeysetDB, commonName: "UEFI DB", issuer: KeysetKEK, ekus: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, uefi: true, guid: true},
+	{dir: KeysetUKILimited, commonName: "UKI limited", issuer: KeysetKEK, ekus: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, uefi: true, guid: true},
+	{dir: KeysetUKIProduction, commonName: "UKI production", issuer: KeysetKEK, ekus: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, uefi: true, guid: true},
+	{dir: KeysetUKITPM, commonName: "UKI TPM", issuer: KeysetKEK, ekus: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, uefi: true, guid: true},
+	{dir: KeysetManifestCA, commonName: "Manifest CA", ca: true},
+	{dir: KeysetSUDICA, commonName: "SUDI CA", ca: true},
+	{dir: KeysetTPMPolAdmin, commonName: "TPM policy admin", noCert: true},
+	{dir: KeysetTPMPolLUKS, commonName: "TPM policy LUKS", noCert: true},
+}
+
+// NewGUID - return a random (version 4) GUID.
+func NewGUID() (efi.GUID, error) {
+	var g efi.GUID
+	if _, err := rand.Read(g[:]); err != nil {
+		return g, err
+	}
+	// efi.GUID stores the first three fields little endian, so the
+	// version is the high nibble of byte 7.
+	g[7] = g[7]&0x0f | 0x40
+	g[8] = g[8]&0x3f | 0x80
+	return g, nil
+}
+
+// PemFromKey - return the PKCS#8 PEM encoding of key.
+func PemFromKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// CreateKeyset - create a new keyset in dir, which must not exist.
+func CreateKeyset(dir string, opts KeysetOptions) error {
+	for _, alg := range []string{opts.UEFIAlgorithm, opts.Algorithm} {
+		if _, ok := KeyAlgorithms[alg]; !ok {
+			names := []string{}
+			for n := range KeyAlgorithms {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown key algorithm %q, expected one of %s", alg, strings.Join(names, ", "))
+		}
+	}
+	if !strings.HasPrefix(opts.UEFIAlgorithm, "rsa") {
+		return fmt.Errorf("uefi key algorithm %q is not rsa: EFI binaries can only be signed with RSA keys", opts.UEFIAlgorithm)
+	}
+	if opts.Validity <= 0 {
+		return fmt.Errorf("validity must be positive")
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists", dir)
+	}
+
+	tmpd := dir + ".tmp"
+	if err := os.RemoveAll(tmpd); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpd, 0700); err != nil {
+		return err
+	}
+	if err := createKeyset(tmpd, opts); err != nil {
+		os.RemoveAll(tmpd)
+		return err
+	}
+	return os.Rename(tmpd, dir)
+}
+
+func createKeyset(dir string, opts KeysetOptions) error {
+	type issued struct {
+		cert *x509.Certificate
+		key  crypto.Signer
+	}
+	issuers := map[string]issued{}
+	notBefore := time.Now().Add(-time.Hour).UTC()
+
+	for _, k := range keysetKeys {
+		alg := opts.Algorithm
+		if k.uefi {
+			alg = opts.UEFIAlgorithm
+		}
+		key, err := KeyAlgorithms[alg]()
+		if err != nil {
+			return fmt.Errorf("failed generating %s key: %w", k.dir, err)
+		}
+
+		kd := filepath.Join(dir, k.dir)
+		if err := os.Mkdir(kd, 0700); err != nil {
+			return err
+		}
+		keyPem, err := PemFromKey(key)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(kd, "privkey.pem"), keyPem, 0600); err != nil {
+			return err
+		}
+
+		if k.noCert {
+			der, err := x509.MarshalPKIXPublicKey(key.Public())
+			if err != nil {
+				return err
+			}
+			pubPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+			if err := os.WriteFile(filepath.Join(kd, "pubkey.pem"), pubPem, 0644); err != nil {
+				return err
+			}
+			continue
+		}
+
+		serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+		if err != nil {
+			return err
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: serial,
+			Subject: pkix.Name{
+				Organization:       []string{opts.Organization},
+				OrganizationalUnit: []string{opts.Name},
+				CommonName:         k.commonName,
+			},
+			NotBefore:             notBefore,
+			NotAfter:              notBefore.Add(opts.Validity),
+			KeyUsage:              x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:           k.ekus,
+			BasicConstraintsValid: true,
+			IsCA:                  k.ca,
+		}
+		if k.ca {
+			tmpl.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		}
+
+		parent, parentKey := tmpl, key
+		if k.issuer != "" {
+			parent, parentKey = issuers[k.issuer].cert, issuers[k.issuer].key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+		if err != nil {
+			return fmt.Errorf("failed creating %s certificate: %w", k.dir, err)
+		}
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		issuers[k.dir] = issued{cert: c, key: key}
+
+		certPem, err := PemFromCert(c)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(kd, "cert.pem"), certPem, 0644); err != nil {
+			return err
+		}
+
+		if k.guid {
+			guid := opts.Owner
+			if guid == (efi.GUID{}) {
+				if guid, err = NewGUID(); err != nil {
+					return err
+				}
+			}
+			// keyset guid files have no trailing newline.
+			if err := os.WriteFile(filepath.Join(kd, "guid"), []byte(guid.String()), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// KeysetKey - one key directory of a keyset.
+type KeysetKey struct {
+	// Name - the name of the directory, such as uefi-db.
+	Name string
+	// Dir - the path of the directory.
+	Dir string
+	// Cert - the certificate in cert.pem.
+	Cert *x509.Certificate
+	// Owner - the owner GUID in guid, or the zero GUID if there is no
+	// guid file.
+	Owner efi.GUID
+	// signer - the key in privkey.pem, or nil if there is none or it
+	// is encrypted and no passphrase was given.
+	signer crypto.Signer
+	// signerErr - why signer is nil.
+	signerErr error
+}
+
+// SignatureData - return the signature database entry of the key.
+func (k *KeysetKey) SignatureData() *efi.SignatureData {
+	return &efi.SignatureData{Owner: k.Owner, Data: k.Cert.Raw}
+}
+
+// Signer - return the private key of the key.
+func (k *KeysetKey) Signer() (crypto.Signer, error) {
+	if k.signer == nil {
+		return nil, fmt.Errorf("%s: %w", k.Name, k.signerErr)
+	}
+	return k.signer, nil
+}
+
+// loadKeysetKey - load the key directory dir.  It is an error if the
+// guid file does not parse or privkey.pem does not match cert.pem.
+func loadKeysetKey(dir string, passphrase []byte) (*KeysetKey, error) {
+	k := &KeysetKey{Name: filepath.Base(dir), Dir: dir}
+
+	var err error
+	if k.Cert, err = CertFromPemFile(filepath.Join(dir, "cert.pem")); err != nil {
+		return nil, fmt.Errorf("%s: %w", k.Name, err)
+	}
+
+	guidPath := filepath.Join(dir, "guid")
+	if _, err := os.Stat(guidPath); err == nil {
+		if k.Owner, err = GUIDFromFile(guidPath); err != nil {
+			return nil, fmt.Errorf("%s: bad owner guid: %w", k.Name, err)
+		}
+	}
+
+	keyPath := filepath.Join(dir, "privkey.pem")
+	if _, err := os.Stat(keyPath); err != nil {
+		k.signerErr = fmt.Errorf("no private key")
+		return k, nil
+	}
+	signer, err := SignerFromPemFile(keyPath, passphrase)
+	if errors.Is(err, ErrPassphraseRequired) {
+		k.signerErr = err
+		return k, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", k.Name, err)
+	}
+	pub, ok := k.Cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(signer.Public()) {
+		return nil, fmt.Errorf("%s: privkey.pem does not match cert.pem", k.Name)
+	}
+	k.signer = signer
+	return k, nil
+}
+
+// Keyset - the keys of a keyset directory, as created by CreateKeyset or
+// in the layout of the project-machine keys repository.
+type Keyset struct {
+	Dir string
+	// PK - the platform key, uefi-pk.
+	PK *KeysetKey
+	// KEK - the key exchange keys, uefi-kek and any uefi-kek-*.
+	KEK []*KeysetKey
+	// DB - the firmware db keys, uefi-db and any uefi-db-*.
+	DB []*KeysetKey
+	// VendorDB - the keys of the shim vendor db: uki-limited,
+	// uki-production and uki-tpm.
+	VendorDB []*KeysetKey
+	// ManifestCA - the CA of signed manifests, manifest-ca.
+	ManifestCA *KeysetKey
+}
+
+// LoadKeyset - load the keyset in dir.  passphrase, if not nil,
+// decrypts encrypted private keys; if it is nil, the private keys that
+// are encrypted are not checked and have no Signer.
+func LoadKeyset(dir string, passphrase []byte) (*Keyset, error) {
+	ks := &Keyset{Dir: dir}
+
+	load := func(name string) (*KeysetKey, error) {
+		k, err := loadKeysetKey(filepath.Join(dir, name), passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("keyset %s: %w", dir, err)
+		}
+		return k, nil
+	}
+	loadAll := func(name string) ([]*KeysetKey, error) {
+		extra, err := filepath.Glob(filepath.Join(dir, name+"-*"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(extra)
+		keys := []*KeysetKey{}
+		for _, n := range append([]string{name}, extra...) {
+			k, err := load(filepath.Base(n))
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+		}
+		return keys, nil
+	}
+
+	var err error
+	if ks.PK, err = load(KeysetPK); err != nil {
+		return nil, err
+	}
+	if ks.KEK, err = loadAll(KeysetKEK); err != nil {
+		return nil, err
+	}
+	if ks.DB, err = loadAll(KeysetDB); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{KeysetUKILimited, KeysetUKIProduction, KeysetUKITPM} {
+		k, err := load(name)
+		if err != nil {
+			return nil, err
+		}
+		ks.VendorDB = append(ks.VendorDB, k)
+	}
+	if ks.ManifestCA, err = load(KeysetManifestCA); err != nil {
+		return nil, err
+	}
+
+	for _, k := range append(append(append([]*KeysetKey{ks.PK}, ks.KEK...), ks.DB...), ks.VendorDB...) {
+		if k.Owner == (efi.GUID{}) {
+			return nil, fmt.Errorf("keyset %s: %s has no owner guid", dir, k.Name)
+		}
+	}
+	return ks, nil
+}
+
+// Key - return the key named name, such as uki-production, or nil if
+// there is none.
+func (ks *Keyset) Key(name string) *KeysetKey {
+	for _, k := range ks.Keys() {
+		if k.Name == name {
+			return k
+		}
+	}
+	return nil
+}
+
+// Keys - return all of the keys of the keyset.
+func (ks *Keyset) Keys() []*KeysetKey {
+	keys := append([]*KeysetKey{ks.PK}, ks.KEK...)
+	keys = append(keys, ks.DB...)
+	keys = append(keys, ks.VendorDB...)
+	return append(keys, ks.ManifestCA)
+}
+
+// signatureData - return the signature database entries of keys.
+func signatureData(keys []*KeysetKey) []*efi.SignatureData {
+	sds := []*efi.SignatureData{}
+	for _, k := range keys {
+		sds = append(sds, k.SignatureData())
+	}
+	return sds
+}
+
+// KEKSignatureData - return the entries of the KEK database.
+func (ks *Keyset) KEKSignatureData() []*efi.SignatureData {
+	return signatureData(ks.KEK)
+}
+
+// DBSignatureData - return the entries of the firmware db.
+func (ks *Keyset) DBSignatureData() []*efi.SignatureData {
+	return signatureData(ks.DB)
+}
+
+// VendorDBSignatureData - return the entries of the shim vendor db.
+func (ks *Keyset) VendorDBSignatureData() []*efi.SignatureData {
+	return signatureData(ks.VendorDB)
+}
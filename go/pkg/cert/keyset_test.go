@@ -0,0 +1,198 @@
+package cert_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	efi "github.com/canonical/go-efilib"
+	. "github.com/project-machine/bootkit/go/pkg/cert"
+)
+
+func TestCreateKeyset(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "snakeoil")
+	opts := KeysetOptions{
+		Organization:  "bootkit",
+		Name:          "snakeoil",
+		Validity:      24 * time.Hour,
+		UEFIAlgorithm: "rsa2048",
+		Algorithm:     "ecdsa-p256",
+	}
+	if err := CreateKeyset(dir, opts); err != nil {
+		t.Fatalf("CreateKeyset: %v", err)
+	}
+
+	certs := map[string]*x509.Certificate{}
+	for _, kd := range []string{KeysetPK, KeysetKEK, KeysetDB, KeysetUKILimited, KeysetUKIProduction, KeysetUKITPM} {
+		owner, err := GUIDFromFile(filepath.Join(dir, kd, "guid"))
+		if err != nil {
+			t.Fatalf("%s guid: %v", kd, err)
+		}
+		if owner == (efi.GUID{}) {
+			t.Errorf("%s has no owner", kd)
+		}
+		if certs[kd], err = CertFromPemFile(filepath.Join(dir, kd, "cert.pem")); err != nil {
+			t.Fatal(err)
+		}
+		key, err := SignerFromPemFile(filepath.Join(dir, kd, "privkey.pem"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !certs[kd].PublicKey.(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+			t.Errorf("%s privkey.pem does not match cert.pem", kd)
+		}
+	}
+	for _, kd := range []string{KeysetManifestCA, KeysetSUDICA} {
+		c, err := CertFromPemFile(filepath.Join(dir, kd, "cert.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.IsCA {
+			t.Errorf("%s is not a CA", kd)
+		}
+	}
+	for _, kd := range []string{KeysetTPMPolAdmin, KeysetTPMPolLUKS} {
+		if _, err := os.Stat(filepath.Join(dir, kd, "pubkey.pem")); err != nil {
+			t.Errorf("%s: %v", kd, err)
+		}
+	}
+
+	// the uki keys sign EFI binaries, so are rsa whatever Algorithm is.
+	if _, ok := certs[KeysetUKIProduction].PublicKey.(*rsa.PublicKey); !ok {
+		t.Errorf("uki-production key is %T, expected rsa", certs[KeysetUKIProduction].PublicKey)
+	}
+	manifestCA, err := CertFromPemFile(filepath.Join(dir, KeysetManifestCA, "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manifestCA.PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("manifest-ca key is %T, expected ecdsa", manifestCA.PublicKey)
+	}
+
+	// db and the uki keys chain to the PK through the KEK, for code signing.
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(certs[KeysetPK])
+	intermediates.AddCert(certs[KeysetKEK])
+	for _, kd := range []string{KeysetDB, KeysetUKILimited, KeysetUKIProduction, KeysetUKITPM} {
+		_, err := certs[kd].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		})
+		if err != nil {
+			t.Errorf("%s does not verify: %v", kd, err)
+		}
+	}
+
+	if err := CreateKeyset(dir, opts); err == nil {
+		t.Errorf("CreateKeyset over an existing keyset succeeded")
+	}
+	opts.UEFIAlgorithm = "ecdsa-p256"
+	if err := CreateKeyset(filepath.Join(t.TempDir(), "ec"), opts); err == nil {
+		t.Errorf("CreateKeyset with ecdsa uefi keys succeeded")
+	}
+	opts.UEFIAlgorithm = "rsa2048"
+	opts.Algorithm = "dsa"
+	if err := CreateKeyset(filepath.Join(t.TempDir(), "bad"), opts); err == nil {
+		t.Errorf("CreateKeyset with an unknown algorithm succeeded")
+	}
+}
+
+func TestLoadKeyset(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "snakeoil")
+	opts := KeysetOptions{
+		Organization:  "bootkit",
+		Name:          "snakeoil",
+		Validity:      24 * time.Hour,
+		UEFIAlgorithm: "rsa2048",
+		Algorithm:     "rsa2048",
+	}
+	if err := CreateKeyset(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err := LoadKeyset(dir, nil)
+	if err != nil {
+		t.Fatalf("LoadKeyset: %v", err)
+	}
+	if len(ks.KEK) != 1 || len(ks.DB) != 1 || len(ks.VendorDB) != 3 {
+		t.Errorf("found %d KEK, %d db and %d vendor db keys", len(ks.KEK), len(ks.DB), len(ks.VendorDB))
+	}
+	if ks.PK.Cert.Subject.CommonName != "UEFI PK" || ks.ManifestCA.Cert.Subject.CommonName != "Manifest CA" {
+		t.Errorf("unexpected PK %s and manifest CA %s", ks.PK.Cert.Subject, ks.ManifestCA.Cert.Subject)
+	}
+	owner, err := GUIDFromFile(filepath.Join(dir, KeysetUKITPM, "guid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := CertFromPemFile(filepath.Join(dir, KeysetUKITPM, "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := ks.VendorDBSignatureData()[2]; found.Owner != owner || !bytes.Equal(found.Data, c.Raw) {
+		t.Errorf("vendor db uki-tpm entry differs from %s", KeysetUKITPM)
+	}
+	if signer, err := ks.Key(KeysetUKIProduction).Signer(); err != nil || signer == nil {
+		t.Errorf("uki-production has no signer: %v", err)
+	}
+	if ks.Key("missing") != nil {
+		t.Errorf("found a missing key")
+	}
+
+	// encrypted keys load without their signer until given the passphrase.
+	keyPath := filepath.Join(dir, KeysetUKILimited, "privkey.pem")
+	rsaKey, err := SignerFromPemFile(keyPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey.(*rsa.PrivateKey)), []byte("bootkit"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ks, err = LoadKeyset(dir, nil); err != nil {
+		t.Fatalf("LoadKeyset with an encrypted key: %v", err)
+	}
+	if _, err := ks.Key(KeysetUKILimited).Signer(); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("encrypted key without a passphrase gave %v", err)
+	}
+	if ks, err = LoadKeyset(dir, []byte("bootkit")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Key(KeysetUKILimited).Signer(); err != nil {
+		t.Errorf("encrypted key with its passphrase: %v", err)
+	}
+
+	// a key that does not match its certificate.
+	other, err := os.ReadFile(filepath.Join(dir, KeysetUKITPM, "privkey.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, other, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyset(dir, nil); err == nil {
+		t.Errorf("LoadKeyset with a mismatched key succeeded")
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey.(*rsa.PrivateKey))}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, KeysetDB, "guid"), []byte("not-a-guid"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyset(dir, nil); err == nil {
+		t.Errorf("LoadKeyset with a bad guid succeeded")
+	}
+}
@@ -0,0 +1,118 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	efi "github.com/canonical/go-efilib"
+)
+
+// DefaultOwner - the owner GUID of certificates that are given without
+// one, as for cert-to-efi-sig-list without -g.
+var DefaultOwner = efi.GUID{}
+
+// keydirPrefix - the prefix of a key directory argument.
+const keydirPrefix = "keydir:"
+
+// CertFromFile - return the PEM or DER certificate in path.
+func CertFromFile(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return certFromBytes(data)
+}
+
+func certFromBytes(data []byte) (*x509.Certificate, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return CertFromPem(data)
+	}
+	return x509.ParseCertificate(data)
+}
+
+// ReadSignatureArg - return the signature database named by arg, which
+// is one of:
+//
+//	keydir:DIR  DIR/cert.pem owned by the GUID in DIR/guid.
+//	GUID:PATH   the PEM or DER certificate PATH owned by GUID.
+//	PATH        a key directory as for keydir:, an EFI signature list
+//	            (.esl) file, or a PEM or DER certificate owned by
+//	            DefaultOwner.
+//
+// Only the text before the first colon is checked for keydir or a GUID,
+// so paths may contain colons.
+func ReadSignatureArg(arg string) (efi.SignatureDatabase, error) {
+	if dir, ok := strings.CutPrefix(arg, keydirPrefix); ok {
+		return readKeydirArg(dir)
+	}
+
+	if prefix, path, ok := strings.Cut(arg, ":"); ok {
+		if guid, err := efi.DecodeGUIDString(prefix); err == nil {
+			c, err := CertFromFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed reading certificate %s: %w", path, err)
+			}
+			return NewEFISignatureDatabase([]*efi.SignatureData{{Owner: guid, Data: c.Raw}}), nil
+		}
+	}
+
+	fi, err := os.Stat(arg)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return readKeydirArg(arg)
+	}
+
+	data, err := os.ReadFile(arg)
+	if err != nil {
+		return nil, err
+	}
+	if c, err := certFromBytes(data); err == nil {
+		return NewEFISignatureDatabase([]*efi.SignatureData{{Owner: DefaultOwner, Data: c.Raw}}), nil
+	}
+	db, err := efi.ReadSignatureDatabase(bytes.NewReader(data))
+	if err != nil || len(db) == 0 {
+		return nil, fmt.Errorf("%s is not a PEM or DER certificate or an EFI signature list", arg)
+	}
+	return db, nil
+}
+
+func readKeydirArg(dir string) (efi.SignatureDatabase, error) {
+	sd, err := LoadSignatureDataDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading key dir %s: %w", dir, err)
+	}
+	return NewEFISignatureDatabase([]*efi.SignatureData{sd}), nil
+}
+
+// ReadSignatureArgs - return the signature database of all of args, as
+// for ReadSignatureArg.
+func ReadSignatureArgs(args []string) (efi.SignatureDatabase, error) {
+	db := efi.SignatureDatabase{}
+	for _, arg := range args {
+		cur, err := ReadSignatureArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		db = append(db, cur...)
+	}
+	return db, nil
+}
+
+// CertSignatureData - return the entries of db, which must all be x509
+// certificates.
+func CertSignatureData(db efi.SignatureDatabase) ([]*efi.SignatureData, error) {
+	sds := []*efi.SignatureData{}
+	for _, l := range db {
+		if l.Type != efi.CertX509Guid {
+			return nil, fmt.Errorf("signature list of type %s is not x509 certificates", l.Type)
+		}
+		sds = append(sds, l.Signatures...)
+	}
+	return sds, nil
+}
@@ -0,0 +1,102 @@
+package cert_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	efi "github.com/canonical/go-efilib"
+	. "github.com/project-machine/bootkit/go/pkg/cert"
+)
+
+func TestReadSignatureArg(t *testing.T) {
+	c, err := CertFromPem(uefiDBPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory with a colon in its name.
+	tmpd := filepath.Join(t.TempDir(), "keys:snakeoil")
+	keydir := filepath.Join(tmpd, "uefi-db")
+	if err := os.MkdirAll(keydir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(path string, data []byte) string {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write(filepath.Join(keydir, "cert.pem"), uefiDBPEM)
+	write(filepath.Join(keydir, "guid"), []byte(puzzleDbGuid.String()))
+	der := write(filepath.Join(tmpd, "db.der"), c.Raw)
+
+	otherGuid := guidFromString("11111111-2222-3333-4444-555555555555")
+	var esl bytes.Buffer
+	eslDB := efi.SignatureDatabase{
+		{Type: efi.CertX509Guid, Signatures: []*efi.SignatureData{{Owner: otherGuid, Data: c.Raw}}},
+		{Type: efi.CertSHA256Guid, Signatures: []*efi.SignatureData{{Owner: otherGuid, Data: bytes.Repeat([]byte{1}, 32)}}},
+	}
+	if err := eslDB.Write(&esl); err != nil {
+		t.Fatal(err)
+	}
+	eslPath := write(filepath.Join(tmpd, "db.esl"), esl.Bytes())
+
+	for _, tc := range []struct {
+		arg    string
+		owners []efi.GUID
+	}{
+		{"keydir:" + keydir, []efi.GUID{puzzleDbGuid}},
+		{keydir, []efi.GUID{puzzleDbGuid}},
+		{otherGuid.String() + ":" + filepath.Join(keydir, "cert.pem"), []efi.GUID{otherGuid}},
+		{otherGuid.String() + ":" + der, []efi.GUID{otherGuid}},
+		{filepath.Join(keydir, "cert.pem"), []efi.GUID{DefaultOwner}},
+		{der, []efi.GUID{DefaultOwner}},
+		{eslPath, []efi.GUID{otherGuid, otherGuid}},
+	} {
+		db, err := ReadSignatureArg(tc.arg)
+		if err != nil {
+			t.Errorf("ReadSignatureArg(%s): %v", tc.arg, err)
+			continue
+		}
+		if len(db) != len(tc.owners) {
+			t.Errorf("ReadSignatureArg(%s) found %d lists, expected %d", tc.arg, len(db), len(tc.owners))
+			continue
+		}
+		for i, l := range db {
+			if len(l.Signatures) != 1 || l.Signatures[0].Owner != tc.owners[i] {
+				t.Errorf("ReadSignatureArg(%s) list %d: %v", tc.arg, i, l.Signatures)
+			}
+		}
+		if db[0].Type != efi.CertX509Guid || !bytes.Equal(db[0].Signatures[0].Data, c.Raw) {
+			t.Errorf("ReadSignatureArg(%s) found the wrong certificate", tc.arg)
+		}
+	}
+
+	db, err := ReadSignatureArgs([]string{keydir, eslPath})
+	if err != nil {
+		t.Fatalf("ReadSignatureArgs: %v", err)
+	}
+	if len(db) != 3 {
+		t.Errorf("ReadSignatureArgs found %d lists, expected 3", len(db))
+	}
+	if _, err := CertSignatureData(db); err == nil {
+		t.Errorf("CertSignatureData accepted a sha256 list")
+	}
+	if sds, err := CertSignatureData(db[:2]); err != nil || len(sds) != 2 {
+		t.Errorf("CertSignatureData found %d entries: %v", len(sds), err)
+	}
+
+	for _, bad := range []string{
+		filepath.Join(tmpd, "missing.pem"),
+		"keydir:" + tmpd,
+		otherGuid.String() + ":" + eslPath,
+		write(filepath.Join(tmpd, "empty"), nil),
+		write(filepath.Join(tmpd, "garbage"), []byte("not a certificate")),
+	} {
+		if _, err := ReadSignatureArg(bad); err == nil {
+			t.Errorf("ReadSignatureArg(%s) succeeded", bad)
+		}
+	}
+}
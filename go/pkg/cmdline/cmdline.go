@@ -0,0 +1,251 @@
+// Package cmdline - build kernel command lines from a base and
+// additions, with placeholders and a policy on what they may contain.
+package cmdline
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Param - a kernel command line parameter, 'key' or 'key=value'.
+type Param struct {
+	Key      string
+	Value    string
+	HasValue bool
+}
+
+func (p Param) String() string {
+	if !p.HasValue {
+		return p.Key
+	}
+	if strings.ContainsAny(p.Value, " \t") {
+		return p.Key + "=\"" + p.Value + "\""
+	}
+	return p.Key + "=" + p.Value
+}
+
+// Cmdline - a parsed kernel command line.
+type Cmdline struct {
+	Params []Param
+	// Init - the arguments after '--', which the kernel passes to init.
+	Init []string
+}
+
+// split - split s at whitespace that is not in double quotes, as the
+// kernel does.  Quotes are removed.
+func split(s string) ([]string, error) {
+	words := []string{}
+	var cur strings.Builder
+	inWord, inQuote := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			inWord = true
+		case !inQuote && (r == ' ' || r == '\t' || r == '\n'):
+			if inWord {
+				words = append(words, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, cur.String())
+	}
+	return words, nil
+}
+
+// Parse - parse the kernel command line s.
+func Parse(s string) (*Cmdline, error) {
+	words, err := split(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cmdline{}
+	for i, w := range words {
+		if w == "--" {
+			c.Init = words[i+1:]
+			break
+		}
+		key, value, found := strings.Cut(w, "=")
+		c.Params = append(c.Params, Param{Key: key, Value: value, HasValue: found})
+	}
+	return c, nil
+}
+
+func (c *Cmdline) String() string {
+	words := []string{}
+	for _, p := range c.Params {
+		words = append(words, p.String())
+	}
+	if len(c.Init) != 0 {
+		words = append(append(words, "--"), c.Init...)
+	}
+	return strings.Join(words, " ")
+}
+
+// Has - return true if c has a parameter with key.
+func (c *Cmdline) Has(key string) bool {
+	for _, p := range c.Params {
+		if p.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge - add the parameters of o to c.  A parameter replaces any
+// earlier one with the same key, in the position of the first, unless
+// the key is in multi, in which case only identical parameters are
+// dropped.  Init arguments of o are appended.
+func (c *Cmdline) Merge(o *Cmdline, multi ...string) {
+	isMulti := map[string]bool{}
+	for _, k := range multi {
+		isMulti[k] = true
+	}
+
+	for _, p := range o.Params {
+		replaced := false
+		params := []Param{}
+		for _, cur := range c.Params {
+			if cur == p || (cur.Key == p.Key && !isMulti[p.Key]) {
+				if !replaced {
+					params = append(params, p)
+					replaced = true
+				}
+				continue
+			}
+			params = append(params, cur)
+		}
+		if !replaced {
+			params = append(params, p)
+		}
+		c.Params = params
+	}
+	c.Init = append(c.Init, o.Init...)
+}
+
+var placeholderRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Expand - replace each ${Name} in s with vars[Name].  An unknown name
+// is an error.
+func Expand(s string, vars map[string]string) (string, error) {
+	var err error
+	expanded := placeholderRe.ReplaceAllStringFunc(s, func(m string) string {
+		name := placeholderRe.FindStringSubmatch(m)[1]
+		v, ok := vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("unknown placeholder %s in %q", m, s)
+		}
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+// ProductionDeny - parameters that give a shell or otherwise change how
+// the system boots, and so should never be in a production image.
+var ProductionDeny = []string{
+	"rd.shell",
+	"rd.break",
+	"rd.debug",
+	"init=",
+	"rdinit=",
+	"single",
+	"emergency",
+	"rescue",
+	"systemd.debug-shell",
+	"systemd.debug_shell",
+	"systemd.unit=emergency.target",
+	"systemd.unit=rescue.target",
+}
+
+// matches - return true if p matches pattern, which is either 'key' or
+// 'key=', matching any value of key, or 'key=value'.
+func matches(p Param, pattern string) bool {
+	key, value, found := strings.Cut(pattern, "=")
+	if p.Key != key {
+		return false
+	}
+	return !found || value == "" || (p.HasValue && p.Value == value)
+}
+
+// Builder - builds kernel command lines.
+type Builder struct {
+	// Vars - the values of ${Name} placeholders.
+	Vars map[string]string
+	// Multi - keys that may be given more than once, like 'console'.
+	Multi []string
+	// Deny - patterns of parameters that are rejected, as 'key', 'key='
+	// or 'key=value'.
+	Deny []string
+	// Allow - if not empty, every parameter must match one of these
+	// patterns.
+	Allow []string
+}
+
+// Check - return an error if c has a parameter or init argument that b
+// does not allow.  Init arguments are checked as parameters, since init
+// reads words like 'single' and 'systemd.unit=rescue.target' from them.
+func (b *Builder) Check(c *Cmdline) error {
+	for _, p := range c.Params {
+		if err := b.check("parameter", p); err != nil {
+			return err
+		}
+	}
+	for _, w := range c.Init {
+		key, value, found := strings.Cut(w, "=")
+		if err := b.check("init argument", Param{Key: key, Value: value, HasValue: found}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Builder) check(kind string, p Param) error {
+	for _, pattern := range b.Deny {
+		if matches(p, pattern) {
+			return fmt.Errorf("%s %s is not allowed (denied by '%s')", kind, p, pattern)
+		}
+	}
+	if len(b.Allow) == 0 {
+		return nil
+	}
+	for _, pattern := range b.Allow {
+		if matches(p, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s is not in the allowed list", kind, p)
+}
+
+// Build - expand placeholders in base and each of additions, merge them
+// in order and check the result.
+func (b *Builder) Build(base string, additions ...string) (string, error) {
+	c := &Cmdline{}
+	for _, s := range append([]string{base}, additions...) {
+		expanded, err := Expand(s, b.Vars)
+		if err != nil {
+			return "", err
+		}
+		o, err := Parse(expanded)
+		if err != nil {
+			return "", err
+		}
+		c.Merge(o, b.Multi...)
+	}
+	if err := b.Check(c); err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
@@ -0,0 +1,102 @@
+package cmdline
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse(`root=/dev/sda1  quiet dyndbg="file foo.c +p" -- single arg`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(c.Params) != 3 {
+		t.Fatalf("found %d params, expected 3: %v", len(c.Params), c.Params)
+	}
+	if p := c.Params[2]; p.Key != "dyndbg" || p.Value != "file foo.c +p" {
+		t.Errorf("quoted param was %+v", p)
+	}
+	if p := c.Params[1]; p.Key != "quiet" || p.HasValue {
+		t.Errorf("flag param was %+v", p)
+	}
+	if len(c.Init) != 2 || c.Init[0] != "single" {
+		t.Errorf("init args were %v", c.Init)
+	}
+	expected := `root=/dev/sda1 quiet dyndbg="file foo.c +p" -- single arg`
+	if got := c.String(); got != expected {
+		t.Errorf("String() was %q, expected %q", got, expected)
+	}
+
+	if _, err := Parse(`foo="bar`); err == nil {
+		t.Errorf("Parse succeeded with an unterminated quote")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	b := &Builder{
+		Vars: map[string]string{"ISOLabel": "OCI-BOOT", "BootLayerName": "live-boot:latest"},
+	}
+
+	tests := []struct {
+		base      string
+		additions []string
+		expected  string
+	}{
+		{
+			"root=soci:name=${BootLayerName},dev=LABEL=${ISOLabel} console=tty0",
+			[]string{"console=ttyS0,115200 quiet", "root=/dev/vda quiet"},
+			"root=/dev/vda console=ttyS0,115200 quiet",
+		},
+		{"", []string{"", "quiet"}, "quiet"},
+		{"a=1 b a=2", nil, "a=2 b"},
+	}
+	for _, test := range tests {
+		got, err := b.Build(test.base, test.additions...)
+		if err != nil {
+			t.Errorf("Build(%q, %q) failed: %v", test.base, test.additions, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("Build(%q, %q) = %q, expected %q", test.base, test.additions, got, test.expected)
+		}
+	}
+
+	b.Multi = []string{"console"}
+	got, err := b.Build("console=tty0 console=ttyS0", "console=tty0 console=hvc0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "console=tty0 console=ttyS0 console=hvc0"; got != expected {
+		t.Errorf("Build with Multi = %q, expected %q", got, expected)
+	}
+
+	if _, err := b.Build("root=${Unknown}"); err == nil {
+		t.Errorf("Build succeeded with an unknown placeholder")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	b := &Builder{Deny: ProductionDeny}
+	for _, s := range []string{"rd.shell", "rd.shell=1", "init=/bin/sh", "systemd.unit=rescue.target",
+		"-- single", "-- emergency", "-- rescue", "-- systemd.unit=emergency.target"} {
+		if _, err := b.Build("quiet", s); err == nil {
+			t.Errorf("Build succeeded with denied %q", s)
+		}
+	}
+	if _, err := b.Build("quiet init.foo=1 systemd.unit=multi-user.target"); err != nil {
+		t.Errorf("Build failed: %v", err)
+	}
+
+	b = &Builder{Allow: []string{"root=", "console", "quiet"}}
+	if _, err := b.Build("root=/dev/vda console=ttyS0 quiet"); err != nil {
+		t.Errorf("Build failed: %v", err)
+	}
+	if _, err := b.Build("root=/dev/vda", "debug"); err == nil {
+		t.Errorf("Build succeeded with a parameter not in the allow list")
+	}
+	if _, err := b.Build("root=/dev/vda", "-- debug"); err == nil {
+		t.Errorf("Build succeeded with an init argument not in the allow list")
+	}
+	if _, err := b.Build("root=/dev/vda -- quiet"); err != nil {
+		t.Errorf("Build failed with an allowed init argument: %v", err)
+	}
+}
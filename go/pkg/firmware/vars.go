@@ -0,0 +1,164 @@
+package firmware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"unicode/utf16"
+
+	efi "github.com/canonical/go-efilib"
+)
+
+// Variable - a UEFI variable read from a varstore.
+type Variable struct {
+	Name       string
+	GUID       efi.GUID
+	Attributes efi.VariableAttributes
+	Data       []byte
+}
+
+// VarStore - the variables of an OVMF vars file, in the order stored.
+type VarStore []Variable
+
+var (
+	// authenticated and plain variable store signatures, from edk2
+	// MdeModulePkg/Include/Guid/VariableFormat.h
+	authVarStoreGUID = efi.MakeGUID(0xaaf32c78, 0x947b, 0x439a, 0xa180, [...]uint8{0x2e, 0x14, 0x4e, 0xc3, 0x77, 0x92})
+	varStoreGUID     = efi.MakeGUID(0xddcf3616, 0x3275, 0x4164, 0x98b6, [...]uint8{0xfe, 0x85, 0x70, 0x7f, 0xfe, 0x7d})
+)
+
+const (
+	fvSignatureOffset    = 40
+	fvHeaderLengthOffset = 48
+	fvSignature          = "_FVH"
+	varStoreHeaderSize   = 28
+	varStartID           = 0x55aa
+	// headers of a variable, without the name and data.
+	authVarHeaderSize = 60
+	varHeaderSize     = 32
+	// a variable is live in either of these states.
+	varAdded                  = 0x3f
+	varAddedInDeletedTransfer = 0x3e
+)
+
+// ParseOVMFVars - parse the variables in an OVMF vars file, which is a
+// firmware volume holding an edk2 variable store.
+func ParseOVMFVars(data []byte) (VarStore, error) {
+	if len(data) < fvHeaderLengthOffset+2 || string(data[fvSignatureOffset:fvSignatureOffset+4]) != fvSignature {
+		return nil, fmt.Errorf("not a firmware volume")
+	}
+	hdrLen := int(binary.LittleEndian.Uint16(data[fvHeaderLengthOffset:]))
+	if hdrLen+varStoreHeaderSize > len(data) {
+		return nil, fmt.Errorf("firmware volume header length %d is too large", hdrLen)
+	}
+
+	store := data[hdrLen:]
+	var guid efi.GUID
+	copy(guid[:], store)
+	var headerSize int
+	switch guid {
+	case authVarStoreGUID:
+		headerSize = authVarHeaderSize
+	case varStoreGUID:
+		headerSize = varHeaderSize
+	default:
+		return nil, fmt.Errorf("unknown variable store %s", guid)
+	}
+	size := int(binary.LittleEndian.Uint32(store[16:]))
+	if size < varStoreHeaderSize || size > len(store) {
+		return nil, fmt.Errorf("bad variable store size %d", size)
+	}
+	store = store[:size]
+
+	vars := VarStore{}
+	for off := varStoreHeaderSize; off+headerSize <= len(store); {
+		hdr := store[off : off+headerSize]
+		if binary.LittleEndian.Uint16(hdr) != varStartID {
+			break
+		}
+		state := hdr[2]
+		attrs := binary.LittleEndian.Uint32(hdr[4:])
+		// NameSize, DataSize and VendorGuid end the header.
+		nameSize := int(binary.LittleEndian.Uint32(hdr[headerSize-24:]))
+		dataSize := int(binary.LittleEndian.Uint32(hdr[headerSize-20:]))
+		var vendor efi.GUID
+		copy(vendor[:], hdr[headerSize-16:])
+
+		nameOff := off + headerSize
+		dataOff := nameOff + nameSize
+		end := dataOff + dataSize
+		if nameSize%2 != 0 || end > len(store) {
+			return nil, fmt.Errorf("bad variable at offset 0x%x", hdrLen+off)
+		}
+
+		if state == varAdded || state == varAddedInDeletedTransfer {
+			vars = append(vars, Variable{
+				Name:       decodeUTF16(store[nameOff:dataOff]),
+				GUID:       vendor,
+				Attributes: efi.VariableAttributes(attrs),
+				Data:       append([]byte{}, store[dataOff:end]...),
+			})
+		}
+
+		// variables are aligned to 4 bytes.
+		off = (end + 3) &^ 3
+	}
+
+	return vars, nil
+}
+
+// decodeUTF16 - decode a NUL terminated UTF-16LE name.
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// ReadOVMFVars - read the variables in the OVMF vars file at path.
+func ReadOVMFVars(path string) (VarStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	vars, err := ParseOVMFVars(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return vars, nil
+}
+
+// Get - return the variable name with the vendor guid, or nil if there
+// is none.
+func (s VarStore) Get(name string, guid efi.GUID) *Variable {
+	for i := range s {
+		if s[i].Name == name && s[i].GUID == guid {
+			return &s[i]
+		}
+	}
+	return nil
+}
+
+// SignatureDatabase - return the content of the signature database
+// variable name (PK, KEK, db or dbx), which is empty if it is not set.
+func (s VarStore) SignatureDatabase(name string) (efi.SignatureDatabase, error) {
+	guid := efi.GlobalVariable
+	if name == "db" || name == "dbx" {
+		guid = efi.ImageSecurityDatabaseGuid
+	}
+	v := s.Get(name, guid)
+	if v == nil {
+		return efi.SignatureDatabase{}, nil
+	}
+	db, err := efi.ReadSignatureDatabase(bytes.NewReader(v.Data))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %w", name, err)
+	}
+	return db, nil
+}
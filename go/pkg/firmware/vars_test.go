@@ -0,0 +1,101 @@
+package firmware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	efi "github.com/canonical/go-efilib"
+)
+
+type testVar struct {
+	name  string
+	guid  efi.GUID
+	state uint8
+	data  []byte
+}
+
+// testVarsFile - return a firmware volume with an authenticated
+// variable store holding vars.
+func testVarsFile(t *testing.T, vars ...testVar) []byte {
+	t.Helper()
+	const fvHeaderLength = 0x48
+
+	var store bytes.Buffer
+	for _, v := range vars {
+		name := utf16.Encode([]rune(v.name + "\x00"))
+		binary.Write(&store, binary.LittleEndian, uint16(varStartID))
+		store.WriteByte(v.state)
+		store.WriteByte(0)
+		binary.Write(&store, binary.LittleEndian, uint32(efi.AttributeNonVolatile|efi.AttributeBootserviceAccess))
+		store.Write(make([]byte, 8+16+4)) // MonotonicCount, TimeStamp, PubKeyIndex
+		binary.Write(&store, binary.LittleEndian, uint32(len(name)*2))
+		binary.Write(&store, binary.LittleEndian, uint32(len(v.data)))
+		store.Write(v.guid[:])
+		binary.Write(&store, binary.LittleEndian, name)
+		store.Write(v.data)
+		for store.Len()%4 != 0 {
+			store.WriteByte(0xff)
+		}
+	}
+	// the unused space of a store is erased flash.
+	store.Write(bytes.Repeat([]byte{0xff}, 64))
+
+	var b bytes.Buffer
+	fv := make([]byte, fvHeaderLength)
+	copy(fv[fvSignatureOffset:], fvSignature)
+	binary.LittleEndian.PutUint16(fv[fvHeaderLengthOffset:], fvHeaderLength)
+	b.Write(fv)
+	b.Write(authVarStoreGUID[:])
+	binary.Write(&b, binary.LittleEndian, uint32(varStoreHeaderSize+store.Len()))
+	b.Write([]byte{0x5a, 0xfe, 0, 0, 0, 0, 0, 0})
+	b.Write(store.Bytes())
+	return b.Bytes()
+}
+
+func TestParseOVMFVars(t *testing.T) {
+	dbData, err := efi.SignatureDatabase{{
+		Type:       efi.CertSHA256Guid,
+		Signatures: []*efi.SignatureData{{Owner: efi.GUID{1}, Data: bytes.Repeat([]byte{2}, 32)}}},
+	}.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testVarsFile(t,
+		// VAR_ADDED & VAR_DELETED, so not live.
+		testVar{"PK", efi.GlobalVariable, 0x3c, []byte("deleted")},
+		testVar{"db", efi.ImageSecurityDatabaseGuid, varAdded, dbData},
+		testVar{"Boot0000", efi.GlobalVariable, varAddedInDeletedTransfer, []byte("odd")},
+	)
+
+	vars, err := ParseOVMFVars(data)
+	if err != nil {
+		t.Fatalf("ParseOVMFVars: %v", err)
+	}
+	if len(vars) != 2 {
+		t.Fatalf("found %d variables, expected 2: %+v", len(vars), vars)
+	}
+	if v := vars.Get("Boot0000", efi.GlobalVariable); v == nil || string(v.Data) != "odd" {
+		t.Errorf("Boot0000 was %+v", v)
+	}
+	if v := vars.Get("PK", efi.GlobalVariable); v != nil {
+		t.Errorf("found deleted PK %+v", v)
+	}
+
+	db, err := vars.SignatureDatabase("db")
+	if err != nil {
+		t.Fatalf("SignatureDatabase: %v", err)
+	}
+	if len(db) != 1 || db[0].Type != efi.CertSHA256Guid {
+		t.Errorf("db was %v", db)
+	}
+	if kek, err := vars.SignatureDatabase("KEK"); err != nil || len(kek) != 0 {
+		t.Errorf("missing KEK was %v, %v", kek, err)
+	}
+
+	if _, err := ParseOVMFVars(data[:0x40]); err == nil {
+		t.Errorf("ParseOVMFVars succeeded on a truncated file")
+	}
+}
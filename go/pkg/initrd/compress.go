@@ -0,0 +1,148 @@
+package initrd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// magic bytes for each compression, as checked by the kernel in
+// lib/decompress.c.
+var compressionMagic = []struct {
+	comp  Compression
+	magic []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b}},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{Xz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{Lzma, []byte{0x5d, 0x00, 0x00}},
+	{Lz4Legacy, []byte{0x02, 0x21, 0x4c, 0x18}},
+}
+
+// compressionMagicLen - number of bytes needed by DetectCompression.
+const compressionMagicLen = 6
+
+var compressionNames = map[Compression]string{
+	Undetermined: "undetermined",
+	Identity:     "none",
+	Gzip:         "gzip",
+	Zstd:         "zstd",
+	Xz:           "xz",
+	Lzma:         "lzma",
+	Lz4Legacy:    "lz4",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+func (c Compression) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// ParseCompression - return the Compression named 'name' as returned
+// by Compression.String.
+func ParseCompression(name string) (Compression, error) {
+	for c, cname := range compressionNames {
+		if c != Undetermined && cname == strings.ToLower(name) {
+			return c, nil
+		}
+	}
+	return Undetermined, fmt.Errorf("unknown compression '%s'", name)
+}
+
+// DetectCompression - determine compression from the leading bytes of
+// a stream.  Data that is not recognized is assumed to be Identity.
+func DetectCompression(buf []byte) Compression {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(buf, m.magic) {
+			return m.comp
+		}
+	}
+	return Identity
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// NewDecompressor - return a reader of the content of r uncompressed
+// with comp.
+func NewDecompressor(r io.Reader, comp Compression) (io.ReadCloser, error) {
+	switch comp {
+	case Identity:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{d}, nil
+	case Xz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case Lzma:
+		lr, err := lzma.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(lr), nil
+	case Lz4Legacy:
+		return io.NopCloser(lz4.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %s", comp)
+}
+
+// NewCompressor - return a writer that compresses with comp and writes to w.
+// Close must be called to flush the compressed stream; w is not closed.
+//
+// The only option that the kernel's decompressors require is the crc32
+// check of xz.
+func NewCompressor(w io.Writer, comp Compression) (io.WriteCloser, error) {
+	switch comp {
+	case Identity:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case Zstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	case Xz:
+		// the kernel's xz decompressor only supports crc32 checks.
+		return xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(w)
+	case Lzma:
+		return lzma.NewWriter(w)
+	case Lz4Legacy:
+		lw := lz4.NewWriter(w)
+		if err := lw.Apply(lz4.LegacyOption(true)); err != nil {
+			return nil, err
+		}
+		return lw, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %s", comp)
+}
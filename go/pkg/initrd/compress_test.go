@@ -0,0 +1,57 @@
+package initrd
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	var archive bytes.Buffer
+	writeTestArchive(t, &archive, testEntries)
+
+	for _, comp := range []Compression{Identity, Gzip, Zstd, Xz, Lzma, Lz4Legacy} {
+		var b bytes.Buffer
+		enc, err := NewCompressor(&b, comp)
+		if err != nil {
+			t.Fatalf("%s: NewCompressor: %v", comp, err)
+		}
+		if _, err := enc.Write(archive.Bytes()); err != nil {
+			t.Fatalf("%s: Write: %v", comp, err)
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", comp, err)
+		}
+
+		if found := DetectCompression(b.Bytes()); found != comp {
+			t.Errorf("%s: detected compression %s", comp, found)
+		}
+
+		dec, err := NewDecompressor(&b, comp)
+		if err != nil {
+			t.Fatalf("%s: NewDecompressor: %v", comp, err)
+		}
+		data, err := io.ReadAll(dec)
+		dec.Close()
+		if err != nil {
+			t.Fatalf("%s: reading: %v", comp, err)
+		}
+		if !bytes.Equal(data, archive.Bytes()) {
+			t.Errorf("%s: content differed after round trip", comp)
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for _, comp := range []Compression{Identity, Gzip, Zstd, Xz, Lzma, Lz4Legacy} {
+		found, err := ParseCompression(comp.String())
+		if err != nil {
+			t.Errorf("%s: %v", comp, err)
+		} else if found != comp {
+			t.Errorf("%s: parsed as %s", comp, found)
+		}
+	}
+	if _, err := ParseCompression("bzip2"); err == nil {
+		t.Errorf("expected error parsing bzip2")
+	}
+}
@@ -0,0 +1,365 @@
+package initrd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+)
+
+// newc format is documented at
+// https://www.kernel.org/doc/html/latest/driver-api/early-userspace/buffer-format.html
+//
+// Each entry is a 110 byte ascii header, followed by the NUL terminated
+// file name padded to a 4 byte boundary, followed by the file data padded
+// to a 4 byte boundary. The archive ends with an entry named TRAILER!!!.
+const (
+	newcMagic    = "070701"
+	newcCRCMagic = "070702"
+	newcHdrSize  = 110
+	TrailerName  = "TRAILER!!!"
+
+	// cpio writes archives in 512 byte blocks.
+	cpioBlockSize = 512
+)
+
+// File type bits of Header.Mode.
+const (
+	ModeTypeMask = 0170000
+	ModeSocket   = 0140000
+	ModeSymlink  = 0120000
+	ModeRegular  = 0100000
+	ModeBlock    = 0060000
+	ModeDir      = 0040000
+	ModeChar     = 0020000
+	ModeFifo     = 0010000
+	ModePermMask = 0007777
+)
+
+// Header - a single newc cpio entry header.
+type Header struct {
+	Ino       uint32
+	Mode      uint32
+	UID       uint32
+	GID       uint32
+	Nlink     uint32
+	Mtime     uint32
+	FileSize  uint32
+	DevMajor  uint32
+	DevMinor  uint32
+	RDevMajor uint32
+	RDevMinor uint32
+	Check     uint32
+	Name      string
+}
+
+// FileMode - return Mode as an fs.FileMode.
+func (h *Header) FileMode() fs.FileMode {
+	mode := fs.FileMode(h.Mode & 0777)
+	if h.Mode&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if h.Mode&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if h.Mode&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	switch h.Mode & ModeTypeMask {
+	case ModeDir:
+		mode |= fs.ModeDir
+	case ModeSymlink:
+		mode |= fs.ModeSymlink
+	case ModeBlock:
+		mode |= fs.ModeDevice
+	case ModeChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case ModeFifo:
+		mode |= fs.ModeNamedPipe
+	case ModeSocket:
+		mode |= fs.ModeSocket
+	}
+	return mode
+}
+
+func (h *Header) IsDir() bool {
+	return h.Mode&ModeTypeMask == ModeDir
+}
+
+func (h *Header) IsRegular() bool {
+	return h.Mode&ModeTypeMask == ModeRegular
+}
+
+func (h *Header) IsSymlink() bool {
+	return h.Mode&ModeTypeMask == ModeSymlink
+}
+
+func (h *Header) IsTrailer() bool {
+	return h.Name == TrailerName
+}
+
+func pad4(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+// ArchiveReader - read entries from an uncompressed newc cpio stream.
+//
+// Concatenated archives are read as one; the trailer of each is consumed
+// along with any zero padding that follows it.  Next returns io.EOF once
+// the stream is exhausted.
+type ArchiveReader struct {
+	r         io.Reader
+	remaining int64 // bytes of current entry's data not yet read.
+	padding   int64 // bytes of padding after current entry's data.
+	offset    int64
+	archives  int
+	single    bool // stop at the first trailer.
+}
+
+func NewArchiveReader(r io.Reader) *ArchiveReader {
+	return &ArchiveReader{r: r}
+}
+
+// newSingleArchiveReader - return an ArchiveReader whose Next returns
+// io.EOF at the first trailer, leaving r positioned just after it.
+func newSingleArchiveReader(r io.Reader) *ArchiveReader {
+	return &ArchiveReader{r: r, single: true}
+}
+
+// Archives - the number of archive trailers seen so far.
+func (a *ArchiveReader) Archives() int {
+	return a.archives
+}
+
+func (a *ArchiveReader) read(p []byte) error {
+	n, err := io.ReadFull(a.r, p)
+	a.offset += int64(n)
+	return err
+}
+
+func (a *ArchiveReader) skip(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	copied, err := io.CopyN(io.Discard, a.r, n)
+	a.offset += copied
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Next - advance to the next entry, skipping any unread data of the
+// current entry.  Trailer entries are not returned.
+func (a *ArchiveReader) Next() (*Header, error) {
+	if err := a.skip(a.remaining + a.padding); err != nil {
+		return nil, err
+	}
+	a.remaining, a.padding = 0, 0
+
+	for {
+		hdr, err := a.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		if !hdr.IsTrailer() {
+			return hdr, nil
+		}
+		a.archives++
+		if a.single {
+			return nil, io.EOF
+		}
+	}
+}
+
+// readHeader - read a header, skipping the zero padding that may precede it.
+func (a *ArchiveReader) readHeader() (*Header, error) {
+	buf := make([]byte, newcHdrSize)
+
+	// padding between archives is NUL bytes, always in multiples of 4.
+	for {
+		if err := a.read(buf[:4]); err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("failed reading header at offset %d: %w", a.offset, err)
+		}
+		if !bytes.Equal(buf[:4], []byte{0, 0, 0, 0}) {
+			break
+		}
+	}
+
+	start := a.offset - 4
+	if err := a.read(buf[4:]); err != nil {
+		return nil, fmt.Errorf("short header at offset %d: %w", start, err)
+	}
+
+	magic := string(buf[:6])
+	if magic != newcMagic && magic != newcCRCMagic {
+		return nil, fmt.Errorf("bad magic '%q' at offset %d: not a newc cpio", buf[:6], start)
+	}
+
+	fields := make([]uint32, 13)
+	for i := range fields {
+		off := 6 + i*8
+		v, err := strconv.ParseUint(string(buf[off:off+8]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad header field %d at offset %d: %v", i, start, err)
+		}
+		fields[i] = uint32(v)
+	}
+
+	hdr := &Header{
+		Ino:       fields[0],
+		Mode:      fields[1],
+		UID:       fields[2],
+		GID:       fields[3],
+		Nlink:     fields[4],
+		Mtime:     fields[5],
+		FileSize:  fields[6],
+		DevMajor:  fields[7],
+		DevMinor:  fields[8],
+		RDevMajor: fields[9],
+		RDevMinor: fields[10],
+		Check:     fields[12],
+	}
+
+	nameSize := int64(fields[11])
+	if nameSize == 0 {
+		return nil, fmt.Errorf("entry at offset %d has empty name", start)
+	}
+	name := make([]byte, nameSize+pad4(newcHdrSize+nameSize))
+	if err := a.read(name); err != nil {
+		return nil, fmt.Errorf("short name in entry at offset %d: %w", start, err)
+	}
+	hdr.Name = string(bytes.TrimRight(name[:nameSize], "\x00"))
+
+	a.remaining = int64(hdr.FileSize)
+	a.padding = pad4(a.remaining)
+
+	return hdr, nil
+}
+
+// Read - read data of the current entry.
+func (a *ArchiveReader) Read(p []byte) (int, error) {
+	if a.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > a.remaining {
+		p = p[:a.remaining]
+	}
+	n, err := a.r.Read(p)
+	a.offset += int64(n)
+	a.remaining -= int64(n)
+	if err == io.EOF && a.remaining != 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// ArchiveWriter - write a newc cpio archive.
+type ArchiveWriter struct {
+	w         io.Writer
+	remaining int64
+	padding   int64
+	written   int64
+	closed    bool
+}
+
+func NewArchiveWriter(w io.Writer) *ArchiveWriter {
+	return &ArchiveWriter{w: w}
+}
+
+func (a *ArchiveWriter) write(p []byte) error {
+	n, err := a.w.Write(p)
+	a.written += int64(n)
+	return err
+}
+
+func (a *ArchiveWriter) finishEntry() error {
+	if a.remaining != 0 {
+		return fmt.Errorf("entry is missing %d bytes of data", a.remaining)
+	}
+	if a.padding != 0 {
+		if err := a.write(make([]byte, a.padding)); err != nil {
+			return err
+		}
+		a.padding = 0
+	}
+	return nil
+}
+
+// WriteHeader - write hdr and prepare to accept hdr.FileSize bytes of data.
+func (a *ArchiveWriter) WriteHeader(hdr *Header) error {
+	if a.closed {
+		return fmt.Errorf("write to closed archive")
+	}
+	if err := a.finishEntry(); err != nil {
+		return err
+	}
+
+	nameSize := int64(len(hdr.Name) + 1)
+	buf := bytes.NewBufferString(newcMagic)
+	for _, v := range []uint32{
+		hdr.Ino, hdr.Mode, hdr.UID, hdr.GID, hdr.Nlink, hdr.Mtime, hdr.FileSize,
+		hdr.DevMajor, hdr.DevMinor, hdr.RDevMajor, hdr.RDevMinor,
+		uint32(nameSize), hdr.Check} {
+		fmt.Fprintf(buf, "%08x", v)
+	}
+	buf.WriteString(hdr.Name)
+	buf.Write(make([]byte, 1+pad4(newcHdrSize+nameSize)))
+
+	if err := a.write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	a.remaining = int64(hdr.FileSize)
+	a.padding = pad4(a.remaining)
+	return nil
+}
+
+// Write - write data for the current entry.
+func (a *ArchiveWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > a.remaining {
+		return 0, fmt.Errorf("write of %d bytes exceeds entry size by %d", len(p), int64(len(p))-a.remaining)
+	}
+	n, err := a.w.Write(p)
+	a.written += int64(n)
+	a.remaining -= int64(n)
+	return n, err
+}
+
+// Close - write the trailer and pad the archive to a full block.
+// The underlying writer is not closed.
+func (a *ArchiveWriter) Close() error {
+	if a.closed {
+		return nil
+	}
+	if err := a.WriteHeader(&Header{Name: TrailerName, Nlink: 1}); err != nil {
+		return err
+	}
+	a.closed = true
+	if n := a.written % cpioBlockSize; n != 0 {
+		return a.write(make([]byte, cpioBlockSize-n))
+	}
+	return nil
+}
+
+// CopyArchive - copy every entry in r to w.  The trailer is not written.
+func CopyArchive(w *ArchiveWriter, r *ArchiveReader) error {
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return fmt.Errorf("failed copying %s: %w", hdr.Name, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package initrd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testEntry struct {
+	hdr  Header
+	data string
+}
+
+var testEntries = []testEntry{
+	{Header{Name: "etc", Mode: ModeDir | 0755, Nlink: 2}, ""},
+	{Header{Name: "etc/hostname", Mode: ModeRegular | 0644, Nlink: 1, Mtime: 1700000000}, "bootkit\n"},
+	{Header{Name: "etc/odd", Mode: ModeRegular | 0600, Nlink: 1, UID: 1000, GID: 100}, "abcde"},
+	{Header{Name: "bin/sh", Mode: ModeSymlink | 0777, Nlink: 1}, "busybox"},
+	{Header{Name: "dev/console", Mode: ModeChar | 0600, Nlink: 1, RDevMajor: 5, RDevMinor: 1}, ""},
+}
+
+func writeTestArchive(t *testing.T, w io.Writer, entries []testEntry) {
+	t.Helper()
+	aw := NewArchiveWriter(w)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.FileSize = uint32(len(e.data))
+		if err := aw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("WriteHeader %s: %v", hdr.Name, err)
+		}
+		if _, err := aw.Write([]byte(e.data)); err != nil {
+			t.Fatalf("Write %s: %v", hdr.Name, err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func readTestArchive(t *testing.T, r io.Reader) []testEntry {
+	t.Helper()
+	found := []testEntry{}
+	ar := NewArchiveReader(r)
+	for {
+		hdr, err := ar.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		data, err := io.ReadAll(ar)
+		if err != nil {
+			t.Fatalf("reading %s: %v", hdr.Name, err)
+		}
+		found = append(found, testEntry{*hdr, string(data)})
+	}
+	return found
+}
+
+func checkEntries(t *testing.T, found, expected []testEntry) {
+	t.Helper()
+	if len(found) != len(expected) {
+		t.Fatalf("found %d entries, expected %d", len(found), len(expected))
+	}
+	for i, e := range expected {
+		hdr := e.hdr
+		hdr.FileSize = uint32(len(e.data))
+		if found[i].hdr != hdr {
+			t.Errorf("entry %d: found %+v, expected %+v", i, found[i].hdr, hdr)
+		}
+		if found[i].data != e.data {
+			t.Errorf("entry %d (%s): found data %q expected %q", i, hdr.Name, found[i].data, e.data)
+		}
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	writeTestArchive(t, &b, testEntries)
+
+	if b.Len()%cpioBlockSize != 0 {
+		t.Errorf("archive length %d is not a multiple of %d", b.Len(), cpioBlockSize)
+	}
+	if !bytes.HasPrefix(b.Bytes(), []byte(newcMagic)) {
+		t.Errorf("archive did not start with newc magic")
+	}
+
+	checkEntries(t, readTestArchive(t, &b), testEntries)
+}
+
+func TestArchiveConcatenated(t *testing.T) {
+	var b bytes.Buffer
+	writeTestArchive(t, &b, testEntries[:2])
+	writeTestArchive(t, &b, testEntries[2:])
+
+	ar := NewArchiveReader(&b)
+	n := 0
+	for {
+		if _, err := ar.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		n++
+	}
+	if n != len(testEntries) {
+		t.Errorf("found %d entries, expected %d", n, len(testEntries))
+	}
+	if ar.Archives() != 2 {
+		t.Errorf("found %d archives, expected 2", ar.Archives())
+	}
+}
+
+func TestArchiveBadMagic(t *testing.T) {
+	ar := NewArchiveReader(bytes.NewBufferString("070707" + string(make([]byte, 200))))
+	if _, err := ar.Next(); err == nil {
+		t.Errorf("expected error reading odc archive")
+	}
+}
+
+func TestArchiveWriteTooMuch(t *testing.T) {
+	aw := NewArchiveWriter(io.Discard)
+	if err := aw.WriteHeader(&Header{Name: "f", Mode: ModeRegular, FileSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aw.Write([]byte("abc")); err == nil {
+		t.Errorf("expected error writing more than FileSize")
+	}
+	if err := aw.WriteHeader(&Header{Name: "g"}); err == nil {
+		t.Errorf("expected error writing header with data missing")
+	}
+}
+
+func TestCpioFileReader(t *testing.T) {
+	tmpd := t.TempDir()
+	plain := filepath.Join(tmpd, "plain.cpio")
+
+	var b bytes.Buffer
+	writeTestArchive(t, &b, testEntries)
+	if err := os.WriteFile(plain, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewCpioFileReader(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if r.Compression() != Identity {
+		t.Errorf("found compression %s, expected %s", r.Compression(), Identity)
+	}
+	if err := r.SetCompression(Gzip); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("output was not gzip: %v", err)
+	}
+	checkEntries(t, readTestArchive(t, zr), testEntries)
+
+	if err := r.SetCompression(Identity); err == nil {
+		t.Errorf("expected error setting compression after read")
+	}
+
+	ur, err := r.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ur.Close()
+	checkEntries(t, readTestArchive(t, ur), testEntries)
+}
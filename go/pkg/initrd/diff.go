@@ -0,0 +1,178 @@
+package initrd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// FileState - the state of a path once an initramfs has been unpacked.
+type FileState struct {
+	Mode uint32 `json:"-"`
+	// Perms - the mode as shown by ls, like -rw-r--r--.
+	Perms   string `json:"mode"`
+	UID     uint32 `json:"uid"`
+	GID     uint32 `json:"gid"`
+	Size    uint32 `json:"size"`
+	SHA256  string `json:"sha256,omitempty"`
+	Link    string `json:"link,omitempty"`
+	Rdev    string `json:"rdev,omitempty"`
+	Segment int    `json:"segment"`
+}
+
+// ChangeType - how a path differs between two initramfs.
+type ChangeType string
+
+const (
+	Added    ChangeType = "added"
+	Removed  ChangeType = "removed"
+	Modified ChangeType = "modified"
+)
+
+// Change - a path that differs between two initramfs.
+type Change struct {
+	Path string     `json:"path"`
+	Type ChangeType `json:"type"`
+	Old  *FileState `json:"old,omitempty"`
+	New  *FileState `json:"new,omitempty"`
+	// Fields - for Modified, what differs: type, mode, owner, size,
+	// content, link or rdev.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// ReadFileStates - read every segment of s and return the state of each
+// path, keyed by the cleaned path.  As when the kernel unpacks it, a
+// later entry for a path replaces an earlier one.
+func ReadFileStates(s *SegmentReader) (map[string]*FileState, error) {
+	states := map[string]*FileState{}
+	// hard links share the data of whichever link in the group has it.
+	// inode numbers are only unique within one archive.
+	links := map[linkKey][]*FileState{}
+
+	for {
+		hdr, err := s.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		st := &FileState{
+			Mode:    hdr.Mode,
+			Perms:   hdr.FileMode().String(),
+			UID:     hdr.UID,
+			GID:     hdr.GID,
+			Size:    hdr.FileSize,
+			Segment: s.Segment().Index,
+		}
+
+		switch hdr.Mode & ModeTypeMask {
+		case ModeRegular:
+			h := sha256.New()
+			if _, err := io.Copy(h, s); err != nil {
+				return nil, fmt.Errorf("failed reading %s: %w", hdr.Name, err)
+			}
+			st.SHA256 = hex.EncodeToString(h.Sum(nil))
+			if hdr.Nlink > 1 {
+				key := linkKey{s.Archive(), hdr.Ino}
+				links[key] = append(links[key], st)
+			}
+		case ModeSymlink:
+			target, err := io.ReadAll(s)
+			if err != nil {
+				return nil, fmt.Errorf("failed reading %s: %w", hdr.Name, err)
+			}
+			st.Link = string(target)
+		case ModeBlock, ModeChar:
+			st.Rdev = fmt.Sprintf("%d:%d", hdr.RDevMajor, hdr.RDevMinor)
+		}
+
+		states[cleanName(hdr.Name)] = st
+	}
+
+	for _, group := range links {
+		var data *FileState
+		for _, st := range group {
+			if st.Size != 0 {
+				data = st
+			}
+		}
+		if data == nil {
+			continue
+		}
+		for _, st := range group {
+			st.Size, st.SHA256 = data.Size, data.SHA256
+		}
+	}
+
+	return states, nil
+}
+
+// changedFields - return the ways in which a and b differ.
+func changedFields(a, b *FileState) []string {
+	fields := []string{}
+	if a.Mode&ModeTypeMask != b.Mode&ModeTypeMask {
+		return append(fields, "type")
+	}
+	if a.Mode&ModePermMask != b.Mode&ModePermMask {
+		fields = append(fields, "mode")
+	}
+	if a.UID != b.UID || a.GID != b.GID {
+		fields = append(fields, "owner")
+	}
+	if a.Size != b.Size {
+		fields = append(fields, "size")
+	}
+	if a.SHA256 != b.SHA256 {
+		fields = append(fields, "content")
+	}
+	if a.Link != b.Link {
+		fields = append(fields, "link")
+	}
+	if a.Rdev != b.Rdev {
+		fields = append(fields, "rdev")
+	}
+	return fields
+}
+
+// DiffStates - return the changes from 'from' to 'to', sorted by path.
+// Modification times and the segment holding a path are not compared.
+func DiffStates(from, to map[string]*FileState) []Change {
+	changes := []Change{}
+	for name, a := range from {
+		b, ok := to[name]
+		if !ok {
+			changes = append(changes, Change{Path: name, Type: Removed, Old: a})
+			continue
+		}
+		if fields := changedFields(a, b); len(fields) != 0 {
+			changes = append(changes, Change{Path: name, Type: Modified, Old: a, New: b, Fields: fields})
+		}
+	}
+	for name, b := range to {
+		if _, ok := from[name]; !ok {
+			changes = append(changes, Change{Path: name, Type: Added, New: b})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// Diff - return the changes in the unpacked content from the initramfs
+// in 'from' to that in 'to'.
+func Diff(from, to *SegmentReader) ([]Change, error) {
+	a, err := ReadFileStates(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ReadFileStates(to)
+	if err != nil {
+		return nil, err
+	}
+	return DiffStates(a, b), nil
+}
@@ -0,0 +1,82 @@
+package initrd
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	var a bytes.Buffer
+	compressTestArchive(t, &a, Identity, []testEntry{
+		{Header{Name: "kernel", Mode: ModeDir | 0755, Nlink: 2}, ""},
+	})
+	compressTestArchive(t, &a, Gzip, []testEntry{
+		{Header{Name: "etc", Mode: ModeDir | 0755, Nlink: 2}, ""},
+		{Header{Name: "etc/hostname", Mode: ModeRegular | 0644, Nlink: 1}, "old\n"},
+		{Header{Name: "etc/motd", Mode: ModeRegular | 0644, Nlink: 1}, "hello\n"},
+		{Header{Name: "etc/gone", Mode: ModeRegular | 0644, Nlink: 1}, "x"},
+		{Header{Ino: 7, Name: "bin/a", Mode: ModeRegular | 0755, Nlink: 2}, "box"},
+		{Header{Ino: 7, Name: "bin/b", Mode: ModeRegular | 0755, Nlink: 2}, ""},
+		{Header{Name: "bin/sh", Mode: ModeSymlink | 0777, Nlink: 1}, "a"},
+	})
+
+	var b bytes.Buffer
+	compressTestArchive(t, &b, Zstd, []testEntry{
+		{Header{Name: "./kernel", Mode: ModeDir | 0755, Nlink: 2, Mtime: 5}, ""},
+		{Header{Name: "etc", Mode: ModeDir | 0700, Nlink: 2}, ""},
+		{Header{Name: "etc/hostname", Mode: ModeRegular | 0644, Nlink: 1}, "new\n"},
+		{Header{Name: "etc/motd", Mode: ModeRegular | 0644, Nlink: 1, UID: 1}, "hello!\n"},
+		{Header{Name: "etc/added", Mode: ModeRegular | 0644, Nlink: 1}, "y"},
+		// GNU cpio puts hard link data on the last link.
+		{Header{Ino: 3, Name: "bin/a", Mode: ModeRegular | 0755, Nlink: 2}, ""},
+		{Header{Ino: 3, Name: "bin/b", Mode: ModeRegular | 0755, Nlink: 2}, "box"},
+		{Header{Name: "bin/sh", Mode: ModeRegular | 0755, Nlink: 1}, "a"},
+	})
+
+	changes, err := Diff(NewSegmentReader(&a), NewSegmentReader(&b))
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+
+	expected := []struct {
+		path   string
+		typ    ChangeType
+		fields []string
+	}{
+		{"bin/sh", Modified, []string{"type"}},
+		{"etc", Modified, []string{"mode"}},
+		{"etc/added", Added, nil},
+		{"etc/gone", Removed, nil},
+		{"etc/hostname", Modified, []string{"content"}},
+		{"etc/motd", Modified, []string{"owner", "size", "content"}},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("found %d changes, expected %d: %+v", len(changes), len(expected), changes)
+	}
+	for i, e := range expected {
+		c := changes[i]
+		if c.Path != e.path || c.Type != e.typ || !reflect.DeepEqual(c.Fields, e.fields) {
+			t.Errorf("change %d: found %s %s %v, expected %s %s %v",
+				i, c.Type, c.Path, c.Fields, e.typ, e.path, e.fields)
+		}
+	}
+}
+
+func TestReadFileStatesArchives(t *testing.T) {
+	var b bytes.Buffer
+	compressTestArchives(t, &b, Gzip, []testEntry{
+		{Header{Ino: 7, Name: "x", Mode: ModeRegular | 0644, Nlink: 2}, "XXXX"},
+	}, []testEntry{
+		{Header{Ino: 7, Name: "q", Mode: ModeRegular | 0644, Nlink: 2}, ""},
+	})
+
+	states, err := ReadFileStates(NewSegmentReader(&b))
+	if err != nil {
+		t.Fatalf("ReadFileStates: %v", err)
+	}
+	if states["x"].Size != 4 || states["q"].Size != 0 {
+		t.Errorf("x and q from different archives were taken as hard links: sizes %d, %d",
+			states["x"].Size, states["q"].Size)
+	}
+}
@@ -0,0 +1,202 @@
+package initrd
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// DirOptions - control the archive created from a directory.
+type DirOptions struct {
+	// UID and GID - owner of every entry.  The default is root, like
+	// 'cpio --owner=+0:+0'.
+	UID uint32
+	GID uint32
+	// KeepOwner - use the owner of each file rather than UID and GID.
+	KeepOwner bool
+	// Mtime - if not nil, the mtime of every entry.
+	Mtime *uint32
+}
+
+// DirOptionsFromEnv - return DirOptions with Mtime set from
+// SOURCE_DATE_EPOCH if it is set.
+// See https://reproducible-builds.org/specs/source-date-epoch/
+func DirOptionsFromEnv() (DirOptions, error) {
+	opts := DirOptions{}
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return opts, nil
+	}
+	mtime, err := strconv.ParseUint(epoch, 10, 32)
+	if err != nil {
+		return opts, fmt.Errorf("bad SOURCE_DATE_EPOCH '%s': %v", epoch, err)
+	}
+	m := uint32(mtime)
+	opts.Mtime = &m
+	return opts, nil
+}
+
+// treeWriter - add files from the filesystem to an archive.
+type treeWriter struct {
+	aw      *ArchiveWriter
+	opts    DirOptions
+	inodes  map[devIno]uint32
+	lastIno uint32
+}
+
+type devIno struct {
+	dev, ino uint64
+}
+
+func newTreeWriter(aw *ArchiveWriter, opts DirOptions) *treeWriter {
+	return &treeWriter{aw: aw, opts: opts, inodes: map[devIno]uint32{}}
+}
+
+// nextIno - return a new inode number.
+func (t *treeWriter) nextIno() uint32 {
+	t.lastIno++
+	return t.lastIno
+}
+
+// add - write an entry named name for the file at path described by info.
+func (t *treeWriter) add(path, name string, info fs.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("%s: could not get stat info", path)
+	}
+
+	hdr := &Header{
+		Mode:  uint32(st.Mode) & ModePermMask,
+		UID:   t.opts.UID,
+		GID:   t.opts.GID,
+		Nlink: uint32(st.Nlink),
+		Mtime: uint32(info.ModTime().Unix()),
+		Name:  name,
+	}
+	if t.opts.KeepOwner {
+		hdr.UID, hdr.GID = st.Uid, st.Gid
+	}
+	if t.opts.Mtime != nil {
+		hdr.Mtime = *t.opts.Mtime
+	}
+
+	key := devIno{uint64(st.Dev), uint64(st.Ino)}
+	ino, linked := t.inodes[key]
+	if !linked || info.IsDir() {
+		ino = t.nextIno()
+		t.inodes[key] = ino
+	}
+	hdr.Ino = ino
+
+	aw := t.aw
+	switch info.Mode().Type() {
+	case 0:
+		hdr.Mode |= ModeRegular
+		if linked {
+			return aw.WriteHeader(hdr)
+		}
+		hdr.FileSize = uint32(info.Size())
+		fp, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		if err := aw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(aw, fp); err != nil {
+			return fmt.Errorf("failed copying %s: %w", path, err)
+		}
+		return nil
+	case fs.ModeDir:
+		hdr.Mode |= ModeDir
+	case fs.ModeSymlink:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		hdr.Mode |= ModeSymlink
+		hdr.FileSize = uint32(len(target))
+		if err := aw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.WriteString(aw, target)
+		return err
+	case fs.ModeDevice:
+		hdr.Mode |= ModeBlock
+		hdr.RDevMajor = unix.Major(uint64(st.Rdev))
+		hdr.RDevMinor = unix.Minor(uint64(st.Rdev))
+	case fs.ModeDevice | fs.ModeCharDevice:
+		hdr.Mode |= ModeChar
+		hdr.RDevMajor = unix.Major(uint64(st.Rdev))
+		hdr.RDevMinor = unix.Minor(uint64(st.Rdev))
+	case fs.ModeNamedPipe:
+		hdr.Mode |= ModeFifo
+	case fs.ModeSocket:
+		hdr.Mode |= ModeSocket
+	default:
+		return fmt.Errorf("%s: unsupported file type %s", path, info.Mode().Type())
+	}
+
+	return aw.WriteHeader(hdr)
+}
+
+// addDir - write entries for the content of dir with names under prefix.
+func (t *treeWriter) addDir(dir, prefix string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if prefix != "" {
+			name = prefix + "/" + name
+		}
+		return t.add(path, name, info)
+	})
+}
+
+// WriteDir - add the content of dir to aw.  Paths in the archive are
+// relative to dir, which itself is not included.
+//
+// Entries are written in sorted order with each directory before its
+// content, and inode numbers are assigned in that order so the same
+// tree always produces the same archive.  Hard links are preserved;
+// the data is stored with the first link.
+func WriteDir(aw *ArchiveWriter, dir string, opts DirOptions) error {
+	return newTreeWriter(aw, opts).addDir(dir, "")
+}
+
+// NewCpioDirReader - return a CpioReader of an archive of the content
+// of the directory at path.
+func NewCpioDirReader(path string, opts DirOptions) (*ArchiveFuncReader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", path)
+	}
+	return NewArchiveFuncReader(path, func(aw *ArchiveWriter) error {
+		return WriteDir(aw, path, opts)
+	}), nil
+}
@@ -0,0 +1,143 @@
+package initrd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func makeTestTree(t *testing.T, dir string, mtime time.Time) {
+	t.Helper()
+	for _, d := range []string{"etc", "usr/bin", "usr/lib"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"etc/hostname":   "bootkit\n",
+		"usr/bin/zot":    "zot binary",
+		"usr/lib/libc.a": "libc",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(dir, "usr/bin/zot"), filepath.Join(dir, "usr/bin/zot2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("usr/bin", filepath.Join(dir, "bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mkfifo(filepath.Join(dir, "etc/fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink != 0 {
+			return err
+		}
+		return os.Chtimes(path, mtime, mtime)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteDir(t *testing.T) {
+	dir := t.TempDir()
+	makeTestTree(t, dir, time.Now())
+
+	epoch := uint32(1700000000)
+	var b bytes.Buffer
+	aw := NewArchiveWriter(&b)
+	if err := WriteDir(aw, dir, DirOptions{UID: 10, GID: 20, Mtime: &epoch}); err != nil {
+		t.Fatalf("WriteDir failed: %v", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	found := readTestArchive(t, &b)
+	names := []string{}
+	byName := map[string]testEntry{}
+	for _, e := range found {
+		names = append(names, e.hdr.Name)
+		byName[e.hdr.Name] = e
+		if e.hdr.UID != 10 || e.hdr.GID != 20 {
+			t.Errorf("%s: owner was %d:%d, expected 10:20", e.hdr.Name, e.hdr.UID, e.hdr.GID)
+		}
+		if e.hdr.Mtime != epoch {
+			t.Errorf("%s: mtime was %d, expected %d", e.hdr.Name, e.hdr.Mtime, epoch)
+		}
+	}
+
+	expected := []string{"bin", "etc", "etc/fifo", "etc/hostname", "usr", "usr/bin",
+		"usr/bin/zot", "usr/bin/zot2", "usr/lib", "usr/lib/libc.a"}
+	if len(names) != len(expected) {
+		t.Fatalf("found %v, expected %v", names, expected)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("entry %d was %s, expected %s", i, names[i], expected[i])
+		}
+	}
+
+	if e := byName["bin"]; !e.hdr.IsSymlink() || e.data != "usr/bin" {
+		t.Errorf("bin: expected symlink to usr/bin, found mode %o data %q", e.hdr.Mode, e.data)
+	}
+	if e := byName["etc/fifo"]; e.hdr.Mode != ModeFifo|0600 {
+		t.Errorf("etc/fifo: mode was %o", e.hdr.Mode)
+	}
+
+	zot, zot2 := byName["usr/bin/zot"], byName["usr/bin/zot2"]
+	if zot.hdr.Ino != zot2.hdr.Ino || zot.hdr.Nlink != 2 {
+		t.Errorf("hardlink not preserved: ino %d/%d nlink %d", zot.hdr.Ino, zot2.hdr.Ino, zot.hdr.Nlink)
+	}
+	if zot.data != "zot binary" || zot2.data != "" {
+		t.Errorf("hardlink data expected with first link only: %q %q", zot.data, zot2.data)
+	}
+}
+
+func TestWriteDirReproducible(t *testing.T) {
+	epoch := uint32(1700000000)
+	archives := [][]byte{}
+	for i := 0; i < 2; i++ {
+		dir := t.TempDir()
+		makeTestTree(t, dir, time.Now().Add(time.Duration(i)*time.Hour))
+
+		var b bytes.Buffer
+		aw := NewArchiveWriter(&b)
+		if err := WriteDir(aw, dir, DirOptions{Mtime: &epoch}); err != nil {
+			t.Fatalf("WriteDir failed: %v", err)
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, b.Bytes())
+	}
+
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Errorf("archives of identical trees differed")
+	}
+}
+
+func TestDirOptionsFromEnv(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1234")
+	opts, err := DirOptionsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Mtime == nil || *opts.Mtime != 1234 {
+		t.Errorf("Mtime was not set from SOURCE_DATE_EPOCH")
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if _, err := DirOptionsFromEnv(); err == nil {
+		t.Errorf("expected error for bad SOURCE_DATE_EPOCH")
+	}
+}
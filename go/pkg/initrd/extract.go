@@ -0,0 +1,238 @@
+package initrd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// dirState - the mode and mtime that Finish sets on a directory.
+type dirState struct {
+	mode  os.FileMode
+	mtime time.Time
+}
+
+type linkKey struct {
+	archive int
+	ino     uint32
+}
+
+// Extractor - write archive entries into a directory.
+type Extractor struct {
+	Dir string
+	// Chown - set the owner of extracted entries from the archive.
+	Chown bool
+	// Skipped - device nodes that could not be created due to permissions.
+	Skipped []string
+
+	links map[linkKey]string
+	dirs  map[string]dirState
+}
+
+func NewExtractor(dir string) *Extractor {
+	return &Extractor{
+		Dir:   dir,
+		Chown: os.Geteuid() == 0,
+		links: map[linkKey]string{},
+		dirs:  map[string]dirState{},
+	}
+}
+
+// target - return the path in e.Dir for name, making sure that it
+// does not resolve outside of e.Dir through a symlink.
+func (e *Extractor) target(name string) (string, error) {
+	clean := cleanName(name)
+	if clean == "." {
+		return e.Dir, nil
+	}
+	dest := filepath.Join(e.Dir, filepath.FromSlash(clean))
+
+	root, err := filepath.EvalSymlinks(e.Dir)
+	if err != nil {
+		return "", err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(dest))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%s: parent directory does not exist", name)
+		}
+		return "", err
+	}
+	if parent != root && !strings.HasPrefix(parent, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: resolves outside of %s", name, e.Dir)
+	}
+	return filepath.Join(parent, filepath.Base(dest)), nil
+}
+
+// Extract - write the entry described by hdr with data from r.
+// archive identifies the archive the entry came from, so that hard
+// links are only resolved within a single archive.
+func (e *Extractor) Extract(archive int, hdr *Header, r io.Reader) error {
+	dest, err := e.target(hdr.Name)
+	if err != nil {
+		return err
+	}
+
+	if !hdr.IsDir() {
+		if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	perm := hdr.FileMode() &^ os.ModeType
+	rdev := int(unix.Mkdev(hdr.RDevMajor, hdr.RDevMinor))
+
+	switch hdr.Mode & ModeTypeMask {
+	case ModeDir:
+		if err := os.Mkdir(dest, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		// keep the directory writable until Finish, so that its
+		// content can be extracted whatever its mode.
+		e.dirs[dest] = dirState{mode: perm, mtime: time.Unix(int64(hdr.Mtime), 0)}
+		perm |= 0700
+	case ModeRegular:
+		key := linkKey{archive, hdr.Ino}
+		if hdr.Nlink > 1 {
+			if first, ok := e.links[key]; ok {
+				if err := os.Link(first, dest); err != nil {
+					return err
+				}
+				if hdr.FileSize == 0 {
+					return nil
+				}
+			} else {
+				e.links[key] = dest
+			}
+		}
+		fp, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(fp, r); err != nil {
+			fp.Close()
+			return fmt.Errorf("failed writing %s: %w", hdr.Name, err)
+		}
+		if err := fp.Close(); err != nil {
+			return err
+		}
+	case ModeSymlink:
+		target, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(string(target), dest); err != nil {
+			return err
+		}
+		if e.Chown {
+			return os.Lchown(dest, int(hdr.UID), int(hdr.GID))
+		}
+		return nil
+	case ModeBlock, ModeChar, ModeFifo, ModeSocket:
+		mode := uint32(syscall.S_IFIFO)
+		switch hdr.Mode & ModeTypeMask {
+		case ModeBlock:
+			mode = syscall.S_IFBLK
+		case ModeChar:
+			mode = syscall.S_IFCHR
+		case ModeSocket:
+			mode = syscall.S_IFSOCK
+		}
+		if err := unix.Mknod(dest, mode|0600, rdev); err != nil {
+			if errors.Is(err, os.ErrPermission) {
+				e.Skipped = append(e.Skipped, hdr.Name)
+				return nil
+			}
+			return fmt.Errorf("mknod %s: %w", hdr.Name, err)
+		}
+	default:
+		return fmt.Errorf("%s: unknown file type in mode %o", hdr.Name, hdr.Mode)
+	}
+
+	if e.Chown {
+		if err := os.Lchown(dest, int(hdr.UID), int(hdr.GID)); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(dest, perm); err != nil {
+		return err
+	}
+	if !hdr.IsDir() {
+		mtime := time.Unix(int64(hdr.Mtime), 0)
+		return os.Chtimes(dest, mtime, mtime)
+	}
+	return nil
+}
+
+// Finish - set the mode and mtime of extracted directories, which are
+// kept writable and whose mtime changes as content is added to them.
+// Directories are done deepest first, so that a parent is not made
+// read-only before its children are done.
+func (e *Extractor) Finish() error {
+	dirs := make([]string, 0, len(e.dirs))
+	for dir := range e.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], string(filepath.Separator)) > strings.Count(dirs[j], string(filepath.Separator))
+	})
+	for _, dir := range dirs {
+		st := e.dirs[dir]
+		if err := os.Chmod(dir, st.mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dir, st.mtime, st.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractAll - extract every entry read from s into dir.  If match
+// is not nil, only entries for which it returns true are extracted.
+func ExtractAll(s *SegmentReader, dir string, match func(Segment, *Header) bool) (*Extractor, error) {
+	e := NewExtractor(dir)
+	for {
+		hdr, err := s.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return e, err
+		}
+		if match != nil && !match(s.Segment(), hdr) {
+			continue
+		}
+		if err := e.Extract(s.Archive(), hdr, s); err != nil {
+			return e, err
+		}
+	}
+	return e, e.Finish()
+}
+
+// matchPath - return true if name is p, is under p or is a parent of p.
+func matchPath(name, p string) bool {
+	name, p = cleanName(name), cleanName(p)
+	return p == "." || name == "." || name == p ||
+		strings.HasPrefix(name, p+"/") || strings.HasPrefix(p, name+"/")
+}
+
+// PathMatcher - return a match function for ExtractAll that selects
+// entries at or under any of paths, and the directories leading to them.
+func PathMatcher(paths ...string) func(Segment, *Header) bool {
+	return func(_ Segment, hdr *Header) bool {
+		for _, p := range paths {
+			if matchPath(hdr.Name, p) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -1,10 +1,10 @@
 package initrd
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"os"
+	"path"
 )
 
 // - just join existing cpios (compressed or not)
@@ -19,6 +19,10 @@ const (
 	Undetermined Compression = iota
 	Identity
 	Gzip
+	Zstd
+	Xz
+	Lzma
+	Lz4Legacy
 )
 
 type CpioReader interface {
@@ -27,28 +31,180 @@ type CpioReader interface {
 	Compression() Compression
 }
 
+// DedupePolicy - which entry is kept when a path is present more than once.
+type DedupePolicy int
+
+const (
+	// LastWins - the content of the last entry for a path is used.
+	LastWins DedupePolicy = iota
+	// FirstWins - the content of the first entry for a path is used.
+	FirstWins
+)
+
+// Collision - a path that was present more than once.
+type Collision struct {
+	Name string
+	// Sources - index into the readers of each occurrence, in order.
+	Sources []int
+	// Winner - index into the readers of the occurrence that was kept.
+	Winner int
+}
+
+// dedupedEntry - an entry whose data is spooled at offset in the spool file.
+type dedupedEntry struct {
+	hdr    Header
+	source int
+	offset int64
+}
+
+// DedupedReader - a CpioReader that merges all of its readers into a
+// single archive in which each path is present only once.
+//
+// An entry kept from a later reader is written at the position of the
+// first occurrence of its path, and with that occurrence's name, so that
+// parent directories still come before their content.  Hard link inode
+// numbers are renumbered so that they cannot collide across readers.
 type DedupedReader struct {
-	readers []CpioReader
-	seen    map[string]bool
+	readers    []CpioReader
+	policy     DedupePolicy
+	comp       Compression
+	seen       map[string]int
+	entries    []*dedupedEntry
+	collisions []Collision
+	spool      *os.File
+	reader     io.ReadCloser
 }
 
 func (d *DedupedReader) Read(p []byte) (n int, err error) {
-	return 0, nil
+	if d.reader == nil {
+		d.comp = d.Compression()
+		if err := d.index(); err != nil {
+			return 0, err
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(d.write(pw))
+		}()
+		d.reader = pr
+	}
+	return d.reader.Read(p)
 }
 
-func (d *DedupedReader) SetCompression(comp Compression) error {
-	for _, r := range d.readers {
-		if err := r.SetCompression(comp); err != nil {
+// index - read every reader, spooling entry data to a temp file and
+// recording which entry is kept for each path.
+func (d *DedupedReader) index() error {
+	spool, err := os.CreateTemp("", "initrd-dedupe-")
+	if err != nil {
+		return err
+	}
+	os.Remove(spool.Name())
+	d.spool = spool
+
+	type inoKey struct {
+		source int
+		ino    uint32
+	}
+	inodes := map[inoKey]uint32{}
+	occurrences := map[string][]int{}
+	offset := int64(0)
+
+	for i, r := range d.readers {
+		if err := r.SetCompression(Identity); err != nil {
+			return err
+		}
+		ar := NewArchiveReader(r)
+		for {
+			hdr, err := ar.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed reading cpio %d: %w", i, err)
+			}
+
+			n, err := io.Copy(spool, ar)
+			if err != nil {
+				return fmt.Errorf("failed reading %s in cpio %d: %w", hdr.Name, i, err)
+			}
+
+			key := inoKey{i, hdr.Ino}
+			if _, ok := inodes[key]; !ok {
+				inodes[key] = uint32(len(inodes) + 1)
+			}
+			hdr.Ino = inodes[key]
+
+			entry := &dedupedEntry{hdr: *hdr, source: i, offset: offset}
+			offset += n
+
+			name := cleanName(hdr.Name)
+			occurrences[name] = append(occurrences[name], i)
+			if idx, ok := d.seen[name]; !ok {
+				d.seen[name] = len(d.entries)
+				d.entries = append(d.entries, entry)
+			} else if d.policy == LastWins {
+				entry.hdr.Name = d.entries[idx].hdr.Name
+				d.entries[idx] = entry
+			}
+		}
+	}
+
+	for _, entry := range d.entries {
+		name := cleanName(entry.hdr.Name)
+		sources := occurrences[name]
+		if len(sources) < 2 || entry.hdr.IsDir() {
+			continue
+		}
+		d.collisions = append(d.collisions,
+			Collision{Name: name, Sources: sources, Winner: entry.source})
+	}
+
+	return nil
+}
+
+func (d *DedupedReader) write(w io.Writer) error {
+	enc, err := NewCompressor(w, d.Compression())
+	if err != nil {
+		return err
+	}
+
+	aw := NewArchiveWriter(enc)
+	for _, entry := range d.entries {
+		if err := aw.WriteHeader(&entry.hdr); err != nil {
 			return err
 		}
+		data := io.NewSectionReader(d.spool, entry.offset, int64(entry.hdr.FileSize))
+		if _, err := io.Copy(aw, data); err != nil {
+			return fmt.Errorf("failed writing %s: %w", entry.hdr.Name, err)
+		}
+	}
+
+	if err := aw.Close(); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Collisions - the non-directory paths that were present more than once.
+// It is populated once reading has started.
+func (d *DedupedReader) Collisions() []Collision {
+	return d.collisions
+}
+
+func (d *DedupedReader) SetCompression(comp Compression) error {
+	if d.reader != nil {
+		return fmt.Errorf("cannot change compression after reading")
 	}
+	d.comp = comp
 	return nil
 }
 
 // Compression - return the compression for this reader
+//   if one was set with SetCompression, that is used.
 //   if all of the readers are the same, it can return that compression
 //   otherwise it has to return identity.
 func (d *DedupedReader) Compression() Compression {
+	if d.comp != Undetermined {
+		return d.comp
+	}
 	var cur, last Compression
 	for i, r := range d.readers {
 		cur = r.Compression()
@@ -60,40 +216,229 @@ func (d *DedupedReader) Compression() Compression {
 		}
 		last = cur
 	}
+	if last == Undetermined {
+		return Identity
+	}
 	return last
 }
 
-func NewDedupedReader(readers []CpioReader) (*DedupedReader, error) {
-	r := &DedupedReader{readers: readers}
+func (d *DedupedReader) Close() error {
+	if d.reader != nil {
+		d.reader.Close()
+	}
+	if d.spool != nil {
+		return d.spool.Close()
+	}
+	return nil
+}
+
+func NewDedupedReader(readers []CpioReader, policy DedupePolicy) (*DedupedReader, error) {
+	r := &DedupedReader{readers: readers, policy: policy, seen: map[string]int{}}
 	return r, nil
 }
 
+// cleanName - normalize an archive path so that './etc/x' and 'etc/x'
+// are treated as the same path.
+func cleanName(name string) string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "."
+	}
+	return name[1:]
+}
+
 type CpioFileReader struct {
-	path   string
-	reader io.Reader
-	comp   Compression
-	unused bytes.Buffer
+	path     string
+	fp       *os.File
+	reader   io.Reader
+	comp     Compression
+	fileComp Compression
 }
 
+// Read - read the cpio content of the file, compressed with Compression().
 func (r *CpioFileReader) Read(p []byte) (int, error) {
-	return 0, fmt.Errorf("implement me please")
+	if r.reader == nil {
+		if r.comp == r.fileComp {
+			r.reader = r.fp
+		} else {
+			rc, err := recompress(r.fp, r.fileComp, r.comp)
+			if err != nil {
+				return 0, err
+			}
+			r.reader = rc
+		}
+	}
+	return r.reader.Read(p)
 }
 
+// SetCompression - set the compression of data returned by Read.
+// It must be called before the first Read.
 func (r *CpioFileReader) SetCompression(comp Compression) error {
+	if r.reader != nil {
+		return fmt.Errorf("cannot change compression of %s after reading", r.path)
+	}
+	if comp == Undetermined {
+		comp = r.fileComp
+	}
 	r.comp = comp
-	return fmt.Errorf("Implement me please")
+	return nil
 }
 
 func (r *CpioFileReader) Compression() Compression {
 	return r.comp
 }
 
+// FileCompression - the compression of the file on disk.
+func (r *CpioFileReader) FileCompression() Compression {
+	return r.fileComp
+}
+
+// Uncompressed - return a reader of the uncompressed file content,
+// suitable for NewArchiveReader.  It reads independently of Read.
+func (r *CpioFileReader) Uncompressed() (io.ReadCloser, error) {
+	fp, err := os.Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := NewDecompressor(fp, r.fileComp)
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("failed to decompress %s: %w", r.path, err)
+	}
+	return readCloser{dec, multiCloser{dec, fp}}, nil
+}
+
+// Segments - return a SegmentReader of the file content.  It reads
+// independently of Read.
+func (r *CpioFileReader) Segments() (*SegmentReader, error) {
+	return OpenSegmentReader(r.path)
+}
+
+func (r *CpioFileReader) Close() error {
+	if rc, ok := r.reader.(io.Closer); ok && r.reader != io.Reader(r.fp) {
+		rc.Close()
+	}
+	return r.fp.Close()
+}
+
 func NewCpioFileReader(path string) (*CpioFileReader, error) {
-	r := &CpioFileReader{path: path}
 	fp, err := os.Open(path)
 	if err != nil {
-		return r, nil
+		return nil, err
 	}
-	r.reader = fp
-	return r, nil
+
+	buf := make([]byte, compressionMagicLen)
+	n, err := io.ReadFull(fp, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		fp.Close()
+		return nil, err
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	comp := DetectCompression(buf[:n])
+	return &CpioFileReader{path: path, fp: fp, comp: comp, fileComp: comp}, nil
+}
+
+// ArchiveFuncReader - a CpioReader of an archive whose entries are
+// written by a function.
+type ArchiveFuncReader struct {
+	name   string
+	write  func(*ArchiveWriter) error
+	reader io.ReadCloser
+	comp   Compression
+}
+
+func (r *ArchiveFuncReader) Read(p []byte) (int, error) {
+	if r.reader == nil {
+		pr, pw := io.Pipe()
+		go func() {
+			enc, err := NewCompressor(pw, r.comp)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			aw := NewArchiveWriter(enc)
+			if err = r.write(aw); err == nil {
+				if err = aw.Close(); err == nil {
+					err = enc.Close()
+				}
+			}
+			pw.CloseWithError(err)
+		}()
+		r.reader = pr
+	}
+	return r.reader.Read(p)
+}
+
+func (r *ArchiveFuncReader) SetCompression(comp Compression) error {
+	if r.reader != nil {
+		return fmt.Errorf("cannot change compression of %s after reading", r.name)
+	}
+	if comp == Undetermined {
+		comp = Identity
+	}
+	r.comp = comp
+	return nil
+}
+
+func (r *ArchiveFuncReader) Compression() Compression {
+	return r.comp
+}
+
+func (r *ArchiveFuncReader) Close() error {
+	if r.reader == nil {
+		return nil
+	}
+	return r.reader.Close()
+}
+
+// NewArchiveFuncReader - return a reader of the archive that write
+// creates.  The trailer is added after write returns.  name is used
+// in error messages.
+func NewArchiveFuncReader(name string, write func(*ArchiveWriter) error) *ArchiveFuncReader {
+	return &ArchiveFuncReader{name: name, write: write, comp: Identity}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// recompress - return a reader of r's content converted from compression
+// 'from' to compression 'to'.
+func recompress(r io.Reader, from, to Compression) (io.ReadCloser, error) {
+	dec, err := NewDecompressor(r, from)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer dec.Close()
+		enc, err := NewCompressor(pw, to)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err = io.Copy(enc, dec); err == nil {
+			err = enc.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
 }
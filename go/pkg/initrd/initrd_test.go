@@ -0,0 +1,120 @@
+package initrd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path string, entries []testEntry) {
+	t.Helper()
+	var b bytes.Buffer
+	writeTestArchive(t, &b, entries)
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDedupedReader(t *testing.T) {
+	tmpd := t.TempDir()
+	first := filepath.Join(tmpd, "first.cpio")
+	second := filepath.Join(tmpd, "second.cpio")
+
+	writeTestFile(t, first, []testEntry{
+		{Header{Name: "etc", Mode: ModeDir | 0755, Nlink: 2}, ""},
+		{Header{Name: "etc/hostname", Mode: ModeRegular | 0644, Nlink: 1}, "first\n"},
+		{Header{Name: "lib/libc.so", Mode: ModeRegular | 0755, Nlink: 1}, "libc1"},
+	})
+	writeTestFile(t, second, []testEntry{
+		{Header{Name: "etc", Mode: ModeDir | 0755, Nlink: 2}, ""},
+		{Header{Name: "./etc/hostname", Mode: ModeRegular | 0600, Nlink: 1}, "second\n"},
+		{Header{Name: "etc/other", Mode: ModeRegular | 0644, Nlink: 1}, "other"},
+	})
+
+	for _, tc := range []struct {
+		policy   DedupePolicy
+		hostname string
+		winner   int
+	}{
+		{LastWins, "second\n", 1},
+		{FirstWins, "first\n", 0},
+	} {
+		readers := []CpioReader{}
+		for _, p := range []string{first, second} {
+			r, err := NewCpioFileReader(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			readers = append(readers, r)
+		}
+
+		d, err := NewDedupedReader(readers, tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		found := readTestArchive(t, d)
+		names := []string{}
+		for _, e := range found {
+			names = append(names, e.hdr.Name)
+		}
+		expected := []string{"etc", "etc/hostname", "lib/libc.so", "etc/other"}
+		if len(names) != len(expected) {
+			t.Fatalf("policy %d: found %v, expected %v", tc.policy, names, expected)
+		}
+		for i := range expected {
+			if names[i] != expected[i] {
+				t.Errorf("policy %d: entry %d was %s, expected %s", tc.policy, i, names[i], expected[i])
+			}
+		}
+
+		if found[1].data != tc.hostname {
+			t.Errorf("policy %d: hostname was %q, expected %q", tc.policy, found[1].data, tc.hostname)
+		}
+
+		collisions := d.Collisions()
+		if len(collisions) != 1 {
+			t.Fatalf("policy %d: found %d collisions, expected 1: %v", tc.policy, len(collisions), collisions)
+		}
+		if c := collisions[0]; c.Name != "etc/hostname" || c.Winner != tc.winner || len(c.Sources) != 2 {
+			t.Errorf("policy %d: unexpected collision %+v", tc.policy, c)
+		}
+	}
+}
+
+func TestDedupedReaderInodes(t *testing.T) {
+	tmpd := t.TempDir()
+	paths := []string{filepath.Join(tmpd, "a.cpio"), filepath.Join(tmpd, "b.cpio")}
+	writeTestFile(t, paths[0], []testEntry{
+		{Header{Name: "a", Ino: 7, Mode: ModeRegular | 0644, Nlink: 1}, "a"},
+	})
+	writeTestFile(t, paths[1], []testEntry{
+		{Header{Name: "b", Ino: 7, Mode: ModeRegular | 0644, Nlink: 1}, "b"},
+	})
+
+	readers := []CpioReader{}
+	for _, p := range paths {
+		r, err := NewCpioFileReader(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		readers = append(readers, r)
+	}
+	d, err := NewDedupedReader(readers, LastWins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	found := readTestArchive(t, d)
+	if len(found) != 2 {
+		t.Fatalf("found %d entries, expected 2", len(found))
+	}
+	if found[0].hdr.Ino == found[1].hdr.Ino {
+		t.Errorf("inode %d was not renumbered", found[0].hdr.Ino)
+	}
+}
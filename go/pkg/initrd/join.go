@@ -0,0 +1,39 @@
+package initrd
+
+import (
+	"fmt"
+	"io"
+)
+
+// Join - write an initramfs made of the provided cpios to w.
+//
+// If microcode is non-nil it is written first and uncompressed, as
+// the kernel requires for early microcode.  The content of each of
+// readers is then written in order, with their combined content
+// compressed with comp.
+func Join(w io.Writer, microcode CpioReader, comp Compression, readers ...CpioReader) error {
+	if microcode != nil {
+		if err := microcode.SetCompression(Identity); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, microcode); err != nil {
+			return fmt.Errorf("failed writing microcode: %w", err)
+		}
+	}
+
+	enc, err := NewCompressor(w, comp)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range readers {
+		if err := r.SetCompression(Identity); err != nil {
+			return err
+		}
+		if _, err := io.Copy(enc, r); err != nil {
+			return fmt.Errorf("failed writing cpio %d: %w", i, err)
+		}
+	}
+
+	return enc.Close()
+}
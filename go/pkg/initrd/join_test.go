@@ -0,0 +1,85 @@
+package initrd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJoin(t *testing.T) {
+	tmpd := t.TempDir()
+
+	var mc bytes.Buffer
+	writeTestArchive(t, &mc, testEntries[:1])
+	mcPath := filepath.Join(tmpd, "microcode.cpio")
+	if err := os.WriteFile(mcPath, mc.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var core bytes.Buffer
+	zw := gzip.NewWriter(&core)
+	writeTestArchive(t, zw, testEntries[1:3])
+	zw.Close()
+	corePath := filepath.Join(tmpd, "core.cpio.gz")
+	if err := os.WriteFile(corePath, core.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	extra := filepath.Join(tmpd, "extra")
+	if err := os.MkdirAll(filepath.Join(extra, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(extra, "etc", "extra"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mcr, err := NewCpioFileReader(mcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mcr.Close()
+	cr, err := NewCpioFileReader(corePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	dr, err := NewCpioDirReader(extra, DirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dr.Close()
+
+	var out bytes.Buffer
+	if err := Join(&out, mcr, Gzip, cr, dr); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+
+	if !bytes.HasPrefix(out.Bytes(), mc.Bytes()) {
+		t.Fatalf("output did not start with uncompressed microcode")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(out.Bytes()[mc.Len():]))
+	if err != nil {
+		t.Fatalf("tail was not gzip: %v", err)
+	}
+
+	found := readTestArchive(t, zr)
+	names := []string{}
+	for _, e := range found {
+		names = append(names, e.hdr.Name)
+	}
+	expected := []string{"etc/hostname", "etc/odd", "etc", "etc/extra"}
+	if len(names) != len(expected) {
+		t.Fatalf("found entries %v, expected %v", names, expected)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("entry %d: found %s, expected %s", i, names[i], expected[i])
+		}
+	}
+	if found[3].data != "data" {
+		t.Errorf("etc/extra had content %q", found[3].data)
+	}
+}
@@ -0,0 +1,185 @@
+package initrd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Paths that the kernel loads early microcode from.  See
+// https://docs.kernel.org/arch/x86/microcode.html
+const (
+	IntelMicrocodePath = "kernel/x86/microcode/GenuineIntel.bin"
+	AMDMicrocodePath   = "kernel/x86/microcode/AuthenticAMD.bin"
+)
+
+const (
+	intelHeaderSize      = 48
+	intelDefaultDataSize = 2000
+	amdContainerMagic    = 0x00414d44
+)
+
+// checkIntelMicrocode - verify that buf is a series of intel microcode
+// updates with valid checksums.
+func checkIntelMicrocode(buf []byte) error {
+	for off := 0; off < len(buf); {
+		if len(buf)-off < intelHeaderSize {
+			return fmt.Errorf("short update header at offset %d", off)
+		}
+		hdr := buf[off:]
+		if v := binary.LittleEndian.Uint32(hdr[0:]); v != 1 {
+			return fmt.Errorf("unsupported header version %d at offset %d", v, off)
+		}
+		dataSize := int(binary.LittleEndian.Uint32(hdr[28:]))
+		totalSize := int(binary.LittleEndian.Uint32(hdr[32:]))
+		if dataSize == 0 {
+			dataSize = intelDefaultDataSize
+		}
+		if totalSize == 0 {
+			totalSize = dataSize + intelHeaderSize
+		}
+		if totalSize < dataSize+intelHeaderSize || totalSize%4 != 0 || totalSize > len(buf)-off {
+			return fmt.Errorf("bad total size %d in update at offset %d", totalSize, off)
+		}
+
+		sum := uint32(0)
+		for i := 0; i < dataSize+intelHeaderSize; i += 4 {
+			sum += binary.LittleEndian.Uint32(hdr[i:])
+		}
+		if sum != 0 {
+			return fmt.Errorf("bad checksum in update at offset %d", off)
+		}
+		off += totalSize
+	}
+	return nil
+}
+
+func checkAMDMicrocode(buf []byte) error {
+	if len(buf) < 4 || binary.LittleEndian.Uint32(buf) != amdContainerMagic {
+		return fmt.Errorf("missing container magic")
+	}
+	return nil
+}
+
+// readMicrocode - return the concatenated content of files, checked
+// with check, and the newest mtime of them.
+func readMicrocode(files []string, check func([]byte) error) ([]byte, uint32, error) {
+	var b bytes.Buffer
+	mtime := uint32(0)
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := check(content); err != nil {
+			return nil, 0, fmt.Errorf("%s: %v", f, err)
+		}
+		b.Write(content)
+		if m := uint32(info.ModTime().Unix()); m > mtime {
+			mtime = m
+		}
+	}
+	return b.Bytes(), mtime, nil
+}
+
+// WriteMicrocode - add early microcode to aw from the vendor microcode
+// files in dir, as laid out in linux-firmware.  All of dir/intel-ucode/*
+// are concatenated into GenuineIntel.bin and all of dir/amd-ucode/*.bin
+// into AuthenticAMD.bin.
+//
+// The archive written must be the first in the initramfs and must not
+// be compressed.
+func WriteMicrocode(aw *ArchiveWriter, dir string, opts DirOptions) error {
+	blobs := []struct {
+		name  string
+		glob  string
+		check func([]byte) error
+	}{
+		{AMDMicrocodePath, "amd-ucode/*.bin", checkAMDMicrocode},
+		{IntelMicrocodePath, "intel-ucode/*", checkIntelMicrocode},
+	}
+
+	type entry struct {
+		name  string
+		data  []byte
+		mtime uint32
+	}
+	entries := []entry{}
+	newest := uint32(0)
+	for _, blob := range blobs {
+		files, err := filepath.Glob(filepath.Join(dir, blob.glob))
+		if err != nil {
+			return err
+		}
+		sort.Strings(files)
+		data, mtime, err := readMicrocode(files, blob.check)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		entries = append(entries, entry{blob.name, data, mtime})
+		if mtime > newest {
+			newest = mtime
+		}
+	}
+
+	if len(entries) == 0 {
+		return fmt.Errorf("no microcode found in %s/intel-ucode or %s/amd-ucode", dir, dir)
+	}
+
+	mtime := func(m uint32) uint32 {
+		if opts.Mtime != nil {
+			return *opts.Mtime
+		}
+		return m
+	}
+
+	ino := uint32(0)
+	for _, d := range []string{"kernel", "kernel/x86", "kernel/x86/microcode"} {
+		ino++
+		hdr := &Header{Ino: ino, Mode: ModeDir | 0755, UID: opts.UID, GID: opts.GID,
+			Nlink: 2, Mtime: mtime(newest), Name: d}
+		if err := aw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		ino++
+		hdr := &Header{Ino: ino, Mode: ModeRegular | 0644, UID: opts.UID, GID: opts.GID,
+			Nlink: 1, Mtime: mtime(e.mtime), FileSize: uint32(len(e.data)), Name: e.name}
+		if err := aw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := aw.Write(e.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewMicrocodeReader - return a CpioReader of the early microcode
+// archive for the vendor microcode files in dir.  See WriteMicrocode.
+func NewMicrocodeReader(dir string, opts DirOptions) (*ArchiveFuncReader, error) {
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", dir)
+	}
+	return NewArchiveFuncReader(dir, func(aw *ArchiveWriter) error {
+		return WriteMicrocode(aw, dir, opts)
+	}), nil
+}
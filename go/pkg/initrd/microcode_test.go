@@ -0,0 +1,102 @@
+package initrd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeIntelUpdate - return an intel microcode update with the default
+// 2000 byte data size and a valid checksum.
+func fakeIntelUpdate(rev uint32) []byte {
+	buf := make([]byte, intelHeaderSize+intelDefaultDataSize)
+	binary.LittleEndian.PutUint32(buf[0:], 1)
+	binary.LittleEndian.PutUint32(buf[4:], rev)
+	for i := intelHeaderSize; i < len(buf); i++ {
+		buf[i] = byte(i)
+	}
+	sum := uint32(0)
+	for i := 0; i < len(buf); i += 4 {
+		sum += binary.LittleEndian.Uint32(buf[i:])
+	}
+	binary.LittleEndian.PutUint32(buf[16:], -sum)
+	return buf
+}
+
+func writeMicrocodeFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWriteMicrocode(t *testing.T) {
+	dir := t.TempDir()
+	amd := append([]byte{'D', 'M', 'A', 0}, []byte("amd container")...)
+	intel1, intel2 := fakeIntelUpdate(1), fakeIntelUpdate(2)
+	writeMicrocodeFiles(t, dir, map[string][]byte{
+		"intel-ucode/06-55-04":               intel2,
+		"intel-ucode/06-3f-02":               intel1,
+		"amd-ucode/microcode_amd_fam17h.bin": amd,
+		"amd-ucode/README":                   []byte("not microcode"),
+	})
+
+	epoch := uint32(100)
+	var b bytes.Buffer
+	aw := NewArchiveWriter(&b)
+	if err := WriteMicrocode(aw, dir, DirOptions{Mtime: &epoch}); err != nil {
+		t.Fatalf("WriteMicrocode failed: %v", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	found := readTestArchive(t, &b)
+	expected := []testEntry{
+		{Header{Name: "kernel"}, ""},
+		{Header{Name: "kernel/x86"}, ""},
+		{Header{Name: "kernel/x86/microcode"}, ""},
+		{Header{Name: AMDMicrocodePath}, string(amd)},
+		{Header{Name: IntelMicrocodePath}, string(intel1) + string(intel2)},
+	}
+	if len(found) != len(expected) {
+		t.Fatalf("found %d entries, expected %d", len(found), len(expected))
+	}
+	for i, e := range expected {
+		if found[i].hdr.Name != e.hdr.Name {
+			t.Errorf("entry %d was %s, expected %s", i, found[i].hdr.Name, e.hdr.Name)
+		}
+		if found[i].data != e.data {
+			t.Errorf("entry %s had unexpected content", e.hdr.Name)
+		}
+		if found[i].hdr.Mtime != epoch {
+			t.Errorf("entry %s mtime was %d", e.hdr.Name, found[i].hdr.Mtime)
+		}
+	}
+}
+
+func TestWriteMicrocodeBad(t *testing.T) {
+	bad := fakeIntelUpdate(1)
+	bad[100]++
+
+	for name, files := range map[string]map[string][]byte{
+		"empty":     {"other/file": []byte("x")},
+		"checksum":  {"intel-ucode/06-3f-02": bad},
+		"truncated": {"intel-ucode/06-3f-02": fakeIntelUpdate(1)[:1024]},
+		"amd-magic": {"amd-ucode/microcode_amd.bin": []byte("not a container")},
+	} {
+		dir := t.TempDir()
+		writeMicrocodeFiles(t, dir, files)
+		if err := WriteMicrocode(NewArchiveWriter(&bytes.Buffer{}), dir, DirOptions{}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package initrd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// OverlayFile - a file or directory to add to an initramfs.
+type OverlayFile struct {
+	// Src - path of the file or directory on the filesystem.
+	Src string
+	// Dest - path in the initramfs.  If Src is a directory its content
+	// is added under Dest, which may be "/" to add it at the root.
+	Dest string
+}
+
+// overlayEntry - a single file to be written by Overlay.
+type overlayEntry struct {
+	path string
+	name string
+	info fs.FileInfo
+}
+
+// overlaySegment - what Overlay learned about a segment of the input.
+type overlaySegment struct {
+	Segment
+	// replaced - number of entries that are replaced by the overlay.
+	replaced int
+}
+
+// overlayLinks - hard links of the input that lose entries to the
+// overlay, keyed by archive and inode as inode numbers are only unique
+// within one archive.
+type overlayLinks struct {
+	// unlinked - the number of links of each inode being replaced.
+	unlinked map[linkKey]uint32
+	// moved - data held by a replaced link that must move to one of
+	// the remaining links, which all have none.
+	moved map[linkKey][]byte
+}
+
+// overlayEntries - return the entries to write for files, in order.
+func overlayEntries(files []OverlayFile) ([]overlayEntry, error) {
+	entries := []overlayEntry{}
+	for _, f := range files {
+		info, err := os.Lstat(f.Src)
+		if err != nil {
+			return nil, err
+		}
+		dest := cleanName(f.Dest)
+		if !info.IsDir() {
+			if dest == "." {
+				return nil, fmt.Errorf("%s: destination of a file cannot be the root", f.Src)
+			}
+			entries = append(entries, overlayEntry{f.Src, dest, info})
+			continue
+		}
+
+		err = filepath.WalkDir(f.Src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(f.Src, p)
+			if err != nil {
+				return err
+			}
+			name := cleanName(path.Join(dest, filepath.ToSlash(rel)))
+			if name == "." {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			entries = append(entries, overlayEntry{p, name, info})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// scanOverlay - read every segment of input, finding the entries that
+// replaced will replace.  Returns the segments, the hard links that
+// change and the directories present in input.
+func scanOverlay(input string, replaced map[string]bool) ([]overlaySegment, *overlayLinks, map[string]bool, error) {
+	s, err := OpenSegmentReader(input)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer s.Close()
+
+	links := &overlayLinks{unlinked: map[linkKey]uint32{}, moved: map[linkKey][]byte{}}
+	// kept - for each inode with remaining links, whether any of them
+	// holds the data.
+	kept := map[linkKey]bool{}
+	dirs := map[string]bool{}
+	segs := []overlaySegment{}
+	for {
+		hdr, err := s.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+		seg := s.Segment()
+		if seg.Index == len(segs) {
+			segs = append(segs, overlaySegment{})
+		}
+
+		name := cleanName(hdr.Name)
+		isDir, ok := replaced[name]
+		if hdr.IsDir() {
+			dirs[name] = true
+			if ok && !isDir {
+				return nil, nil, nil, fmt.Errorf("cannot replace directory %s with a file", name)
+			}
+			continue
+		}
+
+		key := linkKey{s.Archive(), hdr.Ino}
+		if !ok {
+			if hdr.Nlink > 1 {
+				kept[key] = kept[key] || hdr.FileSize != 0
+			}
+			continue
+		}
+		segs[seg.Index].replaced++
+		if hdr.Nlink > 1 {
+			links.unlinked[key]++
+			if hdr.FileSize != 0 {
+				data, err := io.ReadAll(s)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				links.moved[key] = data
+			}
+		}
+	}
+
+	for key := range links.moved {
+		if hasData, ok := kept[key]; !ok || hasData {
+			delete(links.moved, key)
+		}
+	}
+	for i, seg := range s.Segments() {
+		segs[i].Segment = seg
+	}
+	return segs, links, dirs, nil
+}
+
+// Overlay - write input to w with files added, replacing any entries
+// of input at the same paths.
+//
+// Segments of input that contain none of the paths are copied
+// unchanged, so an uncompressed early microcode segment is kept as it
+// is.  Segments that do are rewritten without those entries, using
+// the same compression.  The files are written to a new segment at
+// the end, compressed with comp, or if comp is Undetermined with the
+// compression of the last compressed segment of input.  Parent
+// directories that are missing from input are created.
+//
+// Only gzip segments may be followed by another segment, so if the
+// last segment of input uses another compression the files are
+// added to that segment instead.
+func Overlay(w io.Writer, input string, files []OverlayFile, comp Compression, opts DirOptions) error {
+	entries, err := overlayEntries(files)
+	if err != nil {
+		return err
+	}
+
+	replaced := map[string]bool{}
+	for _, e := range entries {
+		replaced[e.name] = e.info.IsDir()
+	}
+
+	segs, links, dirs, err := scanOverlay(input, replaced)
+	if err != nil {
+		return fmt.Errorf("failed reading %s: %w", input, err)
+	}
+
+	last := Identity
+	for _, seg := range segs {
+		if seg.Compression != Identity {
+			last = seg.Compression
+		}
+	}
+	if comp == Undetermined {
+		comp = last
+	}
+
+	merge := -1
+	if n := len(segs); n != 0 && segs[n-1].Compression != Identity && segs[n-1].Compression != Gzip {
+		if comp != segs[n-1].Compression {
+			return fmt.Errorf("cannot add a %s segment after the %s segment of %s", comp, segs[n-1].Compression, input)
+		}
+		merge = n - 1
+	}
+
+	fp, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	st, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+
+	write := func(w io.Writer) error {
+		aw := NewArchiveWriter(w)
+		if err := writeOverlay(aw, entries, dirs, opts); err != nil {
+			return err
+		}
+		return aw.Close()
+	}
+
+	cw := &countingWriter{w: w}
+	for i, seg := range segs {
+		end := st.Size()
+		if i+1 < len(segs) {
+			end = segs[i+1].Offset
+		}
+
+		if seg.replaced == 0 && i != merge {
+			if err := cw.pad(); err != nil {
+				return err
+			}
+			if _, err := io.Copy(cw, io.NewSectionReader(fp, seg.Offset, end-seg.Offset)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		writers := []func(io.Writer) error{
+			func(w io.Writer) error {
+				return copyOverlaid(w, io.NewSectionReader(fp, seg.Offset, end-seg.Offset), seg, links, replaced)
+			},
+		}
+		if i == merge {
+			// a separate archive, so that its inode numbers cannot
+			// be taken as hard links to the existing entries.
+			writers = append(writers, write)
+		}
+		if err := writeSegment(cw, seg.Compression, writers...); err != nil {
+			return fmt.Errorf("failed rewriting segment %d: %w", i, err)
+		}
+	}
+
+	if merge >= 0 {
+		return nil
+	}
+	return writeSegment(cw, comp, write)
+}
+
+// countingWriter - count the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// pad - pad to a 4 byte boundary, as a segment must start on one.
+func (c *countingWriter) pad() error {
+	if n := pad4(c.n); n != 0 {
+		_, err := c.Write(make([]byte, n))
+		return err
+	}
+	return nil
+}
+
+// writeSegment - write a segment to w, compressed with comp, holding
+// the archives written by each of writers.
+func writeSegment(w *countingWriter, comp Compression, writers ...func(io.Writer) error) error {
+	if err := w.pad(); err != nil {
+		return err
+	}
+	enc, err := NewCompressor(w, comp)
+	if err != nil {
+		return err
+	}
+	for _, write := range writers {
+		if err := write(enc); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+// copyOverlaid - copy the archives of the segment in r to w, leaving
+// out the entries that are replaced.  Each archive is written with its
+// own trailer, as inode numbers are only unique within one.  If a
+// replaced entry holds the data of a hard link, that data moves to the
+// first remaining link.
+func copyOverlaid(w io.Writer, r io.Reader, seg overlaySegment, links *overlayLinks, replaced map[string]bool) error {
+	var ar *ArchiveReader
+	if seg.Compression == Identity {
+		ar = newSingleArchiveReader(r)
+	} else {
+		dec, err := NewDecompressor(r, seg.Compression)
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		if zr, ok := dec.(*gzip.Reader); ok {
+			zr.Multistream(false)
+		}
+		ar = NewArchiveReader(dec)
+	}
+
+	aw := NewArchiveWriter(w)
+	archives := 0
+	for {
+		hdr, err := ar.Next()
+		if err == io.EOF {
+			return aw.Close()
+		} else if err != nil {
+			return err
+		}
+
+		if ar.Archives() != archives {
+			if err := aw.Close(); err != nil {
+				return err
+			}
+			aw = NewArchiveWriter(w)
+			archives = ar.Archives()
+		}
+
+		if _, drop := replaced[cleanName(hdr.Name)]; drop && !hdr.IsDir() {
+			continue
+		}
+
+		var data io.Reader = ar
+		if hdr.Nlink > 1 && !hdr.IsDir() {
+			key := linkKey{seg.Archive + archives, hdr.Ino}
+			hdr.Nlink -= links.unlinked[key]
+			if buf, ok := links.moved[key]; ok && hdr.FileSize == 0 {
+				hdr.FileSize = uint32(len(buf))
+				data = bytes.NewReader(buf)
+				delete(links.moved, key)
+			}
+		}
+
+		if err := aw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(aw, data); err != nil {
+			return fmt.Errorf("failed copying %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// writeOverlay - write entries to aw, preceded by any of their parent
+// directories that are not in dirs.
+func writeOverlay(aw *ArchiveWriter, entries []overlayEntry, dirs map[string]bool, opts DirOptions) error {
+	t := newTreeWriter(aw, opts)
+	for _, e := range entries {
+		if err := writeParents(t, path.Dir(e.name), dirs); err != nil {
+			return err
+		}
+		if err := t.add(e.path, e.name, e.info); err != nil {
+			return err
+		}
+		if e.info.IsDir() {
+			dirs[e.name] = true
+		}
+	}
+	return nil
+}
+
+// writeParents - write entries for dir and its parents if they are
+// not in dirs.
+func writeParents(t *treeWriter, dir string, dirs map[string]bool) error {
+	if dir == "." || dirs[dir] {
+		return nil
+	}
+	if err := writeParents(t, path.Dir(dir), dirs); err != nil {
+		return err
+	}
+
+	hdr := &Header{
+		Ino:   t.nextIno(),
+		Mode:  ModeDir | 0755,
+		UID:   t.opts.UID,
+		GID:   t.opts.GID,
+		Nlink: 2,
+		Mtime: uint32(time.Now().Unix()),
+		Name:  dir,
+	}
+	if t.opts.Mtime != nil {
+		hdr.Mtime = *t.opts.Mtime
+	}
+	dirs[dir] = true
+	return t.aw.WriteHeader(hdr)
+}
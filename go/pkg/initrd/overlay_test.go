@@ -0,0 +1,263 @@
+package initrd
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readSegments - return the entries of each segment of the initramfs in r.
+func readSegments(t *testing.T, r io.Reader) ([]Segment, map[int][]testEntry) {
+	t.Helper()
+	sr := NewSegmentReader(r)
+	found := map[int][]testEntry{}
+	for {
+		hdr, err := sr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		data, err := io.ReadAll(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx := sr.Segment().Index
+		found[idx] = append(found[idx], testEntry{*hdr, string(data)})
+	}
+	return sr.Segments(), found
+}
+
+func entryNames(entries []testEntry) []string {
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.hdr.Name)
+	}
+	return names
+}
+
+func TestOverlay(t *testing.T) {
+	tmpd := t.TempDir()
+
+	var microcode bytes.Buffer
+	compressTestArchive(t, &microcode, Identity, []testEntry{
+		{Header{Name: "kernel", Mode: ModeDir | 0755, Nlink: 2}, ""},
+		{Header{Name: "kernel/GenuineIntel.bin", Mode: ModeRegular | 0644, Nlink: 1}, "ucode"},
+	})
+
+	var b bytes.Buffer
+	b.Write(microcode.Bytes())
+	compressTestArchive(t, &b, Gzip, []testEntry{
+		{Header{Name: "etc", Mode: ModeDir | 0755, Nlink: 2}, ""},
+		{Header{Name: "etc/hostname", Mode: ModeRegular | 0644, Nlink: 1}, "old\n"},
+		{Header{Name: "etc/motd", Mode: ModeRegular | 0644, Nlink: 1}, "hello\n"},
+	})
+	input := filepath.Join(tmpd, "initrd")
+	if err := os.WriteFile(input, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(tmpd, "src")
+	if err := os.MkdirAll(filepath.Join(src, "pcr7data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"hostname":          "new\n",
+		"manifestCA.pem":    "cert\n",
+		"pcr7data/policy-1": "policy\n",
+	} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	err := Overlay(&out, input, []OverlayFile{
+		{filepath.Join(src, "hostname"), "/etc/hostname"},
+		{filepath.Join(src, "manifestCA.pem"), "/manifestCA.pem"},
+		{filepath.Join(src, "pcr7data"), "/pcr7data"},
+		{filepath.Join(src, "hostname"), "/usr/share/bootkit/hostname"},
+	}, Undetermined, DirOptions{})
+	if err != nil {
+		t.Fatalf("Overlay: %v", err)
+	}
+
+	if !bytes.HasPrefix(out.Bytes(), microcode.Bytes()) {
+		t.Errorf("microcode segment was not kept unchanged")
+	}
+
+	segs, found := readSegments(t, bytes.NewReader(out.Bytes()))
+	expected := []Compression{Identity, Gzip, Gzip}
+	if len(segs) != len(expected) {
+		t.Fatalf("found %d segments, expected %d", len(segs), len(expected))
+	}
+	for i, comp := range expected {
+		if segs[i].Compression != comp {
+			t.Errorf("segment %d compression was %s, expected %s", i, segs[i].Compression, comp)
+		}
+	}
+
+	checkEntries(t, found[1], []testEntry{
+		{Header{Name: "etc", Mode: ModeDir | 0755, Nlink: 2}, ""},
+		{Header{Name: "etc/motd", Mode: ModeRegular | 0644, Nlink: 1}, "hello\n"},
+	})
+
+	names := entryNames(found[2])
+	expectedNames := []string{
+		"etc/hostname", "manifestCA.pem", "pcr7data", "pcr7data/policy-1",
+		"usr", "usr/share", "usr/share/bootkit", "usr/share/bootkit/hostname"}
+	if len(names) != len(expectedNames) {
+		t.Fatalf("overlay segment had %v, expected %v", names, expectedNames)
+	}
+	for i, name := range expectedNames {
+		if names[i] != name {
+			t.Errorf("overlay entry %d was %s, expected %s", i, names[i], name)
+		}
+	}
+	if found[2][0].data != "new\n" {
+		t.Errorf("etc/hostname was %q, expected %q", found[2][0].data, "new\n")
+	}
+}
+
+func TestOverlayHardlink(t *testing.T) {
+	tmpd := t.TempDir()
+
+	var b bytes.Buffer
+	compressTestArchive(t, &b, Gzip, []testEntry{
+		{Header{Ino: 5, Name: "bin/sh", Mode: ModeRegular | 0755, Nlink: 2, FileSize: 4}, "box\n"},
+		{Header{Ino: 5, Name: "bin/ls", Mode: ModeRegular | 0755, Nlink: 2}, ""},
+	})
+	input := filepath.Join(tmpd, "initrd")
+	if err := os.WriteFile(input, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(tmpd, "sh")
+	if err := os.WriteFile(src, []byte("dash\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := Overlay(&out, input, []OverlayFile{{src, "bin/sh"}}, Undetermined, DirOptions{}); err != nil {
+		t.Fatalf("Overlay: %v", err)
+	}
+
+	_, found := readSegments(t, bytes.NewReader(out.Bytes()))
+	checkEntries(t, found[0], []testEntry{
+		{Header{Ino: 5, Name: "bin/ls", Mode: ModeRegular | 0755, Nlink: 1, FileSize: 4}, "box\n"},
+	})
+}
+
+func TestOverlayHardlinkData(t *testing.T) {
+	tmpd := t.TempDir()
+
+	// as written by GNU cpio, only the last link holds the data.
+	var b bytes.Buffer
+	compressTestArchive(t, &b, Gzip, []testEntry{
+		{Header{Ino: 5, Name: "bin/ls", Mode: ModeRegular | 0755, Nlink: 3}, ""},
+		{Header{Ino: 5, Name: "bin/cat", Mode: ModeRegular | 0755, Nlink: 3}, ""},
+		{Header{Ino: 5, Name: "bin/sh", Mode: ModeRegular | 0755, Nlink: 3}, "box\n"},
+	})
+	input := filepath.Join(tmpd, "initrd")
+	if err := os.WriteFile(input, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(tmpd, "sh")
+	if err := os.WriteFile(src, []byte("dash\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := Overlay(&out, input, []OverlayFile{{src, "bin/sh"}}, Undetermined, DirOptions{}); err != nil {
+		t.Fatalf("Overlay: %v", err)
+	}
+
+	_, found := readSegments(t, bytes.NewReader(out.Bytes()))
+	checkEntries(t, found[0], []testEntry{
+		{Header{Ino: 5, Name: "bin/ls", Mode: ModeRegular | 0755, Nlink: 2}, "box\n"},
+		{Header{Ino: 5, Name: "bin/cat", Mode: ModeRegular | 0755, Nlink: 2}, ""},
+	})
+}
+
+func TestOverlayArchivesInSegment(t *testing.T) {
+	tmpd := t.TempDir()
+
+	// two archives in one gzip stream, each using inode 7.
+	var b bytes.Buffer
+	compressTestArchives(t, &b, Gzip, []testEntry{
+		{Header{Ino: 7, Name: "a", Mode: ModeRegular | 0644, Nlink: 2}, ""},
+		{Header{Ino: 7, Name: "b", Mode: ModeRegular | 0644, Nlink: 2}, "AAAA"},
+	}, []testEntry{
+		{Header{Ino: 7, Name: "c", Mode: ModeRegular | 0644, Nlink: 2}, ""},
+		{Header{Ino: 7, Name: "d", Mode: ModeRegular | 0644, Nlink: 2}, "DDDD"},
+	})
+	input := filepath.Join(tmpd, "initrd")
+	if err := os.WriteFile(input, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(tmpd, "b")
+	if err := os.WriteFile(src, []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := Overlay(&out, input, []OverlayFile{{src, "b"}}, Undetermined, DirOptions{}); err != nil {
+		t.Fatalf("Overlay: %v", err)
+	}
+
+	sr := NewSegmentReader(bytes.NewReader(out.Bytes()))
+	archives := map[string]int{}
+	for {
+		hdr, err := sr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		archives[hdr.Name] = sr.Archive()
+	}
+	if archives["a"] == archives["c"] {
+		t.Errorf("a and c were written to the same archive")
+	}
+
+	_, found := readSegments(t, bytes.NewReader(out.Bytes()))
+	checkEntries(t, found[0], []testEntry{
+		{Header{Ino: 7, Name: "a", Mode: ModeRegular | 0644, Nlink: 1}, "AAAA"},
+		{Header{Ino: 7, Name: "c", Mode: ModeRegular | 0644, Nlink: 2}, ""},
+		{Header{Ino: 7, Name: "d", Mode: ModeRegular | 0644, Nlink: 2}, "DDDD"},
+	})
+}
+
+func TestOverlayZstd(t *testing.T) {
+	tmpd := t.TempDir()
+
+	var b bytes.Buffer
+	compressTestArchive(t, &b, Zstd, testEntries)
+	input := filepath.Join(tmpd, "initrd")
+	if err := os.WriteFile(input, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(tmpd, "file")
+	if err := os.WriteFile(src, []byte("data\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Overlay(io.Discard, input, []OverlayFile{{src, "file"}}, Gzip, DirOptions{}); err == nil {
+		t.Errorf("Overlay succeeded adding gzip after a zstd segment")
+	}
+
+	var out bytes.Buffer
+	if err := Overlay(&out, input, []OverlayFile{{src, "file"}}, Undetermined, DirOptions{}); err != nil {
+		t.Fatalf("Overlay: %v", err)
+	}
+
+	segs, found := readSegments(t, bytes.NewReader(out.Bytes()))
+	if len(segs) != 1 || segs[0].Compression != Zstd {
+		t.Fatalf("expected a single zstd segment, found %v", segs)
+	}
+	names := entryNames(found[0])
+	if len(names) != len(testEntries)+1 || names[len(names)-1] != "file" {
+		t.Errorf("unexpected entries %v", names)
+	}
+}
@@ -0,0 +1,200 @@
+package initrd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Segment - one part of an initramfs.  An initramfs is a series of
+// uncompressed cpio archives and compressed streams of cpio archives,
+// optionally separated by NUL padding.
+type Segment struct {
+	Index       int
+	Offset      int64
+	Size        int64
+	Compression Compression
+	Entries     int
+	// Archive - index of the first archive in the segment, counted
+	// across all segments as SegmentReader.Archive does.
+	Archive int
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// SegmentReader - read entries from every segment of an initramfs, as
+// the kernel does when unpacking it.
+//
+// gzip streams are read exactly, so any segment may follow them.
+// Decompressors for other formats read ahead, so a stream in one of
+// those formats must be the last segment.
+type SegmentReader struct {
+	counter  *countingReader
+	br       *bufio.Reader
+	closer   io.Closer
+	segments []Segment
+	cur      *ArchiveReader
+	dec      io.ReadCloser
+	done     bool
+	archives int // archives in segments before the current one.
+}
+
+func NewSegmentReader(r io.Reader) *SegmentReader {
+	counter := &countingReader{r: r}
+	return &SegmentReader{counter: counter, br: bufio.NewReader(counter)}
+}
+
+// OpenSegmentReader - return a SegmentReader of the initramfs at path.
+func OpenSegmentReader(path string) (*SegmentReader, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSegmentReader(fp)
+	s.closer = fp
+	return s, nil
+}
+
+// offset - the offset in the underlying reader that has been consumed.
+func (s *SegmentReader) offset() int64 {
+	return s.counter.n - int64(s.br.Buffered())
+}
+
+// Segments - the segments seen so far.
+func (s *SegmentReader) Segments() []Segment {
+	return s.segments
+}
+
+// Segment - the segment of the entry most recently returned by Next.
+func (s *SegmentReader) Segment() Segment {
+	return s.segments[len(s.segments)-1]
+}
+
+// Archive - the index of the archive of the entry most recently
+// returned by Next, counted across all segments.  A segment may hold
+// several concatenated archives, and inode numbers are only unique
+// within one of them.
+func (s *SegmentReader) Archive() int {
+	if s.cur == nil {
+		return s.archives
+	}
+	return s.archives + s.cur.Archives()
+}
+
+// Next - advance to the next entry, moving to the next segment as needed.
+func (s *SegmentReader) Next() (*Header, error) {
+	for {
+		if s.cur != nil {
+			hdr, err := s.cur.Next()
+			if err == nil {
+				s.segments[len(s.segments)-1].Entries++
+				return hdr, nil
+			} else if err != io.EOF {
+				return nil, fmt.Errorf("segment %d: %w", len(s.segments)-1, err)
+			}
+			if err := s.endSegment(); err != nil {
+				return nil, err
+			}
+		}
+		if s.done {
+			return nil, io.EOF
+		}
+		if err := s.nextSegment(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *SegmentReader) endSegment() error {
+	s.archives += s.cur.Archives()
+	s.cur = nil
+	if s.dec != nil {
+		if err := s.dec.Close(); err != nil {
+			return err
+		}
+		s.dec = nil
+	}
+	seg := &s.segments[len(s.segments)-1]
+	seg.Size = s.offset() - seg.Offset
+	return nil
+}
+
+func (s *SegmentReader) nextSegment() error {
+	for {
+		b, err := s.br.Peek(1)
+		if err == io.EOF {
+			s.done = true
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if b[0] != 0 {
+			break
+		}
+		if _, err := s.br.Discard(1); err != nil {
+			return err
+		}
+	}
+
+	seg := Segment{Index: len(s.segments), Offset: s.offset(), Compression: Identity, Archive: s.archives}
+	magic, err := s.br.Peek(compressionMagicLen)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if bytes.HasPrefix(magic, []byte(newcMagic[:5])) {
+		s.cur = newSingleArchiveReader(s.br)
+		s.segments = append(s.segments, seg)
+		return nil
+	}
+
+	seg.Compression = DetectCompression(magic)
+	if seg.Compression == Identity {
+		return fmt.Errorf("unrecognized data at offset %d: % x", seg.Offset, magic)
+	}
+
+	dec, err := NewDecompressor(s.br, seg.Compression)
+	if err != nil {
+		return fmt.Errorf("failed to read %s segment at offset %d: %w", seg.Compression, seg.Offset, err)
+	}
+	if zr, ok := dec.(*gzip.Reader); ok {
+		zr.Multistream(false)
+	} else {
+		s.done = true
+	}
+
+	s.dec = dec
+	s.cur = NewArchiveReader(dec)
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// Read - read data of the current entry.
+func (s *SegmentReader) Read(p []byte) (int, error) {
+	if s.cur == nil {
+		return 0, io.EOF
+	}
+	return s.cur.Read(p)
+}
+
+func (s *SegmentReader) Close() error {
+	if s.dec != nil {
+		s.dec.Close()
+	}
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package initrd
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func compressTestArchive(t *testing.T, w io.Writer, comp Compression, entries []testEntry) {
+	t.Helper()
+	compressTestArchives(t, w, comp, entries)
+}
+
+// compressTestArchives - write a segment holding an archive of each of
+// archives.
+func compressTestArchives(t *testing.T, w io.Writer, comp Compression, archives ...[]testEntry) {
+	t.Helper()
+	enc, err := NewCompressor(w, comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entries := range archives {
+		writeTestArchive(t, enc, entries)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentReader(t *testing.T) {
+	var b bytes.Buffer
+	compressTestArchive(t, &b, Identity, testEntries[:1])
+	compressTestArchive(t, &b, Gzip, testEntries[1:2])
+	b.Write(make([]byte, 8))
+	compressTestArchive(t, &b, Gzip, testEntries[2:3])
+	compressTestArchive(t, &b, Zstd, testEntries[3:])
+
+	sr := NewSegmentReader(&b)
+	names := []string{}
+	indexes := []int{}
+	for {
+		hdr, err := sr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		names = append(names, hdr.Name)
+		indexes = append(indexes, sr.Segment().Index)
+	}
+
+	if len(names) != len(testEntries) {
+		t.Fatalf("found %v, expected %d entries", names, len(testEntries))
+	}
+	for i, e := range testEntries {
+		if names[i] != e.hdr.Name {
+			t.Errorf("entry %d was %s, expected %s", i, names[i], e.hdr.Name)
+		}
+	}
+
+	expected := []Compression{Identity, Gzip, Gzip, Zstd}
+	segs := sr.Segments()
+	if len(segs) != len(expected) {
+		t.Fatalf("found %d segments, expected %d", len(segs), len(expected))
+	}
+	for i, comp := range expected {
+		if segs[i].Compression != comp {
+			t.Errorf("segment %d compression was %s, expected %s", i, segs[i].Compression, comp)
+		}
+	}
+	if segs[0].Offset != 0 || segs[1].Offset != cpioBlockSize {
+		t.Errorf("unexpected offsets %d, %d", segs[0].Offset, segs[1].Offset)
+	}
+	if indexes[len(indexes)-1] != 3 {
+		t.Errorf("last entry was in segment %d, expected 3", indexes[len(indexes)-1])
+	}
+}
+
+func TestExtractAll(t *testing.T) {
+	var b bytes.Buffer
+	compressTestArchive(t, &b, Identity, []testEntry{
+		{Header{Name: "etc", Mode: ModeDir | 0755, Nlink: 2}, ""},
+		{Header{Name: "etc/hostname", Mode: ModeRegular | 0644, Nlink: 1}, "first\n"},
+	})
+	compressTestArchive(t, &b, Gzip, []testEntry{
+		{Header{Name: "etc/hostname", Mode: ModeRegular | 0600, Nlink: 1}, "second\n"},
+		{Header{Name: "bin", Mode: ModeDir | 0755, Nlink: 2}, ""},
+		{Header{Name: "bin/a", Ino: 5, Mode: ModeRegular | 0755, Nlink: 2}, ""},
+		{Header{Name: "bin/b", Ino: 5, Mode: ModeRegular | 0755, Nlink: 2}, "binary"},
+		{Header{Name: "bin/sh", Mode: ModeSymlink | 0777, Nlink: 1}, "b"},
+		{Header{Name: "../escape", Mode: ModeRegular | 0644, Nlink: 1}, "x"},
+	})
+
+	dir := t.TempDir()
+	if _, err := ExtractAll(NewSegmentReader(&b), dir, nil); err != nil {
+		t.Fatalf("ExtractAll failed: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "etc/hostname"))
+	if err != nil || string(content) != "second\n" {
+		t.Errorf("etc/hostname had %q (%v), expected later content", content, err)
+	}
+
+	a, errA := os.Stat(filepath.Join(dir, "bin/a"))
+	bi, errB := os.Stat(filepath.Join(dir, "bin/b"))
+	if errA != nil || errB != nil {
+		t.Fatalf("hardlinks missing: %v %v", errA, errB)
+	}
+	if !os.SameFile(a, bi) || a.Size() != 6 {
+		t.Errorf("bin/a and bin/b were not the same 6 byte file")
+	}
+
+	if target, err := os.Readlink(filepath.Join(dir, "bin/sh")); err != nil || target != "b" {
+		t.Errorf("bin/sh: readlink gave %q, %v", target, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "escape")); err != nil {
+		t.Errorf("../escape was not extracted inside dir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape")); err == nil {
+		t.Errorf("../escape was extracted outside of dir")
+	}
+}
+
+func TestExtractSymlinkEscape(t *testing.T) {
+	var b bytes.Buffer
+	outside := t.TempDir()
+	compressTestArchive(t, &b, Identity, []testEntry{
+		{Header{Name: "link", Mode: ModeSymlink | 0777, Nlink: 1}, outside},
+		{Header{Name: "link/file", Mode: ModeRegular | 0644, Nlink: 1}, "x"},
+	})
+
+	if _, err := ExtractAll(NewSegmentReader(&b), t.TempDir(), nil); err == nil {
+		t.Errorf("expected error extracting through a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file")); err == nil {
+		t.Errorf("file was written outside of extraction dir")
+	}
+}
+
+func TestExtractArchivesInSegment(t *testing.T) {
+	var b bytes.Buffer
+	compressTestArchives(t, &b, Gzip, []testEntry{
+		{Header{Name: "x", Ino: 7, Mode: ModeRegular | 0644, Nlink: 2}, "XXXX"},
+	}, []testEntry{
+		{Header{Name: "p", Ino: 1, Mode: ModeDir | 0755, Nlink: 2}, ""},
+		{Header{Name: "p/q", Ino: 7, Mode: ModeRegular | 0644, Nlink: 2}, "PPPP"},
+	})
+
+	sr := NewSegmentReader(&b)
+	dir := t.TempDir()
+	if _, err := ExtractAll(sr, dir, nil); err != nil {
+		t.Fatalf("ExtractAll failed: %v", err)
+	}
+	if n := len(sr.Segments()); n != 1 {
+		t.Fatalf("found %d segments, expected 1", n)
+	}
+
+	x, errX := os.Stat(filepath.Join(dir, "x"))
+	q, errQ := os.Stat(filepath.Join(dir, "p/q"))
+	if errX != nil || errQ != nil {
+		t.Fatalf("files missing: %v %v", errX, errQ)
+	}
+	if os.SameFile(x, q) {
+		t.Errorf("x and p/q from different archives were linked")
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, "x")); err != nil || string(content) != "XXXX" {
+		t.Errorf("x had %q (%v), expected XXXX", content, err)
+	}
+}
+
+func TestExtractReadOnlyDir(t *testing.T) {
+	var b bytes.Buffer
+	compressTestArchive(t, &b, Identity, []testEntry{
+		{Header{Name: "usr", Mode: ModeDir | 0555, Nlink: 3, Mtime: 1700000000}, ""},
+		{Header{Name: "usr/lib", Mode: ModeDir | 0500, Nlink: 2, Mtime: 1700000000}, ""},
+		{Header{Name: "usr/lib/os-release", Mode: ModeRegular | 0444, Nlink: 1}, "ID=bootkit\n"},
+		{Header{Name: "usr/bin", Mode: ModeRegular | 0755, Nlink: 1}, "binary"},
+	})
+
+	dir := t.TempDir()
+	t.Cleanup(func() {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(path, 0755)
+			}
+			return nil
+		})
+	})
+
+	sr := NewSegmentReader(&b)
+	e := NewExtractor(dir)
+	for {
+		hdr, err := sr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Extract(sr.Archive(), hdr, sr); err != nil {
+			t.Fatalf("Extract %s: %v", hdr.Name, err)
+		}
+	}
+	// directories stay writable until Finish.
+	for _, name := range []string{"usr", "usr/lib"} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil || fi.Mode().Perm()&0200 == 0 {
+			t.Errorf("%s was not writable before Finish: %v", name, err)
+		}
+	}
+	if err := e.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	for name, mode := range map[string]os.FileMode{"usr": 0555, "usr/lib": 0500, "usr/lib/os-release": 0444} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Errorf("%s has mode %o, expected %o", name, fi.Mode().Perm(), mode)
+		}
+		if fi.IsDir() && fi.ModTime().Unix() != 1700000000 {
+			t.Errorf("%s has mtime %s", name, fi.ModTime())
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package objtest - helpers for tests that work with PE32+ images and
+// their Authenticode signatures.
+package objtest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/pe"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/foxboron/go-uefi/efi/pecoff"
+)
+
+// TextSize - the size of the .text section of PE.
+const TextSize = 0x30
+
+// PE - return a minimal PE32+ EFI application with a .text section of
+// TextSize bytes of 0xc3 at 0x1000.  If sig is not nil, it is put in
+// the security directory at file offset 0x400.
+func PE(t testing.TB, sig []byte) []byte {
+	t.Helper()
+	const lfanew = 0x80
+	dos := make([]byte, lfanew)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], lfanew)
+
+	opt := pe.OptionalHeader64{
+		Magic:               0x20b,
+		AddressOfEntryPoint: 0x1000,
+		SectionAlignment:    0x1000,
+		FileAlignment:       0x200,
+		SizeOfImage:         0x2000,
+		SizeOfHeaders:       0x200,
+		Subsystem:           pe.IMAGE_SUBSYSTEM_EFI_APPLICATION,
+		NumberOfRvaAndSizes: 16,
+	}
+	if sig != nil {
+		opt.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY] = pe.DataDirectory{VirtualAddress: 0x400, Size: uint32(len(sig))}
+	}
+
+	var b bytes.Buffer
+	b.Write(dos)
+	b.WriteString("PE\x00\x00")
+	binary.Write(&b, binary.LittleEndian, pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_AMD64,
+		NumberOfSections:     1,
+		SizeOfOptionalHeader: uint16(binary.Size(opt)),
+		Characteristics:      pe.IMAGE_FILE_EXECUTABLE_IMAGE,
+	})
+	binary.Write(&b, binary.LittleEndian, opt)
+	sh := pe.SectionHeader32{
+		VirtualSize:      TextSize,
+		VirtualAddress:   0x1000,
+		SizeOfRawData:    0x200,
+		PointerToRawData: 0x200,
+		Characteristics:  pe.IMAGE_SCN_CNT_CODE | pe.IMAGE_SCN_MEM_EXECUTE | pe.IMAGE_SCN_MEM_READ,
+	}
+	copy(sh.Name[:], ".text")
+	binary.Write(&b, binary.LittleEndian, sh)
+	b.Write(make([]byte, 0x200-b.Len()))
+	b.Write(bytes.Repeat([]byte{0xc3}, TextSize))
+	b.Write(make([]byte, 0x400-b.Len()))
+	b.Write(sig)
+	return b.Bytes()
+}
+
+// Signer - a self-signed RSA certificate and its key.
+type Signer struct {
+	Cert *x509.Certificate
+	Key  *rsa.PrivateKey
+}
+
+// NewSigner - return a Signer with a new key and a certificate for cn.
+func NewSigner(t testing.TB, cn string) *Signer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Signer{Cert: cert, Key: key}
+}
+
+// Sign - return the unsigned image data with an Authenticode signature
+// by s appended.
+func (s *Signer) Sign(t testing.TB, data []byte) []byte {
+	t.Helper()
+	// PECOFFChecksum modifies the image it is given.
+	ctx := pecoff.PECOFFChecksum(append([]byte{}, data...))
+	sig, err := pecoff.CreateSignature(ctx, s.Cert, s.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := pecoff.AppendToBinary(ctx, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// Owner - the owner of the entries of CertDB.
+var Owner = efi.GUID{1}
+
+// CertDB - return a signature database with an entry for each of certs.
+func CertDB(certs ...*x509.Certificate) efi.SignatureDatabase {
+	l := &efi.SignatureList{Type: efi.CertX509Guid}
+	for _, c := range certs {
+		l.Signatures = append(l.Signatures, &efi.SignatureData{Owner: Owner, Data: c.Raw})
+	}
+	return efi.SignatureDatabase{l}
+}
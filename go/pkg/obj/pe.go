@@ -0,0 +1,479 @@
+package obj
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	peSignature       = "PE\x00\x00"
+	peMagic64         = 0x20b
+	dosLfanewOffset   = 0x3c
+	coffHeaderSize    = 20
+	sectionHeaderSize = 40
+	optHeader64Size   = 240 // with all 16 data directories.
+	optChecksumOffset = 64
+	debugEntrySize    = 28
+
+	// objcopy --add-section makes sections 'contents, alloc, load,
+	// readonly, data'.
+	defaultCharacteristics = pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ
+)
+
+// Section - a section of a PE image.
+type Section struct {
+	Name            string
+	VirtualAddress  uint32
+	VirtualSize     uint32
+	Characteristics uint32
+	// Data - the raw data of the section, which may be shorter or
+	// longer than VirtualSize.
+	Data []byte
+
+	// rawName - the name as stored in the section table, so names in
+	// the string table survive a rewrite.
+	rawName [8]byte
+}
+
+// PEFile - a PE32+ image whose sections can be added, removed or replaced.
+//
+// Sections keep their virtual addresses; their data is laid out again
+// in the file when it is written.  Any Authenticode signature is
+// dropped as the changes invalidate it.
+type PEFile struct {
+	dos      []byte
+	header   pe.FileHeader
+	opt      pe.OptionalHeader64
+	symbols  []byte // COFF symbol and string tables, if any.
+	certs    []byte // the attribute certificate table, if any.
+	Sections []*Section
+}
+
+func align(n, a uint32) uint32 {
+	if a == 0 {
+		return n
+	}
+	return (n + a - 1) / a * a
+}
+
+// ParsePE - parse the PE32+ image in data.
+func ParsePE(data []byte) (*PEFile, error) {
+	if len(data) < dosLfanewOffset+4 || data[0] != 'M' || data[1] != 'Z' {
+		return nil, fmt.Errorf("not a PE image: missing MZ header")
+	}
+	lfanew := binary.LittleEndian.Uint32(data[dosLfanewOffset:])
+	if int64(lfanew)+4+coffHeaderSize > int64(len(data)) || string(data[lfanew:lfanew+4]) != peSignature {
+		return nil, fmt.Errorf("not a PE image: missing PE signature")
+	}
+
+	p := &PEFile{dos: data[:lfanew]}
+	off := int(lfanew) + 4
+	if err := binary.Read(bytes.NewReader(data[off:]), binary.LittleEndian, &p.header); err != nil {
+		return nil, err
+	}
+	off += coffHeaderSize
+
+	optSize := int(p.header.SizeOfOptionalHeader)
+	if optSize > optHeader64Size || off+optSize > len(data) {
+		return nil, fmt.Errorf("bad optional header size %d", optSize)
+	}
+	opt := make([]byte, optHeader64Size)
+	copy(opt, data[off:off+optSize])
+	if err := binary.Read(bytes.NewReader(opt), binary.LittleEndian, &p.opt); err != nil {
+		return nil, err
+	}
+	if p.opt.Magic != peMagic64 {
+		return nil, fmt.Errorf("unsupported optional header magic 0x%x: not PE32+", p.opt.Magic)
+	}
+	off += optSize
+
+	if p.header.PointerToSymbolTable != 0 {
+		start := int64(p.header.PointerToSymbolTable)
+		strtab := start + int64(p.header.NumberOfSymbols)*pe.COFFSymbolSize
+		if strtab+4 > int64(len(data)) {
+			return nil, fmt.Errorf("symbol table at 0x%x is past end of file", start)
+		}
+		end := strtab + int64(binary.LittleEndian.Uint32(data[strtab:]))
+		if end > int64(len(data)) {
+			return nil, fmt.Errorf("string table at 0x%x is past end of file", strtab)
+		}
+		p.symbols = data[start:end]
+	}
+
+	// the certificate table entry holds a file offset, not an address.
+	if dir := p.opt.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]; dir.Size != 0 {
+		end := int64(dir.VirtualAddress) + int64(dir.Size)
+		if end > int64(len(data)) {
+			return nil, fmt.Errorf("certificate table at 0x%x is past end of file", dir.VirtualAddress)
+		}
+		p.certs = data[dir.VirtualAddress:end]
+	}
+
+	for i := 0; i < int(p.header.NumberOfSections); i++ {
+		if off+sectionHeaderSize > len(data) {
+			return nil, fmt.Errorf("section table is past end of file")
+		}
+		var sh pe.SectionHeader32
+		if err := binary.Read(bytes.NewReader(data[off:]), binary.LittleEndian, &sh); err != nil {
+			return nil, err
+		}
+		off += sectionHeaderSize
+
+		end := int64(sh.PointerToRawData) + int64(sh.SizeOfRawData)
+		if end > int64(len(data)) {
+			return nil, fmt.Errorf("section %d data is past end of file", i)
+		}
+		s := &Section{
+			Name:            p.sectionName(sh.Name),
+			VirtualAddress:  sh.VirtualAddress,
+			VirtualSize:     sh.VirtualSize,
+			Characteristics: sh.Characteristics,
+			Data:            data[sh.PointerToRawData:end],
+			rawName:         sh.Name,
+		}
+		p.Sections = append(p.Sections, s)
+	}
+
+	return p, nil
+}
+
+// ReadPEFile - read and parse the PE32+ image at path.
+func ReadPEFile(path string) (*PEFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePE(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// sectionName - return the name of a section from its table entry,
+// resolving '/<offset>' names through the string table.
+func (p *PEFile) sectionName(raw [8]byte) string {
+	name := strings.TrimRight(string(raw[:]), "\x00")
+	if !strings.HasPrefix(name, "/") || p.symbols == nil {
+		return name
+	}
+	var off uint32
+	if _, err := fmt.Sscanf(name[1:], "%d", &off); err != nil {
+		return name
+	}
+	strtab := p.symbols[int(p.header.NumberOfSymbols)*pe.COFFSymbolSize:]
+	if int(off) >= len(strtab) {
+		return name
+	}
+	if end := bytes.IndexByte(strtab[off:], 0); end >= 0 {
+		return string(strtab[off : int(off)+end])
+	}
+	return name
+}
+
+// Image executables have no string table, so section names longer than
+// 8 bytes are truncated.  Look sections up by the truncated name too.
+func sectionNameMatch(s *Section, name string) bool {
+	if s.Name == name {
+		return true
+	}
+	return len(name) > 8 && s.Name == name[:8]
+}
+
+// ImageBase - the preferred load address of the image.
+func (p *PEFile) ImageBase() uint64 {
+	return p.opt.ImageBase
+}
+
+// Machine - the machine type from the COFF header, like
+// pe.IMAGE_FILE_MACHINE_AMD64.
+func (p *PEFile) Machine() uint16 {
+	return p.header.Machine
+}
+
+// Subsystem - the subsystem from the optional header, like
+// pe.IMAGE_SUBSYSTEM_EFI_APPLICATION.
+func (p *PEFile) Subsystem() uint16 {
+	return p.opt.Subsystem
+}
+
+// Section - return the section named name, or nil.
+func (p *PEFile) Section(name string) *Section {
+	for _, s := range p.Sections {
+		if sectionNameMatch(s, name) {
+			return s
+		}
+	}
+	return nil
+}
+
+// RemoveSection - remove the section named name.  Returns false if
+// there was no such section.
+func (p *PEFile) RemoveSection(name string) bool {
+	for i, s := range p.Sections {
+		if sectionNameMatch(s, name) {
+			p.Sections = append(p.Sections[:i], p.Sections[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Content - the data of the section without the padding to the file
+// alignment.
+func (s *Section) Content() []byte {
+	if s.VirtualSize != 0 && int(s.VirtualSize) < len(s.Data) {
+		return s.Data[:s.VirtualSize]
+	}
+	return s.Data
+}
+
+// end - the end of the section's virtual address range.
+func (s *Section) end() uint32 {
+	return s.VirtualAddress + max32(max32(s.VirtualSize, uint32(len(s.Data))), 1)
+}
+
+// overlaps - return true if [start, end) overlaps the address range of s.
+func (s *Section) overlaps(start, end uint32) bool {
+	return start < s.end() && s.VirtualAddress < end
+}
+
+// NextFreeAddress - return the first address after all sections other
+// than skip, aligned to the section alignment of the image and to
+// alignment.
+func (p *PEFile) NextFreeAddress(skip *Section, alignment uint32) uint32 {
+	next := align(uint32(len(p.dos))+4+coffHeaderSize+uint32(p.header.SizeOfOptionalHeader)+
+		uint32(len(p.Sections)+1)*sectionHeaderSize, p.opt.FileAlignment)
+	for _, s := range p.Sections {
+		if s != skip && s.end() > next {
+			next = s.end()
+		}
+	}
+	return align(align(next, p.opt.SectionAlignment), alignment)
+}
+
+// overlapping - return the section other than skip that overlaps
+// [start, end), or nil.
+func (p *PEFile) overlapping(skip *Section, start, end uint32) *Section {
+	for _, s := range p.Sections {
+		if s != skip && s.overlaps(start, end) {
+			return s
+		}
+	}
+	return nil
+}
+
+// SetSection - replace the data of the section named name, adding it
+// if it does not exist.
+//
+// rva is relative to the image base.  If it is zero, an existing
+// section stays where it is if the data fits there, otherwise the
+// section is placed at the next free address aligned to alignment.
+// It is an error for the section to overlap another.
+func (p *PEFile) SetSection(name string, data []byte, rva, alignment uint32) (*Section, error) {
+	size := max32(uint32(len(data)), 1)
+	s := p.Section(name)
+	if s == nil {
+		s = &Section{Name: name, Characteristics: defaultCharacteristics}
+		copy(s.rawName[:], name)
+	} else if rva == 0 {
+		rva = s.VirtualAddress
+		if alignment != 0 && rva%alignment != 0 || p.overlapping(s, rva, rva+size) != nil {
+			rva = 0
+		}
+	}
+	if rva == 0 {
+		rva = p.NextFreeAddress(s, alignment)
+	}
+	if o := p.overlapping(s, rva, rva+size); o != nil {
+		return nil, fmt.Errorf("section %s at 0x%x-0x%x overlaps section %s at 0x%x-0x%x",
+			name, rva, rva+size, o.Name, o.VirtualAddress, o.end())
+	}
+
+	if p.Section(name) == nil {
+		p.Sections = append(p.Sections, s)
+	}
+	s.VirtualAddress = rva
+	s.Data = data
+	s.VirtualSize = uint32(len(data))
+	return s, nil
+}
+
+// Bytes - return the image with the headers updated for its sections.
+func (p *PEFile) Bytes() ([]byte, error) {
+	fileAlign := p.opt.FileAlignment
+	sectAlign := p.opt.SectionAlignment
+
+	sections := make([]*Section, len(p.Sections))
+	copy(sections, p.Sections)
+	sort.SliceStable(sections, func(i, j int) bool {
+		return sections[i].VirtualAddress < sections[j].VirtualAddress
+	})
+
+	optSize := uint32(p.header.SizeOfOptionalHeader)
+	tableOffset := uint32(len(p.dos)) + 4 + coffHeaderSize + optSize
+	headersSize := align(tableOffset+uint32(len(sections))*sectionHeaderSize, fileAlign)
+	if len(sections) != 0 && headersSize > sections[0].VirtualAddress {
+		return nil, fmt.Errorf("headers of %d bytes overlap section %s at 0x%x",
+			headersSize, sections[0].Name, sections[0].VirtualAddress)
+	}
+
+	header := p.header
+	opt := p.opt
+	opt.SizeOfHeaders = headersSize
+	opt.SizeOfCode, opt.SizeOfInitializedData, opt.SizeOfUninitializedData = 0, 0, 0
+	opt.CheckSum = 0
+	// the signature is not valid once the image has changed.
+	opt.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY] = pe.DataDirectory{}
+
+	rawOffsets := make([]uint32, len(sections))
+	offset := headersSize
+	imageEnd := align(headersSize, sectAlign)
+	for i, s := range sections {
+		if i > 0 && s.VirtualAddress < sections[i-1].end() {
+			return nil, fmt.Errorf("section %s at 0x%x overlaps section %s", s.Name, s.VirtualAddress, sections[i-1].Name)
+		}
+		rawSize := align(uint32(len(s.Data)), fileAlign)
+		if rawSize != 0 {
+			rawOffsets[i] = offset
+			offset += rawSize
+		}
+		switch {
+		case s.Characteristics&pe.IMAGE_SCN_CNT_CODE != 0:
+			opt.SizeOfCode += rawSize
+		case s.Characteristics&pe.IMAGE_SCN_CNT_INITIALIZED_DATA != 0:
+			opt.SizeOfInitializedData += rawSize
+		case s.Characteristics&pe.IMAGE_SCN_CNT_UNINITIALIZED_DATA != 0:
+			opt.SizeOfUninitializedData += align(s.VirtualSize, fileAlign)
+		}
+		if end := align(s.VirtualAddress+max32(s.VirtualSize, uint32(len(s.Data))), sectAlign); end > imageEnd {
+			imageEnd = end
+		}
+	}
+	opt.SizeOfImage = imageEnd
+
+	header.NumberOfSections = uint16(len(sections))
+	if p.symbols != nil {
+		header.PointerToSymbolTable = offset
+	}
+
+	var b bytes.Buffer
+	b.Write(p.dos)
+	b.WriteString(peSignature)
+	if err := binary.Write(&b, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	var ob bytes.Buffer
+	if err := binary.Write(&ob, binary.LittleEndian, opt); err != nil {
+		return nil, err
+	}
+	b.Write(ob.Bytes()[:optSize])
+
+	for i, s := range sections {
+		sh := pe.SectionHeader32{
+			Name:             s.rawName,
+			VirtualSize:      s.VirtualSize,
+			VirtualAddress:   s.VirtualAddress,
+			SizeOfRawData:    align(uint32(len(s.Data)), fileAlign),
+			PointerToRawData: rawOffsets[i],
+			Characteristics:  s.Characteristics,
+		}
+		if err := binary.Write(&b, binary.LittleEndian, sh); err != nil {
+			return nil, err
+		}
+	}
+	b.Write(make([]byte, int(headersSize)-b.Len()))
+
+	for _, s := range sections {
+		b.Write(s.Data)
+		b.Write(make([]byte, align(uint32(len(s.Data)), fileAlign)-uint32(len(s.Data))))
+	}
+	b.Write(p.symbols)
+
+	out := b.Bytes()
+	if err := fixDebugDirectory(out, &opt, sections, rawOffsets); err != nil {
+		return nil, err
+	}
+
+	optOffset := len(p.dos) + 4 + coffHeaderSize
+	binary.LittleEndian.PutUint32(out[optOffset+optChecksumOffset:], peChecksum(out, optOffset+optChecksumOffset))
+	return out, nil
+}
+
+func max32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// fixDebugDirectory - update the file offsets in debug directory
+// entries whose data is in a section that has moved in the file.
+func fixDebugDirectory(out []byte, opt *pe.OptionalHeader64, sections []*Section, rawOffsets []uint32) error {
+	dir := opt.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_DEBUG]
+	if dir.VirtualAddress == 0 || dir.Size == 0 {
+		return nil
+	}
+
+	fileOffset := func(rva uint32) (uint32, bool) {
+		for i, s := range sections {
+			if rva >= s.VirtualAddress && rva < s.VirtualAddress+uint32(len(s.Data)) {
+				return rawOffsets[i] + rva - s.VirtualAddress, true
+			}
+		}
+		return 0, false
+	}
+
+	start, ok := fileOffset(dir.VirtualAddress)
+	if !ok || int(start+dir.Size) > len(out) {
+		return fmt.Errorf("debug directory at 0x%x is not in a section", dir.VirtualAddress)
+	}
+	for off := start; off+debugEntrySize <= start+dir.Size; off += debugEntrySize {
+		entry := out[off : off+debugEntrySize]
+		rva := binary.LittleEndian.Uint32(entry[20:])
+		if rva == 0 {
+			continue
+		}
+		if ptr, ok := fileOffset(rva); ok {
+			binary.LittleEndian.PutUint32(entry[24:], ptr)
+		}
+	}
+	return nil
+}
+
+// peChecksum - compute the image checksum, skipping the checksum field
+// at offset csOffset.
+func peChecksum(data []byte, csOffset int) uint32 {
+	var sum uint64
+	for i := 0; i < len(data); i += 2 {
+		if i == csOffset || i == csOffset+2 {
+			continue
+		}
+		w := uint64(data[i])
+		if i+1 < len(data) {
+			w |= uint64(data[i+1]) << 8
+		}
+		sum += w
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	sum = (sum & 0xffff) + (sum >> 16)
+	return uint32(sum) + uint32(len(data))
+}
+
+// WriteFile - write the image to path.
+func (p *PEFile) WriteFile(path string) error {
+	data, err := p.Bytes()
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if st, err := os.Stat(path); err == nil {
+		mode = st.Mode().Perm()
+	}
+	return os.WriteFile(path, data, mode)
+}
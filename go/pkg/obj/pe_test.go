@@ -0,0 +1,185 @@
+package obj
+
+import (
+	"bytes"
+	"debug/pe"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/project-machine/bootkit/go/pkg/obj/objtest"
+)
+
+// testPE - return a minimal PE32+ image with a .text section at 0x1000
+// and a dummy signature.
+func testPE(t *testing.T) []byte {
+	return objtest.PE(t, bytes.Repeat([]byte{0xaa}, 0x20))
+}
+
+func writeTestData(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func sectionData(t *testing.T, f *pe.File, name string) []byte {
+	t.Helper()
+	s := f.Section(name)
+	if s == nil {
+		t.Fatalf("missing section %s", name)
+	}
+	data, err := s.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data[:s.VirtualSize]
+}
+
+func TestSetSections(t *testing.T) {
+	tmpd := t.TempDir()
+	efi := writeTestData(t, tmpd, "stub.efi", testPE(t))
+	cmdline := writeTestData(t, tmpd, "cmdline", []byte("console=ttyS0"))
+	initrd := writeTestData(t, tmpd, "initrd", bytes.Repeat([]byte{1}, 0x1234))
+	vendor := writeTestData(t, tmpd, "vendor", []byte("certs"))
+
+	err := SetSections(efi,
+		SectionInput{Name: ".cmdline", VMA: 0x30000, Path: cmdline},
+		SectionInput{Name: ".initrd", VMA: 0x40000, Path: initrd},
+		SectionInput{Name: ".vendor_cert", VMA: 0x50000, Path: vendor})
+	if err != nil {
+		t.Fatalf("SetSections: %v", err)
+	}
+
+	// replace one section and remove another.
+	err = SetSections(efi,
+		SectionInput{Name: ".cmdline", Path: writeTestData(t, tmpd, "cmdline2", []byte("quiet"))},
+		SectionInput{Name: ".initrd", Remove: true})
+	if err != nil {
+		t.Fatalf("SetSections: %v", err)
+	}
+
+	data, err := os.ReadFile(efi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("debug/pe could not parse result: %v", err)
+	}
+	opt := f.OptionalHeader.(*pe.OptionalHeader64)
+
+	if len(f.Sections) != 3 {
+		t.Fatalf("found %d sections, expected 3", len(f.Sections))
+	}
+	if s := f.Section(".cmdline"); s.VirtualAddress != 0x30000 {
+		t.Errorf(".cmdline at 0x%x, expected 0x30000", s.VirtualAddress)
+	}
+	if got := string(sectionData(t, f, ".cmdline")); got != "quiet" {
+		t.Errorf(".cmdline was %q", got)
+	}
+	if got := string(sectionData(t, f, ".vendor_")); got != "certs" {
+		t.Errorf(".vendor_cert was %q", got)
+	}
+	if got := sectionData(t, f, ".text"); !bytes.Equal(got, bytes.Repeat([]byte{0xc3}, objtest.TextSize)) {
+		t.Errorf(".text was changed: % x", got)
+	}
+	for _, s := range f.Sections {
+		if s.Offset%opt.FileAlignment != 0 {
+			t.Errorf("section %s at file offset 0x%x is not aligned", s.Name, s.Offset)
+		}
+	}
+
+	if opt.SizeOfImage != 0x51000 {
+		t.Errorf("SizeOfImage was 0x%x, expected 0x51000", opt.SizeOfImage)
+	}
+	if opt.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY].Size != 0 {
+		t.Errorf("signature was not removed")
+	}
+	csOffset := 0x80 + 4 + coffHeaderSize + optChecksumOffset
+	if cs := peChecksum(data, csOffset); opt.CheckSum != cs || cs == 0 {
+		t.Errorf("CheckSum was 0x%x, expected 0x%x", opt.CheckSum, cs)
+	}
+}
+
+func TestSetSectionsErrors(t *testing.T) {
+	tmpd := t.TempDir()
+	efi := writeTestData(t, tmpd, "stub.efi", testPE(t))
+	data := writeTestData(t, tmpd, "data", []byte("data"))
+
+	for _, s := range []SectionInput{
+		{Name: ".missing", Remove: true},
+		{Name: ".missing", VMA: 0x30000},
+		{Name: ".sbat", VMA: 0x30100, Alignment: 512, Path: data},
+	} {
+		if err := SetSections(efi, s); err == nil {
+			t.Errorf("SetSections %+v succeeded", s)
+		}
+	}
+
+	if err := SetSections(writeTestData(t, tmpd, "notpe", []byte("MZ")), SectionInput{Name: ".x", Remove: true}); err == nil {
+		t.Errorf("SetSections succeeded on a file that is not PE")
+	}
+}
+
+func TestSetSectionsPlacement(t *testing.T) {
+	tmpd := t.TempDir()
+	efi := writeTestData(t, tmpd, "stub.efi", testPE(t))
+	small := writeTestData(t, tmpd, "small", []byte("small"))
+	big := writeTestData(t, tmpd, "big", bytes.Repeat([]byte{2}, 0x2345))
+
+	err := SetSections(efi,
+		SectionInput{Name: ".cmdline", Path: small},
+		SectionInput{Name: ".sbat", Alignment: 0x4000, Path: small},
+		SectionInput{Name: ".linux", Path: big},
+		SectionInput{Name: ".initrd", Path: small})
+	if err != nil {
+		t.Fatalf("SetSections: %v", err)
+	}
+
+	p, err := ReadPEFile(efi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]uint32{
+		".text":    0x1000,
+		".cmdline": 0x2000,
+		".sbat":    0x4000,
+		".linux":   0x5000,
+		".initrd":  0x8000,
+	}
+	for name, addr := range expected {
+		if s := p.Section(name); s == nil || s.VirtualAddress != addr {
+			t.Errorf("section %s: found %+v, expected address 0x%x", name, s, addr)
+		}
+	}
+
+	// .cmdline no longer fits before .sbat so it moves to the end,
+	// while .initrd fits where it is.
+	if err := SetSections(efi,
+		SectionInput{Name: ".cmdline", Path: big},
+		SectionInput{Name: ".initrd", Path: small}); err != nil {
+		t.Fatalf("SetSections: %v", err)
+	}
+	if p, err = ReadPEFile(efi); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Section(".cmdline"); s.VirtualAddress != 0x9000 {
+		t.Errorf(".cmdline at 0x%x, expected 0x9000", s.VirtualAddress)
+	}
+	if s := p.Section(".initrd"); s.VirtualAddress != 0x8000 {
+		t.Errorf(".initrd at 0x%x, expected 0x8000", s.VirtualAddress)
+	}
+
+	for _, s := range []SectionInput{
+		{Name: ".new", VMA: 0x5800, Path: small},
+		{Name: ".sbat", VMA: 0x1000},
+		{Name: ".linux", VMA: 0x4000, Path: big},
+	} {
+		if err := SetSections(efi, s); err == nil {
+			t.Errorf("SetSections %+v succeeded despite overlap", s)
+		}
+	}
+}
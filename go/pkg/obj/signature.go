@@ -0,0 +1,107 @@
+package obj
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+
+	"go.mozilla.org/pkcs7"
+)
+
+const (
+	winCertHeaderSize     = 8
+	winCertRevision       = 0x0200
+	WinCertTypePKCSSigned = 0x0002
+)
+
+// Signature - an entry in the attribute certificate table of a PE image.
+// For Authenticode signatures CertType is WinCertTypePKCSSigned and
+// Data is a PKCS#7 SignedData.
+type Signature struct {
+	Revision uint16
+	CertType uint16
+	Data     []byte
+}
+
+// Signatures - return the entries of the attribute certificate table.
+func (p *PEFile) Signatures() ([]Signature, error) {
+	sigs := []Signature{}
+	buf := p.certs
+	for len(buf) >= winCertHeaderSize {
+		length := binary.LittleEndian.Uint32(buf)
+		if length < winCertHeaderSize || int64(length) > int64(len(buf)) {
+			return nil, fmt.Errorf("bad certificate table entry length %d", length)
+		}
+		sig := Signature{
+			Revision: binary.LittleEndian.Uint16(buf[4:]),
+			CertType: binary.LittleEndian.Uint16(buf[6:]),
+			Data:     buf[winCertHeaderSize:length],
+		}
+		if sig.Revision != winCertRevision {
+			return nil, fmt.Errorf("unsupported certificate table entry revision 0x%x", sig.Revision)
+		}
+		sigs = append(sigs, sig)
+
+		// entries are padded to 8 bytes.
+		next := int(align(length, 8))
+		if next >= len(buf) {
+			break
+		}
+		buf = buf[next:]
+	}
+	return sigs, nil
+}
+
+// IsSigned - true if the image has an attribute certificate table.
+func (p *PEFile) IsSigned() bool {
+	return len(p.certs) != 0
+}
+
+// StripSignatures - remove the attribute certificate table.  Bytes
+// always does this, so it only affects Signatures and IsSigned.
+func (p *PEFile) StripSignatures() {
+	p.certs = nil
+}
+
+// Signers - return the certificates of the signers of an Authenticode
+// signature.
+func (s Signature) Signers() ([]*x509.Certificate, error) {
+	if s.CertType != WinCertTypePKCSSigned {
+		return nil, fmt.Errorf("unsupported certificate type 0x%x", s.CertType)
+	}
+	p7, err := pkcs7.Parse(s.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	signers := []*x509.Certificate{}
+	for _, si := range p7.Signers {
+		var found *x509.Certificate
+		for _, c := range p7.Certificates {
+			if c.SerialNumber.Cmp(si.IssuerAndSerialNumber.SerialNumber) == 0 &&
+				bytes.Equal(c.RawIssuer, si.IssuerAndSerialNumber.IssuerName.FullBytes) {
+				found = c
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("no certificate for signer with serial %s", si.IssuerAndSerialNumber.SerialNumber)
+		}
+		signers = append(signers, found)
+	}
+	return signers, nil
+}
+
+// Certificates - return all of the certificates included in an
+// Authenticode signature, which are the signers and any intermediates.
+func (s Signature) Certificates() ([]*x509.Certificate, error) {
+	if s.CertType != WinCertTypePKCSSigned {
+		return nil, fmt.Errorf("unsupported certificate type 0x%x", s.CertType)
+	}
+	p7, err := pkcs7.Parse(s.Data)
+	if err != nil {
+		return nil, err
+	}
+	return p7.Certificates, nil
+}
@@ -0,0 +1,52 @@
+package obj
+
+import (
+	"testing"
+
+	"github.com/project-machine/bootkit/go/pkg/obj/objtest"
+)
+
+func TestSignatures(t *testing.T) {
+	signer := objtest.NewSigner(t, "bootkit test signer")
+
+	p, err := ParsePE(testPE(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.StripSignatures()
+	unsigned, err := p.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := signer.Sign(t, unsigned)
+
+	if p, err = ParsePE(signed); err != nil {
+		t.Fatal(err)
+	}
+	sigs, err := p.Signatures()
+	if err != nil {
+		t.Fatalf("Signatures: %v", err)
+	}
+	if len(sigs) != 1 || sigs[0].CertType != WinCertTypePKCSSigned {
+		t.Fatalf("found signatures %+v", sigs)
+	}
+	signers, err := sigs[0].Signers()
+	if err != nil {
+		t.Fatalf("Signers: %v", err)
+	}
+	if len(signers) != 1 || signers[0].Subject.CommonName != "bootkit test signer" {
+		t.Errorf("unexpected signers %v", signers)
+	}
+
+	// writing the image drops the signature.
+	out, err := p.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err = ParsePE(out); err != nil {
+		t.Fatal(err)
+	}
+	if p.IsSigned() {
+		t.Errorf("signature was kept")
+	}
+}
@@ -2,41 +2,81 @@ package obj
 
 import (
 	"fmt"
-
-	"github.com/project-machine/bootkit/go/pkg/run"
+	"os"
 )
 
+// SectionInput - a change to a section of a PE image.  VMA, as with
+// objcopy --change-section-vma, includes the image base.  If VMA is
+// zero the section is placed at the next free address after the
+// existing sections, aligned to Alignment, unless it already exists
+// and its new content fits where it is.
 type SectionInput struct {
 	Name      string
 	VMA       int
 	Alignment int
 	Path      string
+	// Remove - remove the section rather than setting it.
+	Remove bool
 }
 
-func (s *SectionInput) setArgs() []string {
-	args := []string{}
-	if s.Path != "" {
-		args = append(args,
-			"--remove-section="+s.Name,
-			"--add-section="+s.Name+"="+s.Path)
+// apply - make the change described by s to p.
+func (s *SectionInput) apply(p *PEFile) error {
+	if s.Remove {
+		if !p.RemoveSection(s.Name) {
+			return fmt.Errorf("no section %s to remove", s.Name)
+		}
+		return nil
+	}
+
+	if s.Alignment != 0 && s.VMA%s.Alignment != 0 {
+		return fmt.Errorf("VMA 0x%x of section %s is not aligned to %d", s.VMA, s.Name, s.Alignment)
 	}
 
+	rva := uint32(0)
 	if s.VMA != 0 {
-		args = append(args, fmt.Sprintf("--change-section-vma=%s=0x%x", s.Name, s.VMA))
+		if uint64(s.VMA) < p.ImageBase() {
+			return fmt.Errorf("VMA 0x%x of section %s is below image base 0x%x", s.VMA, s.Name, p.ImageBase())
+		}
+		rva = uint32(uint64(s.VMA) - p.ImageBase())
 	}
-	if s.Alignment != 0 {
-		args = append(args, fmt.Sprintf("--set-section-alignment=%s=%d", s.Name, s.Alignment))
+
+	if s.Path == "" {
+		sect := p.Section(s.Name)
+		if sect == nil {
+			return fmt.Errorf("no section %s", s.Name)
+		}
+		if rva != 0 {
+			if o := p.overlapping(sect, rva, rva+sect.end()-sect.VirtualAddress); o != nil {
+				return fmt.Errorf("section %s at 0x%x overlaps section %s", s.Name, s.VMA, o.Name)
+			}
+			sect.VirtualAddress = rva
+		}
+		return nil
 	}
 
-	return args
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := p.SetSection(s.Name, data, rva, uint32(s.Alignment)); err != nil {
+		return err
+	}
+	return nil
 }
 
+// SetSections - add, replace or remove sections of the PE32+ image at
+// objpath, in place.
 func SetSections(objpath string, sections ...SectionInput) error {
-	cmd := []string{"objcopy"}
+	p, err := ReadPEFile(objpath)
+	if err != nil {
+		return err
+	}
+
 	for _, s := range sections {
-		cmd = append(cmd, s.setArgs()...)
+		if err := s.apply(p); err != nil {
+			return fmt.Errorf("%s: %w", objpath, err)
+		}
 	}
-	cmd = append(cmd, objpath)
 
-	return run.Capture(cmd...).Error()
+	return p.WriteFile(objpath)
 }
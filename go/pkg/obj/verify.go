@@ -0,0 +1,295 @@
+package obj
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+
+	efi "github.com/canonical/go-efilib"
+	"go.mozilla.org/pkcs7"
+)
+
+var digestAlgorithms = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+// digestInfo - the messageDigest of an Authenticode
+// SpcIndirectDataContent.
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+// ImageDigest - return the Authenticode digest of the PE image in data.
+func ImageDigest(data []byte, h crypto.Hash) ([]byte, error) {
+	return efi.ComputePeImageDigest(h, bytes.NewReader(data), int64(len(data)))
+}
+
+// SignedDigest - return the image digest that an Authenticode signature
+// signs, and its algorithm.
+func (s Signature) SignedDigest() (crypto.Hash, []byte, error) {
+	if s.CertType != WinCertTypePKCSSigned {
+		return 0, nil, fmt.Errorf("unsupported certificate type 0x%x", s.CertType)
+	}
+	p7, err := pkcs7.Parse(s.Data)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// p7.Content is the content of the SpcIndirectDataContent
+	// sequence: SpcAttributeTypeAndOptionalValue then DigestInfo.
+	var attr asn1.RawValue
+	rest, err := asn1.Unmarshal(p7.Content, &attr)
+	if err != nil {
+		return 0, nil, fmt.Errorf("bad SpcIndirectDataContent: %w", err)
+	}
+	var di digestInfo
+	if _, err := asn1.Unmarshal(rest, &di); err != nil {
+		return 0, nil, fmt.Errorf("bad SpcIndirectDataContent digest: %w", err)
+	}
+	h, ok := digestAlgorithms[di.Algorithm.Algorithm.String()]
+	if !ok {
+		return 0, nil, fmt.Errorf("unsupported digest algorithm %s", di.Algorithm.Algorithm)
+	}
+	return h, di.Digest, nil
+}
+
+// SignedBy - return true if cert is, or issued, a signer of s,
+// following intermediates included in the signature.  As in firmware,
+// validity times and certificate constraints are not checked.
+func (s Signature) SignedBy(cert *x509.Certificate) (bool, error) {
+	signers, err := s.Signers()
+	if err != nil {
+		return false, err
+	}
+	certs, err := s.Certificates()
+	if err != nil {
+		return false, err
+	}
+
+	issuedBy := func(c, parent *x509.Certificate) bool {
+		return bytes.Equal(c.RawIssuer, parent.RawSubject) &&
+			parent.CheckSignature(c.SignatureAlgorithm, c.RawTBSCertificate, c.Signature) == nil
+	}
+
+	for _, cur := range signers {
+		for depth := 0; cur != nil && depth <= len(certs); depth++ {
+			if cur.Equal(cert) || issuedBy(cur, cert) {
+				return true, nil
+			}
+			var next *x509.Certificate
+			for _, c := range certs {
+				if !c.Equal(cur) && issuedBy(cur, c) {
+					next = c
+					break
+				}
+			}
+			cur = next
+		}
+	}
+	return false, nil
+}
+
+// FindSigner - return the x509 entry of db that is, or issued, a signer
+// of s, or nil if there is none.
+func (s Signature) FindSigner(db efi.SignatureDatabase) (*efi.SignatureData, error) {
+	for _, l := range db {
+		if l.Type != efi.CertX509Guid {
+			continue
+		}
+		for _, sd := range l.Signatures {
+			cert, err := x509.ParseCertificate(sd.Data)
+			if err != nil {
+				continue
+			}
+			ok, err := s.SignedBy(cert)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return sd, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// FindCertHash - return the x509_sha256 entry of dbx that is the
+// SHA-256 of the to-be-signed part of a certificate of s, or nil if
+// there is none.  An x509_sha256 entry is the hash followed by the time
+// of revocation, which, as in firmware without a timestamp database, is
+// not checked.  Firmware only matches these entries in dbx.
+func (s Signature) FindCertHash(dbx efi.SignatureDatabase) (*efi.SignatureData, error) {
+	certs, err := s.Certificates()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range dbx {
+		if l.Type != efi.CertX509SHA256Guid {
+			continue
+		}
+		for _, sd := range l.Signatures {
+			if len(sd.Data) < sha256.Size {
+				continue
+			}
+			for _, c := range certs {
+				if sum := sha256.Sum256(c.RawTBSCertificate); bytes.Equal(sd.Data[:sha256.Size], sum[:]) {
+					return sd, nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// FindDigest - return the sha256 entry of db that is digest, or nil if
+// there is none.
+func FindDigest(db efi.SignatureDatabase, digest []byte) *efi.SignatureData {
+	for _, l := range db {
+		if l.Type != efi.CertSHA256Guid {
+			continue
+		}
+		for _, sd := range l.Signatures {
+			if bytes.Equal(sd.Data, digest) {
+				return sd
+			}
+		}
+	}
+	return nil
+}
+
+// Verification - the result of verifying one signature of an image.
+type Verification struct {
+	Signature Signature
+	Signers   []*x509.Certificate
+	// Err - why the signature is not valid, or nil if it is: it does
+	// not sign the digest of the image or its signature is bad.
+	Err error
+	// TrustedBy - the entry of db that allows the signature.
+	TrustedBy *efi.SignatureData
+	// RevokedBy - the entry of dbx that revokes the signature: an x509
+	// entry that is or issued a signer, or an x509_sha256 entry of one
+	// of its certificates.
+	RevokedBy *efi.SignatureData
+}
+
+// Trusted - true if the signature is valid, allowed by db and not
+// revoked by dbx.
+func (v Verification) Trusted() bool {
+	return v.Err == nil && v.TrustedBy != nil && v.RevokedBy == nil
+}
+
+// verify - verify the signature s of the image with the given digests,
+// keyed by algorithm.
+func (s Signature) verify(data []byte, digests map[crypto.Hash][]byte) error {
+	h, signed, err := s.SignedDigest()
+	if err != nil {
+		return err
+	}
+	if _, ok := digests[h]; !ok {
+		d, err := ImageDigest(data, h)
+		if err != nil {
+			return err
+		}
+		digests[h] = d
+	}
+	if !bytes.Equal(digests[h], signed) {
+		return fmt.Errorf("signed digest %x does not match image digest %x", signed, digests[h])
+	}
+
+	p7, err := pkcs7.Parse(s.Data)
+	if err != nil {
+		return err
+	}
+	return p7.Verify()
+}
+
+// ImageVerification - the result of verifying an image.
+type ImageVerification struct {
+	// Digest - the SHA-256 Authenticode digest of the image.
+	Digest []byte
+	// TrustedBy - the sha256 entry of db that allows the image.
+	TrustedBy *efi.SignatureData
+	// RevokedBy - the sha256 entry of dbx that revokes the image.
+	RevokedBy *efi.SignatureData
+	// Signatures - the result for each attached signature.
+	Signatures []Verification
+}
+
+// Trusted - true if firmware with db and dbx would start the image: it
+// is not revoked by digest, no signature is by a signer in dbx, and
+// either its digest or a valid signature is trusted.
+func (v *ImageVerification) Trusted() bool {
+	if v.RevokedBy != nil {
+		return false
+	}
+	for _, s := range v.Signatures {
+		if s.RevokedBy != nil {
+			return false
+		}
+	}
+	if v.TrustedBy != nil {
+		return true
+	}
+	for _, s := range v.Signatures {
+		if s.Trusted() {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify - verify each Authenticode signature of the PE image in data,
+// and find the entries of db and dbx that allow or revoke the image or
+// its signatures.
+func Verify(data []byte, db, dbx efi.SignatureDatabase) (*ImageVerification, error) {
+	p, err := ParsePE(data)
+	if err != nil {
+		return nil, err
+	}
+	sigs, err := p.Signatures()
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := ImageDigest(data, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	result := &ImageVerification{
+		Digest:     digest,
+		TrustedBy:  FindDigest(db, digest),
+		RevokedBy:  FindDigest(dbx, digest),
+		Signatures: []Verification{},
+	}
+
+	digests := map[crypto.Hash][]byte{crypto.SHA256: digest}
+	for _, sig := range sigs {
+		v := Verification{Signature: sig}
+		if v.Signers, v.Err = sig.Signers(); v.Err == nil {
+			v.Err = sig.verify(data, digests)
+		}
+		if v.Err == nil {
+			if v.TrustedBy, err = sig.FindSigner(db); err != nil {
+				return nil, err
+			}
+			if v.RevokedBy, err = sig.FindSigner(dbx); err != nil {
+				return nil, err
+			}
+			if v.RevokedBy == nil {
+				if v.RevokedBy, err = sig.FindCertHash(dbx); err != nil {
+					return nil, err
+				}
+			}
+		}
+		result.Signatures = append(result.Signatures, v)
+	}
+	return result, nil
+}
@@ -0,0 +1,101 @@
+package obj
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"testing"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/project-machine/bootkit/go/pkg/obj/objtest"
+)
+
+func TestVerify(t *testing.T) {
+	signer := objtest.NewSigner(t, "bootkit test signer")
+	otherSigner := objtest.NewSigner(t, "bootkit other signer")
+	cert, other := signer.Cert, otherSigner.Cert
+
+	unsigned := objtest.PE(t, nil)
+	signed := signer.Sign(t, unsigned)
+
+	v, err := Verify(signed, objtest.CertDB(other, cert), nil)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if len(v.Signatures) != 1 || v.Signatures[0].Err != nil {
+		t.Fatalf("unexpected signatures %+v", v.Signatures)
+	}
+	if !v.Trusted() || v.Signatures[0].TrustedBy == nil {
+		t.Errorf("image signed by a db cert not trusted: %+v", v)
+	}
+	if d, err := ImageDigest(unsigned, crypto.SHA256); err != nil || string(d) != string(v.Digest) {
+		t.Errorf("digest %x, expected %x (%v)", v.Digest, d, err)
+	}
+
+	if v, err = Verify(signed, objtest.CertDB(other), nil); err != nil {
+		t.Fatal(err)
+	}
+	if v.Trusted() {
+		t.Errorf("image trusted by a db without its signer")
+	}
+
+	if v, err = Verify(signed, objtest.CertDB(cert), objtest.CertDB(cert)); err != nil {
+		t.Fatal(err)
+	}
+	if v.Trusted() || v.Signatures[0].RevokedBy == nil {
+		t.Errorf("image trusted with its signer in dbx")
+	}
+
+	// dbx updates revoke certificates by the hash of their
+	// to-be-signed part, followed by the time of revocation.
+	tbs := sha256.Sum256(cert.RawTBSCertificate)
+	certHashDBX := efi.SignatureDatabase{{
+		Type:       efi.CertX509SHA256Guid,
+		Signatures: []*efi.SignatureData{{Owner: objtest.Owner, Data: append(tbs[:], make([]byte, 16)...)}},
+	}}
+	if v, err = Verify(signed, objtest.CertDB(cert), certHashDBX); err != nil {
+		t.Fatal(err)
+	}
+	if v.Trusted() || v.Signatures[0].RevokedBy == nil {
+		t.Errorf("image trusted with the hash of its signer in dbx")
+	}
+
+	// edk2 rejects an image if the signer of any signature is in dbx,
+	// even if another signature is trusted.
+	twice := otherSigner.Sign(t, signed)
+	if v, err = Verify(twice, objtest.CertDB(cert), objtest.CertDB(other)); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Signatures) != 2 || !v.Signatures[0].Trusted() || v.Signatures[1].RevokedBy == nil {
+		t.Fatalf("unexpected signatures %+v", v.Signatures)
+	}
+	if v.Trusted() {
+		t.Errorf("image trusted with the signer of another signature in dbx")
+	}
+
+	hashDB := efi.SignatureDatabase{{
+		Type:       efi.CertSHA256Guid,
+		Signatures: []*efi.SignatureData{{Owner: efi.GUID{1}, Data: v.Digest}},
+	}}
+	if v, err = Verify(unsigned, hashDB, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !v.Trusted() || v.TrustedBy == nil || len(v.Signatures) != 0 {
+		t.Errorf("unsigned image not trusted by digest: %+v", v)
+	}
+	if v, err = Verify(signed, objtest.CertDB(cert), hashDB); err != nil {
+		t.Fatal(err)
+	}
+	if v.Trusted() {
+		t.Errorf("image trusted with its digest in dbx")
+	}
+
+	// change a byte that the digest covers.
+	tampered := append([]byte{}, signed...)
+	tampered[len(unsigned)/2] ^= 0xff
+	if v, err = Verify(tampered, objtest.CertDB(cert), nil); err != nil {
+		t.Fatal(err)
+	}
+	if v.Trusted() || v.Signatures[0].Err == nil {
+		t.Errorf("tampered image verified: %+v", v.Signatures[0])
+	}
+}
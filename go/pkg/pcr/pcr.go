@@ -0,0 +1,127 @@
+// Package pcr - predict the SHA-256 TPM PCR values that firmware, shim
+// and systemd-stub measure when booting an image, so that policies
+// sealed to them can be created when the image is built.
+package pcr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"unicode/utf16"
+
+	efi "github.com/canonical/go-efilib"
+)
+
+// EventType - the type of an event in the TCG event log.
+type EventType uint32
+
+const (
+	EvIPL                        EventType = 0x0000000d
+	EvSeparator                  EventType = 0x00000004
+	EvEFIVariableDriverConfig    EventType = 0x80000001
+	EvEFIBootServicesApplication EventType = 0x80000003
+	EvEFIAction                  EventType = 0x80000007
+	EvEFIVariableAuthority       EventType = 0x800000e0
+)
+
+const (
+	digestSize    = sha256.Size
+	separatorData = "\x00\x00\x00\x00"
+	// callingEFIApplication - the EV_EFI_ACTION measured by the firmware
+	// before it starts the first boot option.
+	callingEFIApplication = "Calling EFI Application from Boot Option"
+)
+
+var eventTypeNames = map[EventType]string{
+	EvIPL:                        "EV_IPL",
+	EvSeparator:                  "EV_SEPARATOR",
+	EvEFIVariableDriverConfig:    "EV_EFI_VARIABLE_DRIVER_CONFIG",
+	EvEFIBootServicesApplication: "EV_EFI_BOOT_SERVICES_APPLICATION",
+	EvEFIAction:                  "EV_EFI_ACTION",
+	EvEFIVariableAuthority:       "EV_EFI_VARIABLE_AUTHORITY",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "EV_UNKNOWN"
+}
+
+func (t EventType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// Digest - a SHA-256 digest, shown as hex.
+type Digest []byte
+
+func (d Digest) String() string {
+	return hex.EncodeToString(d)
+}
+
+func (d Digest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Event - a measurement into a PCR.
+type Event struct {
+	PCR         int       `json:"pcr"`
+	Type        EventType `json:"type"`
+	Description string    `json:"description"`
+	Digest      Digest    `json:"digest"`
+}
+
+// Log - events in the order they are measured.
+type Log []Event
+
+// Extend - return the value of a PCR with value pcr after extending it
+// with digest.
+func Extend(pcr, digest []byte) []byte {
+	h := sha256.New()
+	h.Write(pcr)
+	h.Write(digest)
+	return h.Sum(nil)
+}
+
+// PCRs - return the value of each PCR in the log, starting from zero.
+func (l Log) PCRs() map[int]Digest {
+	pcrs := map[int]Digest{}
+	for _, e := range l {
+		cur, ok := pcrs[e.PCR]
+		if !ok {
+			cur = make([]byte, digestSize)
+		}
+		pcrs[e.PCR] = Extend(cur, e.Digest)
+	}
+	return pcrs
+}
+
+func sum(data []byte) Digest {
+	s := sha256.Sum256(data)
+	return s[:]
+}
+
+// variableData - return the UEFI_VARIABLE_DATA structure that is
+// measured for a variable.
+func variableData(name string, guid efi.GUID, data []byte) []byte {
+	unicode := utf16.Encode([]rune(name))
+	var b bytes.Buffer
+	b.Write(guid[:])
+	binary.Write(&b, binary.LittleEndian, uint64(len(unicode)))
+	binary.Write(&b, binary.LittleEndian, uint64(len(data)))
+	binary.Write(&b, binary.LittleEndian, unicode)
+	b.Write(data)
+	return b.Bytes()
+}
+
+// variableEvent - return the event measuring a variable.
+func variableEvent(pcr int, t EventType, name string, guid efi.GUID, data []byte) Event {
+	return Event{PCR: pcr, Type: t, Description: name, Digest: sum(variableData(name, guid, data))}
+}
+
+// separatorEvent - return the separator event for pcr.
+func separatorEvent(pcr int) Event {
+	return Event{PCR: pcr, Type: EvSeparator, Description: "separator", Digest: sum([]byte(separatorData))}
+}
@@ -0,0 +1,270 @@
+package pcr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/project-machine/bootkit/go/pkg/firmware"
+	"github.com/project-machine/bootkit/go/pkg/obj"
+	"github.com/project-machine/bootkit/go/pkg/obj/objtest"
+	"github.com/project-machine/bootkit/go/pkg/shim"
+)
+
+// writeImage - write data to dir/name, run edit on it if not nil, sign
+// it with signer if not nil and return it as an Image.
+func writeImage(t *testing.T, dir, name string, data []byte, edit func(path string) error, signer *objtest.Signer) *Image {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if edit != nil {
+		if err := edit(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if signer != nil {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, signer.Sign(t, data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	i, err := ReadImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func testVars(t *testing.T, pk, kek, db efi.SignatureDatabase) firmware.VarStore {
+	t.Helper()
+	vars := firmware.VarStore{}
+	for _, v := range []struct {
+		name string
+		guid efi.GUID
+		db   efi.SignatureDatabase
+	}{
+		{"PK", efi.GlobalVariable, pk},
+		{"KEK", efi.GlobalVariable, kek},
+		{"db", efi.ImageSecurityDatabaseGuid, db},
+	} {
+		if v.db == nil {
+			continue
+		}
+		data, err := v.db.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars = append(vars, firmware.Variable{Name: v.name, GUID: v.guid, Data: data})
+	}
+	return vars
+}
+
+func eventNames(l Log) []string {
+	names := []string{}
+	for _, e := range l {
+		names = append(names, e.Type.String()+":"+e.Description)
+	}
+	return names
+}
+
+func checkNames(t *testing.T, l Log, expected ...string) {
+	t.Helper()
+	names := eventNames(l)
+	if len(names) != len(expected) {
+		t.Fatalf("found events %v, expected %v", names, expected)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("event %d was %s, expected %s", i, names[i], expected[i])
+		}
+	}
+}
+
+// TestKnownDigests - digests that appear in the event log of every
+// boot with OVMF.
+func TestKnownDigests(t *testing.T) {
+	for _, test := range []struct {
+		event    Event
+		expected string
+	}{
+		{separatorEvent(7), "df3f619804a92fdb4057192dc43dd748ea778adc52bc498ce80524c014b81119"},
+		{variableEvent(7, EvEFIVariableDriverConfig, "SecureBoot", efi.GlobalVariable, []byte{1}),
+			"ccfc4bb32888a345bc8aeadaba552b627d99348c767681ab3141f5b01e40a40e"},
+		{variableEvent(7, EvEFIVariableDriverConfig, "SecureBoot", efi.GlobalVariable, []byte{0}),
+			"115aa827dbccfb44d216ad9ecfda56bdea620b860a94bed5b7a27bba1c4d02d8"},
+		{variableEvent(7, EvEFIVariableDriverConfig, "PK", efi.GlobalVariable, nil),
+			"dea7b80ab53a3daaa24d5cc46c64e1fa9ffd03739f90aadbd8c0867c4a5b4890"},
+	} {
+		if got := test.event.Digest.String(); got != test.expected {
+			t.Errorf("%s digest was %s, expected %s", test.event.Description, got, test.expected)
+		}
+	}
+
+	l, err := BootManagerCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l[0].Digest.String(); got != "3d6772b4f84ed47595d72a2c4c5ffd15f5bb72c7507fe26f2aaee2c69d5633ba" {
+		t.Errorf("EV_EFI_ACTION digest was %s", got)
+	}
+}
+
+func TestLogPCRs(t *testing.T) {
+	a, b := sum([]byte("a")), sum([]byte("b"))
+	l := Log{{PCR: 4, Digest: a}, {PCR: 7, Digest: b}, {PCR: 4, Digest: b}}
+
+	zero := make([]byte, sha256.Size)
+	expected4 := Extend(Extend(zero, a), b)
+	pcrs := l.PCRs()
+	if !bytes.Equal(pcrs[4], expected4) {
+		t.Errorf("PCR 4 was %s, expected %x", pcrs[4], expected4)
+	}
+	if !bytes.Equal(pcrs[7], Extend(zero, b)) {
+		t.Errorf("PCR 7 was %s", pcrs[7])
+	}
+	if len(pcrs) != 2 {
+		t.Errorf("found %d PCRs, expected 2", len(pcrs))
+	}
+}
+
+func TestUKISections(t *testing.T) {
+	tmpd := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(tmpd, name)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	uki := writeImage(t, tmpd, "uki.efi", objtest.PE(t, nil), func(path string) error {
+		return obj.SetSections(path,
+			obj.SectionInput{Name: ".cmdline", Path: write("cmdline", "quiet")},
+			obj.SectionInput{Name: ".pcrsig", Path: write("pcrsig", "{}")},
+			obj.SectionInput{Name: ".linux", Path: write("linux", "kernel")})
+	}, nil)
+
+	l := UKISections(uki)
+	checkNames(t, l, "EV_IPL:.linux", "EV_IPL:.linux", "EV_IPL:.cmdline", "EV_IPL:.cmdline")
+	if !bytes.Equal(l[0].Digest, sum([]byte(".linux\x00"))) {
+		t.Errorf(".linux name digest was %s", l[0].Digest)
+	}
+	if !bytes.Equal(l[3].Digest, sum([]byte("quiet"))) {
+		t.Errorf(".cmdline digest was %s", l[3].Digest)
+	}
+}
+
+func TestSecureBootPolicy(t *testing.T) {
+	tmpd := t.TempDir()
+	platform := objtest.NewSigner(t, "platform")
+	dbSigner := objtest.NewSigner(t, "db")
+	vendor := objtest.NewSigner(t, "vendor")
+	other := objtest.NewSigner(t, "other")
+
+	var vendorCert bytes.Buffer
+	if err := shim.VendorDBSectionWrite(&vendorCert, objtest.CertDB(vendor.Cert), efi.SignatureDatabase{}); err != nil {
+		t.Fatal(err)
+	}
+	shimImage := writeImage(t, tmpd, "shim.efi", objtest.PE(t, nil), func(path string) error {
+		p := filepath.Join(tmpd, "vendor_cert")
+		if err := os.WriteFile(p, vendorCert.Bytes(), 0644); err != nil {
+			return err
+		}
+		return obj.SetSections(path, obj.SectionInput{Name: ".vendor_cert", Path: p})
+	}, dbSigner)
+	kernel := writeImage(t, tmpd, "kernel.efi", objtest.PE(t, nil), nil, vendor)
+	vars := testVars(t, objtest.CertDB(platform.Cert), objtest.CertDB(platform.Cert), objtest.CertDB(dbSigner.Cert))
+
+	l, err := SecureBootPolicy(vars, shimImage, kernel, []byte("sbat,1,2023012900\n"))
+	if err != nil {
+		t.Fatalf("SecureBootPolicy: %v", err)
+	}
+	checkNames(t, l,
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:SecureBoot",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:PK",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:KEK",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:db",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:dbx",
+		"EV_SEPARATOR:separator",
+		"EV_EFI_VARIABLE_AUTHORITY:db",
+		"EV_EFI_VARIABLE_AUTHORITY:SbatLevel",
+		"EV_EFI_VARIABLE_AUTHORITY:vendor_db")
+
+	var sd bytes.Buffer
+	(&efi.SignatureData{Owner: objtest.Owner, Data: dbSigner.Cert.Raw}).Write(&sd)
+	if expected := sum(variableData("db", efi.ImageSecurityDatabaseGuid, sd.Bytes())); !bytes.Equal(l[6].Digest, expected) {
+		t.Errorf("db authority digest was %s, expected %s", l[6].Digest, expected)
+	}
+
+	// a shim built with VENDOR_CERT_FILE measures its certificate as
+	// Shim rather than a vendor_db entry.
+	certShim := writeImage(t, tmpd, "cert-shim.efi", objtest.PE(t, nil), func(path string) error {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, []uint32{uint32(len(vendor.Cert.Raw)), 0, 16, 16 + uint32(len(vendor.Cert.Raw))})
+		b.Write(vendor.Cert.Raw)
+		p := filepath.Join(tmpd, "cert_vendor_cert")
+		if err := os.WriteFile(p, b.Bytes(), 0644); err != nil {
+			return err
+		}
+		return obj.SetSections(path, obj.SectionInput{Name: ".vendor_cert", Path: p})
+	}, dbSigner)
+	if l, err = SecureBootPolicy(vars, certShim, kernel, nil); err != nil {
+		t.Fatalf("SecureBootPolicy: %v", err)
+	}
+	checkNames(t, l,
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:SecureBoot",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:PK",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:KEK",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:db",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:dbx",
+		"EV_SEPARATOR:separator",
+		"EV_EFI_VARIABLE_AUTHORITY:db",
+		"EV_EFI_VARIABLE_AUTHORITY:Shim")
+	if expected := sum(variableData("Shim", ShimLockGUID, vendor.Cert.Raw)); !bytes.Equal(l[7].Digest, expected) {
+		t.Errorf("Shim authority digest was %s, expected %s", l[7].Digest, expected)
+	}
+
+	// firmware and shim each measure a db entry once, so a kernel
+	// allowed by the db entry that allowed shim is measured again.
+	dbKernel := writeImage(t, tmpd, "db-kernel.efi", objtest.PE(t, nil), nil, dbSigner)
+	if l, err = SecureBootPolicy(vars, shimImage, dbKernel, nil); err != nil {
+		t.Fatalf("SecureBootPolicy: %v", err)
+	}
+	checkNames(t, l,
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:SecureBoot",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:PK",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:KEK",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:db",
+		"EV_EFI_VARIABLE_DRIVER_CONFIG:dbx",
+		"EV_SEPARATOR:separator",
+		"EV_EFI_VARIABLE_AUTHORITY:db",
+		"EV_EFI_VARIABLE_AUTHORITY:db")
+	if !bytes.Equal(l[6].Digest, l[7].Digest) {
+		t.Errorf("firmware and shim measured different db entries")
+	}
+
+	// the firmware starting a kernel that only shim allows.
+	if _, err := SecureBootPolicy(vars, nil, kernel, nil); err == nil {
+		t.Errorf("SecureBootPolicy succeeded with a kernel not allowed by db")
+	}
+	otherKernel := writeImage(t, tmpd, "other-kernel.efi", objtest.PE(t, nil), nil, other)
+	if _, err := SecureBootPolicy(vars, shimImage, otherKernel, nil); err == nil {
+		t.Errorf("SecureBootPolicy succeeded with a kernel not allowed by db or shim")
+	}
+
+	// with no PK secure boot is disabled, so nothing is verified.
+	if l, err = SecureBootPolicy(testVars(t, nil, nil, nil), nil, otherKernel, nil); err != nil {
+		t.Fatalf("SecureBootPolicy: %v", err)
+	}
+	if len(l) != 6 || l[0].Digest.String() != "115aa827dbccfb44d216ad9ecfda56bdea620b860a94bed5b7a27bba1c4d02d8" {
+		t.Errorf("found events %v", eventNames(l))
+	}
+}
@@ -0,0 +1,339 @@
+package pcr
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/project-machine/bootkit/go/pkg/firmware"
+	"github.com/project-machine/bootkit/go/pkg/obj"
+	"github.com/project-machine/bootkit/go/pkg/shim"
+)
+
+const (
+	// PCRBootManagerCode - PCR 4, the EFI applications that are started.
+	PCRBootManagerCode = 4
+	// PCRSecureBootPolicy - PCR 7, the secure boot variables and the
+	// entries of them that allowed each application.
+	PCRSecureBootPolicy = 7
+	// PCRKernelBoot - PCR 11, the sections of a unified kernel image,
+	// as measured by systemd-stub.
+	PCRKernelBoot = 11
+)
+
+// ShimLockGUID - the vendor guid of shim's variables.
+var ShimLockGUID = efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabbd, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23})
+
+// ukiMeasuredSections - the sections of a unified kernel image that
+// systemd-stub measures, in the order that it measures them.  .pcrsig
+// is not measured, as it holds signatures of the result.
+var ukiMeasuredSections = []string{
+	".linux", ".osrel", ".cmdline", ".initrd", ".splash", ".dtb", ".uname", ".sbat", ".pcrpkey",
+}
+
+// Image - an EFI application.
+type Image struct {
+	Name string
+	Data []byte
+	pe   *obj.PEFile
+}
+
+// ReadImage - read the EFI application at path.
+func ReadImage(path string) (*Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := obj.ParsePE(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &Image{Name: filepath.Base(path), Data: data, pe: p}, nil
+}
+
+// digest - return the Authenticode digest of the image.
+func (i *Image) digest() ([]byte, error) {
+	d, err := obj.ImageDigest(i.Data, crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed computing digest of %s: %w", i.Name, err)
+	}
+	return d, nil
+}
+
+// BootManagerCode - return the events that the firmware measures into
+// PCR 4 when it starts the first boot option and the images are loaded
+// in order, the first by the firmware and any others by shim.
+func BootManagerCode(images ...*Image) (Log, error) {
+	log := Log{
+		{PCR: PCRBootManagerCode, Type: EvEFIAction, Description: callingEFIApplication, Digest: sum([]byte(callingEFIApplication))},
+		separatorEvent(PCRBootManagerCode),
+	}
+	for _, i := range images {
+		d, err := i.digest()
+		if err != nil {
+			return nil, err
+		}
+		log = append(log, Event{PCR: PCRBootManagerCode, Type: EvEFIBootServicesApplication, Description: i.Name, Digest: d})
+	}
+	return log, nil
+}
+
+// allowedBy - return the entry of db that allows image: a certificate
+// that signed it or the digest of it.  It returns nil if there is none.
+func allowedBy(image *Image, db efi.SignatureDatabase) (*efi.SignatureData, error) {
+	sigs, err := image.pe.Signatures()
+	if err != nil {
+		return nil, err
+	}
+	for _, sig := range sigs {
+		sd, err := sig.FindSigner(db)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", image.Name, err)
+		}
+		if sd != nil {
+			return sd, nil
+		}
+	}
+
+	digest, err := image.digest()
+	if err != nil {
+		return nil, err
+	}
+	return obj.FindDigest(db, digest), nil
+}
+
+// authorityLog - the EV_EFI_VARIABLE_AUTHORITY events of PCR 7 that
+// one of firmware or shim measures.  Each measures an entry only once,
+// but keeps its own record of what it measured, so shim measures an
+// entry again if the firmware already did.
+type authorityLog struct {
+	log      Log
+	measured map[string]bool
+}
+
+func newAuthorityLog() *authorityLog {
+	return &authorityLog{measured: map[string]bool{}}
+}
+
+func (a *authorityLog) add(name string, guid efi.GUID, data []byte) {
+	e := variableEvent(PCRSecureBootPolicy, EvEFIVariableAuthority, name, guid, data)
+	if a.measured[e.Digest.String()] {
+		return
+	}
+	a.measured[e.Digest.String()] = true
+	a.log = append(a.log, e)
+}
+
+func (a *authorityLog) addSignatureData(name string, guid efi.GUID, sd *efi.SignatureData) error {
+	var b bytes.Buffer
+	if err := sd.Write(&b); err != nil {
+		return err
+	}
+	a.add(name, guid, b.Bytes())
+	return nil
+}
+
+// addVendorCert - add the event that shimImage measures when its
+// .vendor_cert allows kernel.  That is the EFI_SIGNATURE_DATA of the
+// vendor_db entry, or the certificate itself as "Shim" if shim was built
+// with a single vendor certificate.
+func (a *authorityLog) addVendorCert(shimImage, kernel *Image) error {
+	s := shimImage.pe.Section(".vendor_cert")
+	if s == nil {
+		return fmt.Errorf("%s is not allowed by db and %s has no .vendor_cert", kernel.Name, shimImage.Name)
+	}
+	vendorDB, _, err := shim.ParseVendorDB(s.Content())
+	if err != nil {
+		return fmt.Errorf("%s: %w", shimImage.Name, err)
+	}
+	sd, err := allowedBy(kernel, vendorDB)
+	if err != nil {
+		return err
+	}
+	if sd == nil {
+		return fmt.Errorf("%s is not allowed by db or the .vendor_cert of %s", kernel.Name, shimImage.Name)
+	}
+	cert, err := shim.VendorCert(s.Content())
+	if err != nil {
+		return fmt.Errorf("%s: %w", shimImage.Name, err)
+	}
+	if cert != nil {
+		a.add("Shim", ShimLockGUID, cert)
+		return nil
+	}
+	return a.addSignatureData("vendor_db", efi.ImageSecurityDatabaseGuid, sd)
+}
+
+// SecureBootPolicy - return the events measured into PCR 7 when booting
+// with the variables in vars.  If shimImage is not nil, the firmware
+// starts it and it starts kernel, allowing it by the firmware db or its
+// own .vendor_cert; otherwise the firmware starts kernel.  If sbatLevel
+// is not nil it is the SbatLevel that shim measures.
+//
+// If secure boot is not enabled, because vars has no PK, only the
+// variables are measured.
+func SecureBootPolicy(vars firmware.VarStore, shimImage, kernel *Image, sbatLevel []byte) (Log, error) {
+	secureBoot := []byte{0}
+	if pk := vars.Get("PK", efi.GlobalVariable); pk != nil && len(pk.Data) != 0 {
+		secureBoot[0] = 1
+	}
+	log := Log{variableEvent(PCRSecureBootPolicy, EvEFIVariableDriverConfig, "SecureBoot", efi.GlobalVariable, secureBoot)}
+	for _, v := range []struct {
+		name string
+		guid efi.GUID
+	}{
+		{"PK", efi.GlobalVariable},
+		{"KEK", efi.GlobalVariable},
+		{"db", efi.ImageSecurityDatabaseGuid},
+		{"dbx", efi.ImageSecurityDatabaseGuid},
+		{"dbt", efi.ImageSecurityDatabaseGuid},
+	} {
+		data := []byte{}
+		if found := vars.Get(v.name, v.guid); found != nil {
+			data = found.Data
+		} else if v.name == "dbt" {
+			// dbt is measured only if it is set.
+			continue
+		}
+		log = append(log, variableEvent(PCRSecureBootPolicy, EvEFIVariableDriverConfig, v.name, v.guid, data))
+	}
+	log = append(log, separatorEvent(PCRSecureBootPolicy))
+
+	if secureBoot[0] == 0 {
+		return log, nil
+	}
+
+	db, err := vars.SignatureDatabase("db")
+	if err != nil {
+		return nil, err
+	}
+
+	first := kernel
+	if shimImage != nil {
+		first = shimImage
+	}
+	sd, err := allowedBy(first, db)
+	if err != nil {
+		return nil, err
+	}
+	if sd == nil {
+		return nil, fmt.Errorf("%s is not allowed by db", first.Name)
+	}
+	fw := newAuthorityLog()
+	if err := fw.addSignatureData("db", efi.ImageSecurityDatabaseGuid, sd); err != nil {
+		return nil, err
+	}
+	log = append(log, fw.log...)
+
+	if shimImage != nil {
+		a := newAuthorityLog()
+		if sbatLevel != nil {
+			a.add("SbatLevel", ShimLockGUID, sbatLevel)
+		}
+
+		// shim checks the firmware db before its own.
+		if sd, err = allowedBy(kernel, db); err != nil {
+			return nil, err
+		}
+		if sd != nil {
+			err = a.addSignatureData("db", efi.ImageSecurityDatabaseGuid, sd)
+		} else {
+			err = a.addVendorCert(shimImage, kernel)
+		}
+		if err != nil {
+			return nil, err
+		}
+		log = append(log, a.log...)
+	}
+
+	return log, nil
+}
+
+// sectionContent - return the content of a section as loaded, which
+// is zero filled if the virtual size is larger than the data.
+func sectionContent(s *obj.Section) []byte {
+	content := s.Content()
+	if int(s.VirtualSize) > len(content) {
+		content = append(append([]byte{}, content...), make([]byte, int(s.VirtualSize)-len(content))...)
+	}
+	return content
+}
+
+// UKISections - return the events that systemd-stub measures into
+// PCR 11 for the unified kernel image uki: the name, including the
+// terminating NUL, and then the content of each section.
+func UKISections(uki *Image) Log {
+	log := Log{}
+	for _, name := range ukiMeasuredSections {
+		s := uki.pe.Section(name)
+		if s == nil {
+			continue
+		}
+		content := sectionContent(s)
+		if len(content) == 0 {
+			continue
+		}
+		log = append(log,
+			Event{PCR: PCRKernelBoot, Type: EvIPL, Description: name, Digest: sum([]byte(name + "\x00"))},
+			Event{PCR: PCRKernelBoot, Type: EvIPL, Description: name, Digest: sum(content)})
+	}
+	return log
+}
+
+// Options - the boot chain for Predict.
+type Options struct {
+	// Shim - the path of shim.efi, or empty if the firmware starts
+	// Kernel itself.
+	Shim string
+	// Kernel - the path of kernel.efi, a unified kernel image.
+	Kernel string
+	// Vars - the path of the OVMF vars file.
+	Vars string
+	// SbatLevel - if not nil, the SbatLevel that shim measures.
+	SbatLevel []byte
+}
+
+// Prediction - the predicted values of PCRs 4, 7 and 11, and the events
+// that give them.
+type Prediction struct {
+	PCRs map[int]Digest `json:"pcrs"`
+	Log  Log            `json:"log"`
+}
+
+// Predict - return the values of PCRs 4, 7 and 11 after booting the
+// chain in opts, up to the point that the kernel starts.
+func Predict(opts Options) (*Prediction, error) {
+	kernel, err := ReadImage(opts.Kernel)
+	if err != nil {
+		return nil, err
+	}
+	images := []*Image{kernel}
+
+	var shimImage *Image
+	if opts.Shim != "" {
+		if shimImage, err = ReadImage(opts.Shim); err != nil {
+			return nil, err
+		}
+		images = []*Image{shimImage, kernel}
+	}
+
+	vars, err := firmware.ReadOVMFVars(opts.Vars)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := BootManagerCode(images...)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := SecureBootPolicy(vars, shimImage, kernel, opts.SbatLevel)
+	if err != nil {
+		return nil, err
+	}
+	log = append(append(log, policy...), UKISections(kernel)...)
+
+	return &Prediction{PCRs: log.PCRs(), Log: log}, nil
+}
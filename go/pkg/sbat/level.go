@@ -0,0 +1,113 @@
+package sbat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Revocation - an entry of a revocation level: images with an entry
+// for Component with a lower generation are refused.
+type Revocation struct {
+	Component  string `json:"component"`
+	Generation int    `json:"generation"`
+}
+
+// Level - a revocation level, as in shim's SbatLevel variable:
+//
+//	sbat,1,2022052400
+//	grub,2
+//
+// The first line is the 'sbat' revocation, with a datestamp.
+type Level struct {
+	Datestamp   string       `json:"datestamp"`
+	Revocations []Revocation `json:"revocations"`
+}
+
+// ParseLevel - parse a revocation level as written to SbatLevel.
+func ParseLevel(data []byte) (*Level, error) {
+	l := &Level{}
+	for i, line := range lines(data) {
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: found %d fields in %q, expected at least 2", i+1, len(fields), line)
+		}
+		gen, err := parseGeneration(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: component %s: %w", i+1, fields[0], err)
+		}
+		if i == 0 {
+			if fields[0] != HeaderComponent {
+				return nil, fmt.Errorf("first entry must be '%s', found '%s'", HeaderComponent, fields[0])
+			}
+			if len(fields) > 2 {
+				l.Datestamp = fields[2]
+			}
+		}
+		l.Revocations = append(l.Revocations, Revocation{Component: fields[0], Generation: gen})
+	}
+	if len(l.Revocations) == 0 {
+		return nil, fmt.Errorf("no sbat level entries")
+	}
+	return l, nil
+}
+
+// RevokedError - returned by Check when shim would refuse an image.
+type RevokedError struct {
+	// Revoked - the entries of the image with a generation lower than
+	// that of the level.
+	Revoked []Entry
+	Level   *Level
+}
+
+func (e *RevokedError) Error() string {
+	msgs := []string{}
+	for _, r := range e.Revoked {
+		msgs = append(msgs, fmt.Sprintf("%s generation %d is revoked by level %d",
+			r.Component, r.Generation, e.Level.Generation(r.Component)))
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// Generation - return the lowest generation of component that l
+// allows, or 0 if it has no revocation for component.
+func (l *Level) Generation(component string) int {
+	gen := 0
+	for _, r := range l.Revocations {
+		if r.Component == component && r.Generation > gen {
+			gen = r.Generation
+		}
+	}
+	return gen
+}
+
+// Check - return a *RevokedError if shim with revocation level l would
+// refuse an image with SBAT s, because some component in s has a
+// generation lower than l requires.  As in shim, an image with no SBAT
+// is refused too.
+func (l *Level) Check(s SBAT) error {
+	if len(s) == 0 {
+		return fmt.Errorf("no sbat entries")
+	}
+	revoked := []Entry{}
+	for _, e := range s {
+		if e.Generation < l.Generation(e.Component) {
+			revoked = append(revoked, e)
+		}
+	}
+	if len(revoked) != 0 {
+		return &RevokedError{Revoked: revoked, Level: l}
+	}
+	return nil
+}
+
+func (l *Level) String() string {
+	var b strings.Builder
+	for i, r := range l.Revocations {
+		fmt.Fprintf(&b, "%s,%d", r.Component, r.Generation)
+		if i == 0 && l.Datestamp != "" {
+			fmt.Fprintf(&b, ",%s", l.Datestamp)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
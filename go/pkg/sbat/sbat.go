@@ -0,0 +1,200 @@
+// Package sbat - parse, validate and check SBAT (Secure Boot Advanced
+// Targeting) data as described at
+// https://github.com/rhboot/shim/blob/main/SBAT.md
+package sbat
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Entry - one line of the .sbat section of an image.
+type Entry struct {
+	Component     string `json:"component"`
+	Generation    int    `json:"generation"`
+	VendorName    string `json:"vendor_name"`
+	VendorPackage string `json:"vendor_package"`
+	VendorVersion string `json:"vendor_version"`
+	VendorURL     string `json:"vendor_url"`
+}
+
+// entryFields - the number of fields in an Entry.
+const entryFields = 6
+
+// HeaderComponent - the component of the mandatory first entry, which
+// gives the version of the SBAT format.
+const HeaderComponent = "sbat"
+
+// Header - the mandatory first entry of SBAT data.
+var Header = Entry{
+	Component:     HeaderComponent,
+	Generation:    1,
+	VendorName:    "SBAT Version",
+	VendorPackage: "sbat",
+	VendorVersion: "1",
+	VendorURL:     "https://github.com/rhboot/shim/blob/main/SBAT.md",
+}
+
+// SBAT - the entries of the .sbat section of an image, in order.
+type SBAT []Entry
+
+// Default - the SBAT of the unified kernel images that we build.
+var Default = SBAT{
+	Header,
+	{"stubby.puzzleos", 2, "PuzzleOS", "stubby", "1", "https://github.com/puzzleos/stubby"},
+	{"linux.puzzleos", 1, "PuzzleOS", "linux", "1", "NOURL"},
+}
+
+// parseGeneration - parse a generation, which must be a positive integer.
+func parseGeneration(s string) (int, error) {
+	gen, err := strconv.Atoi(s)
+	if err != nil || gen < 1 {
+		return 0, fmt.Errorf("invalid generation %q", s)
+	}
+	return gen, nil
+}
+
+// ParseEntry - parse a line of SBAT csv, like
+// 'linux.puzzleos,1,PuzzleOS,linux,1,NOURL'.  As in shim, the last
+// field is the remainder of the line.
+func ParseEntry(line string) (Entry, error) {
+	fields := strings.SplitN(line, ",", entryFields)
+	if len(fields) != entryFields {
+		return Entry{}, fmt.Errorf("found %d fields in %q, expected %d", len(fields), line, entryFields)
+	}
+	if fields[0] == "" {
+		return Entry{}, fmt.Errorf("empty component name in %q", line)
+	}
+	gen, err := parseGeneration(fields[1])
+	if err != nil {
+		return Entry{}, fmt.Errorf("component %s: %w", fields[0], err)
+	}
+	return Entry{
+		Component:     fields[0],
+		Generation:    gen,
+		VendorName:    fields[2],
+		VendorPackage: fields[3],
+		VendorVersion: fields[4],
+		VendorURL:     fields[5],
+	}, nil
+}
+
+// lines - return the non-empty lines of data, ignoring anything after
+// a NUL as the content of a section is padded with them.
+func lines(data []byte) []string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	found := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line != "" {
+			found = append(found, line)
+		}
+	}
+	return found
+}
+
+// Parse - parse SBAT csv data and validate it.
+func Parse(data []byte) (SBAT, error) {
+	s := SBAT{}
+	for i, line := range lines(data) {
+		e, err := ParseEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		s = append(s, e)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate - check that s starts with the 'sbat,1' header, and that
+// no component appears twice.
+func (s SBAT) Validate() error {
+	if len(s) == 0 {
+		return fmt.Errorf("no sbat entries")
+	}
+	if s[0].Component != HeaderComponent || s[0].Generation != Header.Generation {
+		return fmt.Errorf("first entry must be '%s,%d', found '%s,%d'",
+			HeaderComponent, Header.Generation, s[0].Component, s[0].Generation)
+	}
+	seen := map[string]bool{}
+	for _, e := range s {
+		if e.Component == "" {
+			return fmt.Errorf("entry with empty component name")
+		}
+		if e.Generation < 1 {
+			return fmt.Errorf("component %s: invalid generation %d", e.Component, e.Generation)
+		}
+		for _, f := range []string{e.Component, e.VendorName, e.VendorPackage, e.VendorVersion, e.VendorURL} {
+			if strings.ContainsAny(f, "\n\x00") {
+				return fmt.Errorf("component %s: field %q contains a newline or NUL", e.Component, f)
+			}
+		}
+		if strings.Contains(e.Component, ",") {
+			return fmt.Errorf("component %q contains a comma", e.Component)
+		}
+		if seen[e.Component] {
+			return fmt.Errorf("component %s appears more than once", e.Component)
+		}
+		seen[e.Component] = true
+	}
+	return nil
+}
+
+// Entry - return the entry for component, or nil if there is none.
+func (s SBAT) Entry(component string) *Entry {
+	for i := range s {
+		if s[i].Component == component {
+			return &s[i]
+		}
+	}
+	return nil
+}
+
+// Merge - return a copy of s in which each of entries replaces the
+// entry for the same component, or is appended if there is none.
+func (s SBAT) Merge(entries ...Entry) SBAT {
+	merged := append(SBAT{}, s...)
+	for _, e := range entries {
+		if cur := merged.Entry(e.Component); cur != nil {
+			*cur = e
+		} else {
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
+// Bump - return a copy of s with the generation of component
+// incremented.
+func (s SBAT) Bump(component string) (SBAT, error) {
+	bumped := append(SBAT{}, s...)
+	e := bumped.Entry(component)
+	if e == nil {
+		return nil, fmt.Errorf("no sbat entry for component %s", component)
+	}
+	e.Generation++
+	return bumped, nil
+}
+
+func (e Entry) String() string {
+	return strings.Join([]string{
+		e.Component, strconv.Itoa(e.Generation), e.VendorName,
+		e.VendorPackage, e.VendorVersion, e.VendorURL}, ",")
+}
+
+// String - return s as csv, one line per entry.
+func (s SBAT) String() string {
+	var b strings.Builder
+	for _, e := range s {
+		b.WriteString(e.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
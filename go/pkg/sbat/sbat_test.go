@@ -0,0 +1,126 @@
+package sbat
+
+import (
+	"errors"
+	"testing"
+)
+
+const defaultCSV = `sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md
+stubby.puzzleos,2,PuzzleOS,stubby,1,https://github.com/puzzleos/stubby
+linux.puzzleos,1,PuzzleOS,linux,1,NOURL
+`
+
+func TestParse(t *testing.T) {
+	// section content is padded with NULs.
+	s, err := Parse([]byte(defaultCSV + "\x00\x00\x00"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(s) != 3 {
+		t.Fatalf("found %d entries, expected 3", len(s))
+	}
+	if e := s.Entry("stubby.puzzleos"); e == nil || e.Generation != 2 || e.VendorURL != "https://github.com/puzzleos/stubby" {
+		t.Errorf("stubby.puzzleos entry was %+v", e)
+	}
+	if got := s.String(); got != defaultCSV {
+		t.Errorf("String() was %q, expected %q", got, defaultCSV)
+	}
+	if got := Default.String(); got != defaultCSV {
+		t.Errorf("Default was %q, expected %q", got, defaultCSV)
+	}
+
+	// as in shim, the url is the remainder of the line.
+	e, err := ParseEntry("grub,3,Free Software Foundation,grub,2.06,https://example.com/a,b")
+	if err != nil {
+		t.Fatalf("ParseEntry failed: %v", err)
+	}
+	if e.VendorURL != "https://example.com/a,b" {
+		t.Errorf("VendorURL was %q", e.VendorURL)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"linux.puzzleos,1,PuzzleOS,linux,1,NOURL\n",
+		"sbat,2,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md\n",
+		defaultCSV + "grub,1,Free Software Foundation,grub\n",
+		defaultCSV + "grub,x,Free Software Foundation,grub,2.06,https://www.gnu.org/software/grub/\n",
+		defaultCSV + "grub,0,Free Software Foundation,grub,2.06,https://www.gnu.org/software/grub/\n",
+		defaultCSV + ",1,Free Software Foundation,grub,2.06,https://www.gnu.org/software/grub/\n",
+		defaultCSV + "linux.puzzleos,2,PuzzleOS,linux,1,NOURL\n",
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Parse succeeded for %q", data)
+		}
+	}
+}
+
+func TestMergeBump(t *testing.T) {
+	grub := Entry{"grub", 3, "Free Software Foundation", "grub", "2.06", "https://www.gnu.org/software/grub/"}
+	linux := Entry{"linux.puzzleos", 5, "PuzzleOS", "linux", "6.1", "NOURL"}
+
+	merged := Default.Merge(linux, grub)
+	if err := merged.Validate(); err != nil {
+		t.Fatalf("merged sbat was invalid: %v", err)
+	}
+	if len(merged) != 4 {
+		t.Fatalf("found %d entries, expected 4", len(merged))
+	}
+	if merged[2] != linux || merged[3] != grub {
+		t.Errorf("merged was %v", merged)
+	}
+	if Default.Entry("linux.puzzleos").Generation != 1 {
+		t.Errorf("Merge modified its receiver")
+	}
+
+	bumped, err := Default.Bump("linux.puzzleos")
+	if err != nil {
+		t.Fatalf("Bump failed: %v", err)
+	}
+	if gen := bumped.Entry("linux.puzzleos").Generation; gen != 2 {
+		t.Errorf("generation after Bump was %d, expected 2", gen)
+	}
+	if Default.Entry("linux.puzzleos").Generation != 1 {
+		t.Errorf("Bump modified its receiver")
+	}
+	if _, err := Default.Bump("grub"); err == nil {
+		t.Errorf("Bump of a missing component succeeded")
+	}
+}
+
+func TestLevelCheck(t *testing.T) {
+	l, err := ParseLevel([]byte("sbat,1,2023012900\nshim,2\ngrub,3\nlinux.puzzleos,2\n"))
+	if err != nil {
+		t.Fatalf("ParseLevel failed: %v", err)
+	}
+	if l.Datestamp != "2023012900" || len(l.Revocations) != 4 {
+		t.Errorf("level was %+v", l)
+	}
+
+	err = l.Check(Default)
+	var revoked *RevokedError
+	if !errors.As(err, &revoked) {
+		t.Fatalf("Check returned %v, expected a RevokedError", err)
+	}
+	if len(revoked.Revoked) != 1 || revoked.Revoked[0].Component != "linux.puzzleos" {
+		t.Errorf("revoked was %v", revoked.Revoked)
+	}
+
+	bumped, err := Default.Bump("linux.puzzleos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Check(bumped); err != nil {
+		t.Errorf("Check of bumped sbat failed: %v", err)
+	}
+	if err := l.Check(SBAT{}); err == nil {
+		t.Errorf("Check of empty sbat succeeded")
+	}
+
+	for _, data := range []string{"", "grub,2\n", "sbat\n", "sbat,1\ngrub,x\n"} {
+		if _, err := ParseLevel([]byte(data)); err == nil {
+			t.Errorf("ParseLevel succeeded for %q", data)
+		}
+	}
+}
@@ -2,11 +2,10 @@ package shim
 
 import (
 	"bytes"
+	"crypto/x509"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
 	"unsafe"
 
 	efi "github.com/canonical/go-efilib"
@@ -67,30 +66,100 @@ func VendorDBSectionWrite(writer io.Writer, sigdb, sigdbx efi.SignatureDatabase)
 	return nil
 }
 
-// SetVendorDB - set the VendorDB inside existing file "shim"
-//  with provided db and dbx
-func SetVendorDB(shim string, db, dbx efi.SignatureDatabase) error {
-	fp, err := ioutil.TempFile("", "setvendordb")
+// ParseVendorDB - return the db and dbx from the content of a shim
+// .vendor_cert section.  Shim built with VENDOR_CERT_FILE has a single
+// DER certificate rather than a db; it is returned as a db holding
+// that certificate, see VendorCert.
+func ParseVendorDB(data []byte) (efi.SignatureDatabase, efi.SignatureDatabase, error) {
+	table, err := readCertTable(data)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	db, _, err := readVendorDB(data, "db", table.AuthOffset, table.AuthSize)
+	if err != nil {
+		return nil, nil, err
 	}
-	defer os.Remove(fp.Name())
+	dbx, _, err := readVendorDB(data, "dbx", table.DeAuthOffset, table.DeAuthSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, dbx, nil
+}
 
-	if err := VendorDBSectionWrite(fp, db, dbx); err != nil {
-		fp.Close()
-		return err
+// VendorCert - return the DER certificate in the content of a shim
+// .vendor_cert section if shim was built with VENDOR_CERT_FILE, or nil
+// if the section holds a db.  Shim measures an image allowed by the
+// certificate as "Shim" in ShimLockGUID with the certificate as data,
+// rather than as an EFI_SIGNATURE_DATA of vendor_db.
+func VendorCert(data []byte) ([]byte, error) {
+	table, err := readCertTable(data)
+	if err != nil {
+		return nil, err
 	}
+	_, cert, err := readVendorDB(data, "db", table.AuthOffset, table.AuthSize)
+	return cert, err
+}
 
-	fp.Close()
+func readCertTable(data []byte) (shimCertTable, error) {
+	var table shimCertTable
+	if err := binary.Read(bytes.NewReader(data), nativeEndian, &table); err != nil {
+		return table, fmt.Errorf("Failed reading cert table: %v", err)
+	}
+	return table, nil
+}
 
-	sections := []obj.SectionInput{
-		{Name: ".vendor_cert", VMA: 0xb4000, Path: fp.Name()}}
+// readVendorDB - read the db or dbx called name at offset in the content
+// of a .vendor_cert section.  If it is a single certificate rather than
+// a db, cert is its DER and db holds it.
+func readVendorDB(data []byte, name string, offset, size uint32) (db efi.SignatureDatabase, cert []byte, err error) {
+	if size == 0 {
+		return efi.SignatureDatabase{}, nil, nil
+	}
+	if uint64(offset)+uint64(size) > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("%s at %d size %d is past end of section", name, offset, size)
+	}
+	buf := data[offset : offset+size]
+	db, err = efi.ReadSignatureDatabase(bytes.NewReader(buf))
+	if err == nil {
+		return db, nil, nil
+	}
+	if _, cerr := x509.ParseCertificate(buf); cerr != nil {
+		return nil, nil, fmt.Errorf("%s is neither a signature database (%v) nor a certificate (%v)", name, err, cerr)
+	}
+	return efi.SignatureDatabase{&efi.SignatureList{
+		Type:       efi.CertX509Guid,
+		Signatures: []*efi.SignatureData{{Data: buf}},
+	}}, buf, nil
+}
 
-	if err := obj.SetSections(shim, sections...); err != nil {
+// SetVendorDB - set the VendorDB inside existing file "shim" with
+// provided db and dbx.
+//
+// shim finds the vendor db through the link-time address of its
+// cert_table, so the .vendor_cert section must stay where it is.  It is
+// an error if the new content does not fit there.
+func SetVendorDB(shim string, db, dbx efi.SignatureDatabase) error {
+	p, err := obj.ReadPEFile(shim)
+	if err != nil {
 		return err
 	}
+	s := p.Section(".vendor_cert")
+	if s == nil {
+		return fmt.Errorf("%s has no .vendor_cert section", shim)
+	}
+	rva := s.VirtualAddress
 
-	return nil
+	var b bytes.Buffer
+	if err := VendorDBSectionWrite(&b, db, dbx); err != nil {
+		return err
+	}
+
+	if _, err := p.SetSection(".vendor_cert", b.Bytes(), rva, 0); err != nil {
+		return fmt.Errorf("vendor db of %d bytes does not fit at the .vendor_cert address 0x%x of %s: %w",
+			b.Len(), rva, shim, err)
+	}
+
+	return p.WriteFile(shim)
 }
 
 func init() {
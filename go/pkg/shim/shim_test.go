@@ -2,8 +2,21 @@ package shim
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/project-machine/bootkit/go/pkg/obj"
+	"github.com/project-machine/bootkit/go/pkg/obj/objtest"
 )
 
 func TestShimHead(t *testing.T) {
@@ -35,3 +48,134 @@ func TestShimHead(t *testing.T) {
 		t.Errorf("ctable.AuthSize found %d, expected %d", ctable.DeAuthSize, dbxSize)
 	}
 }
+
+func testCertDER(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "shim test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestParseVendorDB(t *testing.T) {
+	der := testCertDER(t)
+	owner := efi.MakeGUID(0x326aa6de, 0xa82d, 0x4fd7, 0x8015, [...]uint8{0x2d, 0xb8, 0x04, 0xae, 0xa8, 0xe7})
+	db := efi.SignatureDatabase{&efi.SignatureList{
+		Type:       efi.CertX509Guid,
+		Signatures: []*efi.SignatureData{{Owner: owner, Data: der}},
+	}}
+
+	var b bytes.Buffer
+	if err := VendorDBSectionWrite(&b, db, efi.SignatureDatabase{}); err != nil {
+		t.Fatalf("VendorDBSectionWrite: %v", err)
+	}
+
+	foundDB, foundDBX, err := ParseVendorDB(b.Bytes())
+	if err != nil {
+		t.Fatalf("ParseVendorDB: %v", err)
+	}
+	if len(foundDBX) != 0 {
+		t.Errorf("found %d dbx entries, expected 0", len(foundDBX))
+	}
+	if len(foundDB) != 1 || len(foundDB[0].Signatures) != 1 {
+		t.Fatalf("unexpected db %v", foundDB)
+	}
+	sig := foundDB[0].Signatures[0]
+	if sig.Owner != owner || !bytes.Equal(sig.Data, der) {
+		t.Errorf("db entry did not match: owner %s", sig.Owner)
+	}
+
+	// a shim built with VENDOR_CERT_FILE has a bare certificate.
+	header, err := vendorDBSectionHeader(len(der), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foundDB, _, err = ParseVendorDB(append(header, der...))
+	if err != nil {
+		t.Fatalf("ParseVendorDB of a certificate: %v", err)
+	}
+	if len(foundDB) != 1 || !bytes.Equal(foundDB[0].Signatures[0].Data, der) {
+		t.Errorf("certificate was not returned as db")
+	}
+	if cert, err := VendorCert(append(header, der...)); err != nil || !bytes.Equal(cert, der) {
+		t.Errorf("VendorCert of a certificate returned %d bytes, %v", len(cert), err)
+	}
+	if cert, err := VendorCert(b.Bytes()); err != nil || cert != nil {
+		t.Errorf("VendorCert of a db returned %d bytes, %v", len(cert), err)
+	}
+}
+
+// testShim - write a PE image with a .vendor_cert section of size bytes
+// followed by a .data section, and return its path.
+func testShim(t *testing.T, size int) string {
+	t.Helper()
+	tmpd := t.TempDir()
+	path := filepath.Join(tmpd, "shim.efi")
+	if err := os.WriteFile(path, objtest.PE(t, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vendorCert := filepath.Join(tmpd, "vendor_cert")
+	if err := os.WriteFile(vendorCert, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(tmpd, "data")
+	if err := os.WriteFile(data, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := obj.SetSections(path,
+		obj.SectionInput{Name: ".vendor_cert", Path: vendorCert},
+		obj.SectionInput{Name: ".data", Path: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSetVendorDB(t *testing.T) {
+	der := testCertDER(t)
+	db := efi.SignatureDatabase{&efi.SignatureList{
+		Type:       efi.CertX509Guid,
+		Signatures: []*efi.SignatureData{{Data: der}},
+	}}
+
+	path := testShim(t, 16)
+	before, err := obj.ReadPEFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetVendorDB(path, db, efi.SignatureDatabase{}); err != nil {
+		t.Fatalf("SetVendorDB: %v", err)
+	}
+	after, err := obj.ReadPEFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := after.Section(".vendor_cert")
+	if s.VirtualAddress != before.Section(".vendor_cert").VirtualAddress {
+		t.Errorf(".vendor_cert moved from 0x%x to 0x%x", before.Section(".vendor_cert").VirtualAddress, s.VirtualAddress)
+	}
+	foundDB, _, err := ParseVendorDB(s.Content())
+	if err != nil || len(foundDB) != 1 || !bytes.Equal(foundDB[0].Signatures[0].Data, der) {
+		t.Errorf("vendor db was not written: %v %v", foundDB, err)
+	}
+
+	// a db too big for the space before .data must not be moved.
+	large := efi.SignatureDatabase{}
+	for len(large)*len(der) < 0x2000 {
+		large = append(large, db[0])
+	}
+	if err := SetVendorDB(path, large, efi.SignatureDatabase{}); err == nil {
+		t.Errorf("SetVendorDB succeeded with a vendor db that does not fit")
+	}
+}
@@ -0,0 +1,63 @@
+package signer
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Command - a key held by an external signing command.
+//
+// To sign, the command is run with the name of the hash (sha1, sha256,
+// sha384 or sha512) appended to its arguments and the digest on stdin.
+// It writes the signature to stdout and exits 0: a PKCS#1 v1.5
+// signature for an RSA key or an ASN.1 encoded signature for an ECDSA
+// key.  Anything it writes to stderr is included in the error if it
+// fails.
+type Command struct {
+	Args []string
+	pub  crypto.PublicKey
+}
+
+// OpenCommand - return a signer that runs command, a space separated
+// command line.  pub is the public key of the key that command signs
+// with, and is required.
+func OpenCommand(command string, pub crypto.PublicKey) (*Command, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty signing command")
+	}
+	if pub == nil {
+		return nil, fmt.Errorf("signing command %s needs the public key of a certificate", args[0])
+	}
+	return &Command{Args: args, pub: pub}, nil
+}
+
+// Public - return the public key of the signer.
+func (c *Command) Public() crypto.PublicKey {
+	return c.pub
+}
+
+// Sign - sign digest by running the command.
+func (c *Command) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := checkOpts(c.pub, digest, opts); err != nil {
+		return nil, err
+	}
+
+	args := append(append([]string{}, c.Args[1:]...), hashNames[opts.HashFunc()])
+	cmd := exec.Command(c.Args[0], args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(digest)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("signing command %s failed: %w: %s", c.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("signing command %s wrote no signature", c.Args[0])
+	}
+	return stdout.Bytes(), nil
+}
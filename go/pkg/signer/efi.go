@@ -0,0 +1,50 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/foxboron/go-uefi/efi/pecoff"
+)
+
+// CheckEFIKey - return an error if pub is not a key that can sign EFI
+// binaries.  The PKCS#7 encoder used for Authenticode marks every
+// signature as RSA, so firmware and shim reject a signature made with
+// any other kind of key.
+func CheckEFIKey(pub crypto.PublicKey) error {
+	kind := fmt.Sprintf("%T", pub)
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return nil
+	case *ecdsa.PublicKey:
+		kind = "ECDSA"
+	case ed25519.PublicKey:
+		kind = "Ed25519"
+	}
+	return fmt.Errorf("EFI binaries can only be signed with RSA keys, not %s", kind)
+}
+
+// SignEFI - return the EFI binary in data with an Authenticode signature
+// by key, whose certificate is cert, appended.  It is an error if key is
+// not an RSA key, see CheckEFIKey.
+func SignEFI(data []byte, cert *x509.Certificate, key crypto.Signer) ([]byte, error) {
+	if err := CheckEFIKey(key.Public()); err != nil {
+		return nil, err
+	}
+
+	// PECOFFChecksum modifies the image it is given.
+	ctx := pecoff.PECOFFChecksum(append([]byte{}, data...))
+	sig, err := pecoff.CreateSignature(ctx, cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating signature: %w", err)
+	}
+	signed, err := pecoff.AppendToBinary(ctx, sig)
+	if err != nil {
+		return nil, fmt.Errorf("failed appending signature: %w", err)
+	}
+	return signed, nil
+}
@@ -0,0 +1,361 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11URI - the parts of an RFC 7512 PKCS#11 URI that select a key.
+type PKCS11URI struct {
+	// Token - the label of the token.
+	Token string
+	// Serial - the serial number of the token.
+	Serial string
+	// Object - the label of the key.
+	Object string
+	// ID - the CKA_ID of the key.
+	ID []byte
+	// ModulePath - the path of the PKCS#11 module to load.
+	ModulePath string
+	// PIN - the user PIN, from pin-value or the file in pin-source.
+	PIN string
+}
+
+// ParsePKCS11URI - parse an RFC 7512 PKCS#11 URI.  module-path is
+// required, and one of object or id.
+func ParsePKCS11URI(uri string) (*PKCS11URI, error) {
+	if !strings.HasPrefix(uri, pkcs11Scheme) {
+		return nil, fmt.Errorf("%q is not a pkcs11 uri", uri)
+	}
+	path, query, _ := strings.Cut(strings.TrimPrefix(uri, pkcs11Scheme), "?")
+
+	u := &PKCS11URI{}
+	pinSource := ""
+	for _, attrs := range []struct {
+		s, sep string
+	}{{path, ";"}, {query, "&"}} {
+		if attrs.s == "" {
+			continue
+		}
+		for _, attr := range strings.Split(attrs.s, attrs.sep) {
+			k, v, ok := strings.Cut(attr, "=")
+			if !ok {
+				return nil, fmt.Errorf("bad pkcs11 uri attribute %q", attr)
+			}
+			value, err := url.PathUnescape(v)
+			if err != nil {
+				return nil, fmt.Errorf("bad pkcs11 uri attribute %q: %w", attr, err)
+			}
+			switch k {
+			case "token":
+				u.Token = value
+			case "serial":
+				u.Serial = value
+			case "object":
+				u.Object = value
+			case "id":
+				u.ID = []byte(value)
+			case "module-path":
+				u.ModulePath = value
+			case "pin-value":
+				u.PIN = value
+			case "pin-source":
+				pinSource = value
+			}
+		}
+	}
+
+	if pinSource != "" {
+		content, err := os.ReadFile(strings.TrimPrefix(pinSource, fileScheme))
+		if err != nil {
+			return nil, fmt.Errorf("failed reading pin-source: %w", err)
+		}
+		u.PIN = strings.TrimRight(string(content), "\r\n")
+	}
+	if u.ModulePath == "" {
+		return nil, fmt.Errorf("pkcs11 uri has no module-path")
+	}
+	if u.Object == "" && u.ID == nil {
+		return nil, fmt.Errorf("pkcs11 uri has no object or id")
+	}
+	return u, nil
+}
+
+// PKCS11 - a key in a PKCS#11 token.  The key never leaves the token;
+// digests are sent to it to sign.
+type PKCS11 struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+	// mu - a session may only be used by one thread at a time.
+	mu sync.Mutex
+}
+
+// OpenPKCS11 - open the key named by the PKCS#11 URI uri, logging in to
+// its token with the PIN in uri if there is one.  The public key is read
+// from the token, or is pub if the token has none.
+func OpenPKCS11(uri string, pub crypto.PublicKey) (*PKCS11, error) {
+	u, err := ParsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := pkcs11.New(u.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed loading pkcs11 module %s", u.ModulePath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed initializing pkcs11 module %s: %w", u.ModulePath, err)
+	}
+	p := &PKCS11{ctx: ctx}
+	if err := p.open(u, pub); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PKCS11) open(u *PKCS11URI, pub crypto.PublicKey) error {
+	slot, err := findSlot(p.ctx, u)
+	if err != nil {
+		return err
+	}
+	if p.session, err = p.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION); err != nil {
+		return fmt.Errorf("failed opening pkcs11 session: %w", err)
+	}
+	if u.PIN != "" {
+		err := p.ctx.Login(p.session, pkcs11.CKU_USER, u.PIN)
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return fmt.Errorf("failed logging in to pkcs11 token: %w", err)
+		}
+	}
+
+	if p.key, err = p.findObject(pkcs11.CKO_PRIVATE_KEY, u); err != nil {
+		return err
+	}
+	if p.key == 0 {
+		return fmt.Errorf("no private key matching %s", describeKey(u))
+	}
+
+	pubKey, err := p.findObject(pkcs11.CKO_PUBLIC_KEY, u)
+	if err != nil {
+		return err
+	}
+	if pubKey != 0 {
+		if p.pub, err = p.readPublicKey(pubKey); err != nil {
+			return err
+		}
+	} else if pub != nil {
+		p.pub = pub
+	} else {
+		return fmt.Errorf("no public key matching %s", describeKey(u))
+	}
+	return nil
+}
+
+// Close - log out and release the module.
+func (p *PKCS11) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ctx == nil {
+		return nil
+	}
+	if p.session != 0 {
+		p.ctx.Logout(p.session)
+		p.ctx.CloseSession(p.session)
+	}
+	err := p.ctx.Finalize()
+	p.ctx.Destroy()
+	p.ctx = nil
+	return err
+}
+
+// Public - return the public key of the signer.
+func (p *PKCS11) Public() crypto.PublicKey {
+	return p.pub
+}
+
+// digestInfoPrefixes - the DER DigestInfo prefix of each hash, which
+// CKM_RSA_PKCS expects before the digest.
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Sign - sign digest with the key in the token.
+func (p *PKCS11) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := checkOpts(p.pub, digest, opts); err != nil {
+		return nil, err
+	}
+
+	var mech *pkcs11.Mechanism
+	data := digest
+	if _, ok := p.pub.(*rsa.PublicKey); ok {
+		mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		data = append(append([]byte{}, digestInfoPrefixes[opts.HashFunc()]...), digest...)
+	} else {
+		mech = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ctx == nil {
+		return nil, fmt.Errorf("pkcs11 signer is closed")
+	}
+	if err := p.ctx.SignInit(p.session, []*pkcs11.Mechanism{mech}, p.key); err != nil {
+		return nil, fmt.Errorf("pkcs11 sign init failed: %w", err)
+	}
+	sig, err := p.ctx.Sign(p.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11 sign failed: %w", err)
+	}
+	if mech.Mechanism == pkcs11.CKM_ECDSA {
+		return ecdsaFromRaw(sig)
+	}
+	return sig, nil
+}
+
+func describeKey(u *PKCS11URI) string {
+	s := fmt.Sprintf("object=%q", u.Object)
+	if u.ID != nil {
+		s += fmt.Sprintf(" id=%x", u.ID)
+	}
+	return s + fmt.Sprintf(" in token %q", u.Token)
+}
+
+// findSlot - return the slot of the token that u names.
+func findSlot(ctx *pkcs11.Ctx, u *PKCS11URI) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed listing pkcs11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, fmt.Errorf("failed reading pkcs11 token info: %w", err)
+		}
+		if u.Token != "" && strings.TrimRight(info.Label, " ") != u.Token {
+			continue
+		}
+		if u.Serial != "" && strings.TrimRight(info.SerialNumber, " ") != u.Serial {
+			continue
+		}
+		return slot, nil
+	}
+	return 0, fmt.Errorf("no pkcs11 token matching %q", u.Token)
+}
+
+// findObject - return the object of class that u names, or 0 if there
+// is none.  It is an error if more than one object matches.
+func (p *PKCS11) findObject(class uint, u *PKCS11URI) (pkcs11.ObjectHandle, error) {
+	tmpl := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if u.Object != "" {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_LABEL, u.Object))
+	}
+	if u.ID != nil {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_ID, u.ID))
+	}
+	if err := p.ctx.FindObjectsInit(p.session, tmpl); err != nil {
+		return 0, fmt.Errorf("failed finding pkcs11 objects: %w", err)
+	}
+	defer p.ctx.FindObjectsFinal(p.session)
+
+	objs, _, err := p.ctx.FindObjects(p.session, 2)
+	if err != nil {
+		return 0, fmt.Errorf("failed finding pkcs11 objects: %w", err)
+	}
+	switch len(objs) {
+	case 0:
+		return 0, nil
+	case 1:
+		return objs[0], nil
+	}
+	return 0, fmt.Errorf("more than one key matches %s", describeKey(u))
+}
+
+// namedCurves - the curves of EC keys, by the OID in CKA_EC_PARAMS.
+var namedCurves = map[string]elliptic.Curve{
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+// readPublicKey - return the RSA or EC public key of the object.
+func (p *PKCS11) readPublicKey(obj pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := p.ctx.GetAttributeValue(p.session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed reading pkcs11 key type: %w", err)
+	}
+	keyType := new(big.Int).SetBytes(reverse(attrs[0].Value)).Uint64()
+
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		attrs, err := p.ctx.GetAttributeValue(p.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed reading pkcs11 RSA public key: %w", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+
+	case pkcs11.CKK_EC:
+		attrs, err := p.ctx.GetAttributeValue(p.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed reading pkcs11 EC public key: %w", err)
+		}
+		var oid asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(attrs[0].Value, &oid); err != nil {
+			return nil, fmt.Errorf("bad pkcs11 EC params: %w", err)
+		}
+		curve, ok := namedCurves[oid.String()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported EC curve %s", oid)
+		}
+		// CKA_EC_POINT is a DER octet string holding the point.
+		var point []byte
+		if _, err := asn1.Unmarshal(attrs[1].Value, &point); err != nil {
+			return nil, fmt.Errorf("bad pkcs11 EC point: %w", err)
+		}
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, fmt.Errorf("bad pkcs11 EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported pkcs11 key type 0x%x", keyType)
+}
+
+// reverse - return a copy of b, reversed: CK_ULONG attributes are in
+// host, little endian, order.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
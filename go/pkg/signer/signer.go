@@ -0,0 +1,113 @@
+// Package signer provides crypto.Signer implementations for keys that
+// may not be files on disk: keys in a PKCS#11 token and keys held by an
+// external signing command.
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/project-machine/bootkit/go/pkg/cert"
+)
+
+const (
+	// pkcs11Scheme - the prefix of an RFC 7512 PKCS#11 URI.
+	pkcs11Scheme = "pkcs11:"
+	// execScheme - the prefix of an external signing command.
+	execScheme = "exec:"
+	// fileScheme - the optional prefix of a PEM key file.
+	fileScheme = "file:"
+)
+
+// Open - return a crypto.Signer for the key named by uri, which is one of:
+//
+//	pkcs11:token=T;object=O?module-path=M&pin-source=file:P
+//	    a key in a PKCS#11 token, see OpenPKCS11.
+//	exec:command [args...]
+//	    a key held by an external command, see OpenCommand.
+//	[file:]key.pem
+//	    a PEM private key file, see cert.SignerFromPem; passphrase
+//	    decrypts it if it is encrypted.
+//
+// pub is the public key of the certificate that the key is used with, or
+// nil.  Backends that cannot read the public key themselves use it.
+//
+// Use Close to release the signer when done.
+func Open(uri string, pub crypto.PublicKey, passphrase []byte) (crypto.Signer, error) {
+	var s crypto.Signer
+	var err error
+	switch {
+	case strings.HasPrefix(uri, pkcs11Scheme):
+		s, err = OpenPKCS11(uri, pub)
+	case strings.HasPrefix(uri, execScheme):
+		s, err = OpenCommand(strings.TrimPrefix(uri, execScheme), pub)
+	default:
+		s, err = cert.SignerFromPemFile(strings.TrimPrefix(uri, fileScheme), passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close - release the resources of a signer returned by Open.
+func Close(s crypto.Signer) error {
+	if c, ok := s.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// hashNames - the names of the hashes that signers support, as passed
+// to signing commands.
+var hashNames = map[crypto.Hash]string{
+	crypto.SHA1:   "sha1",
+	crypto.SHA256: "sha256",
+	crypto.SHA384: "sha384",
+	crypto.SHA512: "sha512",
+}
+
+// checkOpts - return an error if a backend that signs with PKCS#1 v1.5
+// or ECDSA cannot sign a digest with opts.
+func checkOpts(pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) error {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return fmt.Errorf("RSA-PSS signatures are not supported")
+	}
+	h := opts.HashFunc()
+	if _, ok := hashNames[h]; !ok {
+		return fmt.Errorf("unsupported hash %v", h)
+	}
+	if len(digest) != h.Size() {
+		return fmt.Errorf("digest is %d bytes, expected %d for %v", len(digest), h.Size(), h)
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// ecdsaSignature - the ASN.1 encoding of an ECDSA signature, as
+// crypto.Signer returns it.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// ecdsaFromRaw - return the ASN.1 encoding of the raw r || s ECDSA
+// signature that PKCS#11 returns.
+func ecdsaFromRaw(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, fmt.Errorf("bad ECDSA signature length %d", len(raw))
+	}
+	n := len(raw) / 2
+	return asn1.Marshal(ecdsaSignature{
+		R: new(big.Int).SetBytes(raw[:n]),
+		S: new(big.Int).SetBytes(raw[n:]),
+	})
+}
@@ -0,0 +1,359 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/project-machine/bootkit/go/pkg/obj"
+	"github.com/project-machine/bootkit/go/pkg/obj/objtest"
+)
+
+// TestMain - when run as the signing command of TestCommand, sign
+// stdin with the key in SIGNER_TEST_KEY instead of running tests.
+func TestMain(m *testing.M) {
+	if path := os.Getenv("SIGNER_TEST_KEY"); path != "" {
+		if err := testSigningCommand(path, os.Args[len(os.Args)-1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func testSigningCommand(keyPath, hash string) error {
+	if hash != "sha256" {
+		return fmt.Errorf("unexpected hash %s", hash)
+	}
+	s, err := Open(keyPath, nil, nil)
+	if err != nil {
+		return err
+	}
+	digest, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	sig, err := s.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(sig)
+	return err
+}
+
+func writeTestKey(t *testing.T, dir string) (string, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+func checkSigner(t *testing.T, s crypto.Signer) {
+	t.Helper()
+	digest := sha256.Sum256([]byte("bootkit"))
+	sig, err := s.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	switch pub := s.Public().(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			t.Errorf("bad RSA signature: %v", err)
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			t.Errorf("bad ECDSA signature")
+		}
+	default:
+		t.Fatalf("unexpected public key %T", pub)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	path, key := writeTestKey(t, t.TempDir())
+	for _, uri := range []string{path, "file:" + path} {
+		s, err := Open(uri, nil, nil)
+		if err != nil {
+			t.Fatalf("Open(%s): %v", uri, err)
+		}
+		if !key.PublicKey.Equal(s.Public()) {
+			t.Errorf("Open(%s) returned the wrong key", uri)
+		}
+		checkSigner(t, s)
+		if err := Close(s); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}
+
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.pem"), nil, nil); err == nil {
+		t.Errorf("Open succeeded on a missing key")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	path, key := writeTestKey(t, t.TempDir())
+	t.Setenv("SIGNER_TEST_KEY", path)
+
+	if _, err := Open("exec:"+os.Args[0], nil, nil); err == nil {
+		t.Errorf("Open of a command without a public key succeeded")
+	}
+
+	s, err := Open("exec:"+os.Args[0], &key.PublicKey, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	checkSigner(t, s)
+
+	digest := sha256.Sum256([]byte("bootkit"))
+	if _, err := s.Sign(rand.Reader, digest[:], crypto.SHA384); err == nil {
+		t.Errorf("Sign succeeded with a digest of the wrong size")
+	}
+	if _, err := s.Sign(rand.Reader, digest[:], &rsa.PSSOptions{Hash: crypto.SHA256}); err == nil {
+		t.Errorf("Sign succeeded with RSA-PSS")
+	}
+
+	// the command fails when asked for another hash.
+	digest384 := make([]byte, crypto.SHA384.Size())
+	if _, err := s.Sign(rand.Reader, digest384, crypto.SHA384); err == nil {
+		t.Errorf("Sign succeeded when the command failed")
+	}
+}
+
+func TestParsePKCS11URI(t *testing.T) {
+	pinFile := filepath.Join(t.TempDir(), "pin")
+	if err := os.WriteFile(pinFile, []byte("1234\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := ParsePKCS11URI("pkcs11:token=my%20token;object=uki;id=%01%02?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=file:" + pinFile)
+	if err != nil {
+		t.Fatalf("ParsePKCS11URI: %v", err)
+	}
+	expected := PKCS11URI{
+		Token:      "my token",
+		Object:     "uki",
+		ID:         []byte{1, 2},
+		ModulePath: "/usr/lib/softhsm/libsofthsm2.so",
+		PIN:        "1234",
+	}
+	if fmt.Sprintf("%+v", *u) != fmt.Sprintf("%+v", expected) {
+		t.Errorf("parsed %+v, expected %+v", *u, expected)
+	}
+
+	for _, bad := range []string{
+		"token=t;object=o?module-path=/m.so",
+		"pkcs11:token=t;object=o",
+		"pkcs11:token=t?module-path=/m.so",
+		"pkcs11:token=t;object?module-path=/m.so",
+		"pkcs11:object=%zz?module-path=/m.so",
+	} {
+		if _, err := ParsePKCS11URI(bad); err == nil {
+			t.Errorf("ParsePKCS11URI(%q) succeeded", bad)
+		}
+	}
+}
+
+// TestPKCS11 - sign with keys generated in a new SoftHSM token.  It runs
+// only if SOFTHSM2_MODULE is the path of libsofthsm2.so.
+func TestPKCS11(t *testing.T) {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		t.Skip("SOFTHSM2_MODULE is not set")
+	}
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := os.MkdirAll(filepath.Join(dir, "tokens"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(conf, []byte("directories.tokendir = "+filepath.Join(dir, "tokens")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	const pin = "1234"
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatalf("failed loading %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	slots, err := ctx.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("no slots: %v", err)
+	}
+	if err := ctx.InitToken(slots[0], "so-pin", "bootkit"); err != nil {
+		t.Fatal(err)
+	}
+	slot, err := findSlot(ctx, &PKCS11URI{Token: "bootkit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Login(session, pkcs11.CKU_SO, "so-pin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.InitPIN(session, pin); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Logout(session)
+	if err := ctx.Login(session, pkcs11.CKU_USER, pin); err != nil {
+		t.Fatal(err)
+	}
+
+	// the DER OID of P-256.
+	p256Params := []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+	for _, k := range []struct {
+		label string
+		mech  uint
+		pub   []*pkcs11.Attribute
+	}{
+		{"rsa", pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		}},
+		{"ec", pkcs11.CKM_EC_KEY_PAIR_GEN, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, p256Params),
+		}},
+	} {
+		pub := append(k.pub,
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.label))
+		priv := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.label),
+		}
+		if _, _, err := ctx.GenerateKeyPair(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(k.mech, nil)}, pub, priv); err != nil {
+			t.Fatalf("generating %s key: %v", k.label, err)
+		}
+	}
+	ctx.Logout(session)
+	ctx.CloseSession(session)
+	ctx.Finalize()
+	ctx.Destroy()
+
+	for _, label := range []string{"rsa", "ec"} {
+		s, err := Open(fmt.Sprintf("pkcs11:token=bootkit;object=%s?module-path=%s&pin-value=%s", label, module, pin), nil, nil)
+		if err != nil {
+			t.Fatalf("Open %s: %v", label, err)
+		}
+		checkSigner(t, s)
+		if err := Close(s); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}
+
+	if _, err := Open("pkcs11:token=bootkit;object=missing?module-path="+module+"&pin-value="+pin, nil, nil); err == nil {
+		t.Errorf("Open of a missing key succeeded")
+	}
+}
+
+func TestCheckEFIKey(t *testing.T) {
+	_, key := writeTestKey(t, t.TempDir())
+	if err := CheckEFIKey(&key.PublicKey); err != nil {
+		t.Errorf("CheckEFIKey of an RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckEFIKey(&ecKey.PublicKey); err == nil {
+		t.Errorf("CheckEFIKey of an ECDSA key succeeded")
+	}
+}
+
+// TestSignEFI - sign an image with an RSA key held by each backend and
+// key format, check that obj.Verify trusts the result, and check that
+// other keys are refused.
+func TestSignEFI(t *testing.T) {
+	efiSigner := objtest.NewSigner(t, "efi")
+	dir := t.TempDir()
+	writePem := func(name string, block *pem.Block) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(efiSigner.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := x509.MarshalPKCS1PrivateKey(efiSigner.Key)
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", pkcs1, []byte("secret"), x509.PEMCipherAES256) //nolint:staticcheck
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8Path := writePem("pkcs8.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	t.Setenv("SIGNER_TEST_KEY", pkcs8Path)
+
+	unsigned := objtest.PE(t, nil)
+	db := objtest.CertDB(efiSigner.Cert)
+	for _, tc := range []struct {
+		name       string
+		uri        string
+		passphrase []byte
+	}{
+		{"pkcs1", writePem("pkcs1.pem", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: pkcs1}), nil},
+		{"pkcs8", pkcs8Path, nil},
+		{"encrypted", writePem("encrypted.pem", encrypted), []byte("secret")},
+		{"exec", "exec:" + os.Args[0], nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := Open(tc.uri, efiSigner.Cert.PublicKey, tc.passphrase)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer Close(s)
+			signed, err := SignEFI(unsigned, efiSigner.Cert, s)
+			if err != nil {
+				t.Fatalf("SignEFI: %v", err)
+			}
+			v, err := obj.Verify(signed, db, nil)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if !v.Trusted() {
+				t.Errorf("image signed with a %s key is not trusted", tc.name)
+			}
+		})
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SignEFI(unsigned, efiSigner.Cert, ecKey); err == nil {
+		t.Errorf("SignEFI with an ECDSA key succeeded")
+	}
+}
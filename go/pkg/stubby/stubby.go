@@ -3,25 +3,23 @@ package stubby
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/project-machine/bootkit/go/pkg/obj"
 	"github.com/project-machine/bootkit/go/pkg/util"
 )
 
 // Smoosh - create unified kernel image 'uki' from stubby 'stubEfi'
-//    with the provided cmdline and using kernel file 'kernel' initramfs file 'initrd'
-//  objcopy
-//	   "--add-section=.cmdline=${cmdlinef}"
-//	   "--change-section-vma=.cmdline=0x30000"
-//     "--add-section=.sbat=$sbatf"
-//     "--change-section-vma=.sbat=0x50000"
-//     "--set-section-alignment=.sbat=512"
-//     "--add-section=.linux=$kernel"
-//     "--change-section-vma=.linux=0x2000000"
-//     "--add-section=.initrd=$initrd"
-//     "--change-section-vma=.initrd=0x3000000"
-//     "$stubefi" "$output"
-func Smoosh(stubEfi string, uki string, cmdline, sbat, kernel, initrd string) error {
+// with the provided cmdline and sbat, kernel file 'kernel' and
+// initramfs file 'initrd'.
+//
+// The sections are added in this order, each at the next free address
+// after those already in the image: .cmdline, .sbat aligned to 512
+// bytes, the sections in extra in the order given, .linux and .initrd.
+// extra are usually sections named in ExtraSections.
+func Smoosh(stubEfi string, uki string, cmdline, sbat, kernel, initrd string, extra ...obj.SectionInput) error {
 	if err := util.CopyFileContents(stubEfi, uki); err != nil {
 		return fmt.Errorf("Failed to copy %s -> %s", stubEfi, uki)
 	}
@@ -52,11 +50,100 @@ func Smoosh(stubEfi string, uki string, cmdline, sbat, kernel, initrd string) er
 	sbatFile.Close()
 
 	sections := []obj.SectionInput{
-		{Name: ".cmdline", VMA: 0x30000, Path: cmdlineFile.Name()},
-		{Name: ".sbat", VMA: 0x50000, Alignment: 512, Path: sbatFile.Name()},
-		{Name: ".linux", VMA: 0x2000000, Path: kernel},
-		{Name: ".initrd", VMA: 0x3000000, Path: initrd},
+		{Name: ".cmdline", Path: cmdlineFile.Name()},
+		{Name: ".sbat", Alignment: 512, Path: sbatFile.Name()},
 	}
+	sections = append(sections, extra...)
+	sections = append(sections,
+		obj.SectionInput{Name: ".linux", Path: kernel},
+		obj.SectionInput{Name: ".initrd", Path: initrd})
 
 	return obj.SetSections(uki, sections...)
 }
+
+// ExtraSections - optional sections of a unified kernel image that
+// systemd-stub and related tools understand.
+//
+//	.osrel   - os-release of the image
+//	.uname   - kernel version, as 'uname -r'
+//	.splash  - boot splash image, in bmp format
+//	.dtb     - device tree blob
+//	.pcrsig  - json with signatures of the expected PCR 11 values
+//	.pcrpkey - public key for verifying .pcrsig, in pem format
+var ExtraSections = []string{".osrel", ".uname", ".splash", ".dtb", ".pcrsig", ".pcrpkey"}
+
+// UKISections - the sections that Smoosh adds to a stub.
+var UKISections = append([]string{".linux", ".initrd", ".cmdline", ".sbat"}, ExtraSections...)
+
+// Unsmoosh - write sections of unified kernel image 'uki' to files in
+// 'dir', so that they can be passed to Smoosh again.  A section is
+// written to a file named without the leading '.', so .linux is
+// written to dir/linux.  If no sections are named, those of
+// UKISections that are present are written.  Returns the paths written.
+func Unsmoosh(uki string, dir string, sections ...string) ([]string, error) {
+	p, err := obj.ReadPEFile(uki)
+	if err != nil {
+		return nil, err
+	}
+
+	required := len(sections) != 0
+	if !required {
+		sections = UKISections
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	written := []string{}
+	for _, name := range sections {
+		s := p.Section(name)
+		if s == nil {
+			if required {
+				return written, fmt.Errorf("%s has no section %s", uki, name)
+			}
+			continue
+		}
+		path := filepath.Join(dir, strings.TrimPrefix(name, "."))
+		if err := os.WriteFile(path, s.Content(), 0644); err != nil {
+			return written, err
+		}
+		written = append(written, path)
+	}
+
+	return written, nil
+}
+
+// Update - replace sections of unified kernel image 'uki' with the
+// content in 'sections', keyed by section name, and write the result
+// to 'output', which may be the same as 'uki'.  Other sections are
+// kept.  A replaced section stays where it is if the new content fits,
+// otherwise it moves to the end of the image.
+//
+// Any Authenticode signature is removed as it is no longer valid.
+// Returns true if there was one.
+func Update(uki string, output string, sections map[string][]byte) (bool, error) {
+	p, err := obj.ReadPEFile(uki)
+	if err != nil {
+		return false, err
+	}
+
+	names := []string{}
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		alignment := uint32(0)
+		if name == ".sbat" {
+			alignment = 512
+		}
+		if _, err := p.SetSection(name, sections[name], 0, alignment); err != nil {
+			return false, err
+		}
+	}
+
+	signed := p.IsSigned()
+	return signed, p.WriteFile(output)
+}